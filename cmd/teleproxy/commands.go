@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/datawire/teleproxy/internal/pkg/api"
+	"github.com/datawire/teleproxy/internal/pkg/interceptor"
+	"github.com/datawire/teleproxy/internal/pkg/route"
+	"github.com/datawire/teleproxy/pkg/teleproxy"
+)
+
+// Status is what `teleproxy status` reports about a running
+// teleproxy.
+type Status struct {
+	Ports     api.Ports      `json:"ports"`
+	Legacy    string         `json:"legacy,omitempty"`
+	Search    []string       `json:"search"`
+	Excludes  []string       `json:"excludes"`
+	Tables    map[string]int `json:"tables"`
+	Conflicts int            `json:"conflicts"`
+}
+
+// addCommands adds the subcommands that talk to the api of a running
+// teleproxy to tp.
+func addCommands(tp *cobra.Command, tele *teleproxy.Teleproxy) {
+	var output string
+	client := func() (*api.Client, error) {
+		if output != "" && output != "json" {
+			return nil, errors.Errorf("bad output format: %q (expected json)", output)
+		}
+		return tele.APIClient()
+	}
+	outputFlag := func(cmd *cobra.Command) {
+		cmd.Flags().StringVarP(&output, "output", "o", "", "output format ('json', default: human readable)")
+	}
+	command := func(cmd *cobra.Command) {
+		outputFlag(cmd)
+		tp.AddCommand(cmd)
+	}
+
+	command(&cobra.Command{
+		Use:   "status",
+		Short: "show the ports, search path, and tables of the running teleproxy",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			status, err := getStatus(c)
+			if err != nil {
+				return err
+			}
+			if output == "json" {
+				return writeJSON(cmd.OutOrStdout(), status)
+			}
+			writeStatus(cmd.OutOrStdout(), status)
+			return nil
+		},
+	})
+
+	command(&cobra.Command{
+		Use:   "tables [name]",
+		Short: "show the routing tables of the running teleproxy",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			var tables []route.Table
+			if len(args) == 0 {
+				err = c.Do(http.MethodGet, "/tables/", nil, &tables)
+			} else {
+				var table route.Table
+				err = c.Do(http.MethodGet, "/tables/"+url.PathEscape(args[0]), nil, &table)
+				tables = append(tables, table)
+			}
+			if err != nil {
+				return notFound(err, "table %s", args)
+			}
+			if output == "json" {
+				if len(args) > 0 {
+					return writeJSON(cmd.OutOrStdout(), tables[0])
+				}
+				return writeJSON(cmd.OutOrStdout(), tables)
+			}
+			writeTables(cmd.OutOrStdout(), tables)
+			return nil
+		},
+	})
+
+	command(&cobra.Command{
+		Use:   "resolve <name>",
+		Short: "show what a name resolves to according to the routing tables",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			var res api.Resolution
+			if err := c.Do(http.MethodGet, "/resolve/"+url.PathEscape(args[0]), nil, &res); err != nil {
+				return notFound(err, "name %s", args)
+			}
+			if output == "json" {
+				return writeJSON(cmd.OutOrStdout(), res)
+			}
+			writeResolution(cmd.OutOrStdout(), res)
+			return nil
+		},
+	})
+
+	command(&cobra.Command{
+		Use:   "search [path...]",
+		Short: "show the dns search path, or set it to the given paths",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			if len(args) > 0 {
+				if err := c.Do(http.MethodPost, "/search", args, nil); err != nil {
+					return err
+				}
+			}
+			var paths []string
+			if err := c.Do(http.MethodGet, "/search", nil, &paths); err != nil {
+				return err
+			}
+			if output == "json" {
+				return writeJSON(cmd.OutOrStdout(), paths)
+			}
+			for _, path := range paths {
+				fmt.Fprintln(cmd.OutOrStdout(), displayPath(path))
+			}
+			return nil
+		},
+	})
+
+	routes := &cobra.Command{
+		Use:   "routes",
+		Short: "add routes to or delete routes from a table of the running teleproxy",
+	}
+	tp.AddCommand(routes)
+	patch := func(cmd *cobra.Command, c *api.Client, table string, p route.Patch) error {
+		var patched route.Table
+		if err := c.Do(http.MethodPatch, "/tables/"+url.PathEscape(table), p, &patched); err != nil {
+			return err
+		}
+		if output == "json" {
+			return writeJSON(cmd.OutOrStdout(), patched)
+		}
+		writeTables(cmd.OutOrStdout(), []route.Table{patched})
+		return nil
+	}
+
+	var r route.Route
+	add := &cobra.Command{
+		Use:   "add <table>",
+		Short: "add a route to a table, creating the table if need be",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			if r.Target == "" && r.CNAME == "" {
+				// by default, send the traffic to the
+				// teleproxy's own proxy
+				var ports api.Ports
+				if err := c.Do(http.MethodGet, "/ports", nil, &ports); err != nil {
+					return err
+				}
+				r.Target = ports.Proxy
+			}
+			if err := r.Validate(); err != nil {
+				return err
+			}
+			return patch(cmd, c, args[0], route.Patch{Add: []route.Route{r}})
+		},
+	}
+	add.Flags().StringVar(&r.Name, "name", "", "name that resolves to the route's ip")
+	add.Flags().StringVar(&r.Ip, "ip", "", "address or CIDR to intercept")
+	add.Flags().StringVar(&r.Proto, "proto", "tcp", "protocol to intercept ('tcp' or 'udp')")
+	add.Flags().StringVar(&r.Port, "port", "", "ports to intercept, e.g. 80,443,8000-9000 (default: all)")
+	add.Flags().StringVar(&r.Target, "target", "", "port to redirect to (default: the teleproxy's proxy port)")
+	add.Flags().StringVar(&r.CNAME, "cname", "", "make the name an alias for this one instead")
+	outputFlag(add)
+	routes.AddCommand(add)
+
+	del := &cobra.Command{
+		Use:     "delete <table> <key>...",
+		Aliases: []string{"rm"},
+		Short:   "delete routes from a table by name, which deletes every address of the name, or by proto:ip:port",
+		Args:    cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			return patch(cmd, c, args[0], route.Patch{Remove: args[1:]})
+		},
+	}
+	outputFlag(del)
+	routes.AddCommand(del)
+}
+
+func getStatus(c *api.Client) (status Status, err error) {
+	if legacy := c.Legacy(); legacy != nil {
+		status.Legacy = legacy.Error()
+	}
+	if err = c.Do(http.MethodGet, "/ports", nil, &status.Ports); err != nil {
+		return status, errors.Wrap(err, "getting ports")
+	}
+	if err = c.Do(http.MethodGet, "/search", nil, &status.Search); err != nil {
+		return status, err
+	}
+	if err = c.Do(http.MethodGet, "/exclude", nil, &status.Excludes); err != nil {
+		return status, err
+	}
+	var tables []route.Table
+	if err = c.Do(http.MethodGet, "/tables/", nil, &tables); err != nil {
+		return status, err
+	}
+	status.Tables = make(map[string]int, len(tables))
+	for _, t := range tables {
+		status.Tables[t.Name] = len(t.Routes)
+	}
+	var conflicts []interceptor.Conflict
+	if err = c.Do(http.MethodGet, "/conflicts", nil, &conflicts); err != nil {
+		return status, err
+	}
+	status.Conflicts = len(conflicts)
+	return status, nil
+}
+
+// notFound turns a 404 for the thing named by what and args into a
+// friendlier error.
+func notFound(err error, what string, args []string) error {
+	if se, ok := err.(*api.StatusError); ok && se.Code == http.StatusNotFound && len(args) > 0 {
+		return errors.Errorf(what+": not found", args[0])
+	}
+	return err
+}
+
+func writeJSON(w io.Writer, obj interface{}) error {
+	bytes, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(bytes, '\n'))
+	return err
+}
+
+// displayPath shows the empty search path, which stands for the name
+// itself, as ".".
+func displayPath(path string) string {
+	if path == "" {
+		return "."
+	}
+	return path
+}
+
+func writeStatus(out io.Writer, s Status) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintf(w, "chain:\t%s\n", s.Ports.Chain)
+	fmt.Fprintf(w, "dns port:\t%s\n", s.Ports.DNS)
+	fmt.Fprintf(w, "proxy port:\t%s\n", s.Ports.Proxy)
+	fmt.Fprintf(w, "api port:\t%s\n", s.Ports.API)
+	if s.Legacy != "" {
+		fmt.Fprintf(w, "api:\tunversioned (%s)\n", s.Legacy)
+	}
+	paths := make([]string, len(s.Search))
+	for i, path := range s.Search {
+		paths[i] = displayPath(path)
+	}
+	fmt.Fprintf(w, "search:\t%s\n", strings.Join(paths, " "))
+	if len(s.Excludes) > 0 {
+		fmt.Fprintf(w, "excludes:\t%s\n", strings.Join(s.Excludes, " "))
+	}
+	names := make([]string, 0, len(s.Tables))
+	for name := range s.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "tables:\t%d\n", len(names))
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s:\t%d routes\n", name, s.Tables[name])
+	}
+	fmt.Fprintf(w, "conflicts:\t%d\n", s.Conflicts)
+}
+
+func writeTables(out io.Writer, tables []route.Table) {
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Name < tables[j].Name })
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "TABLE\tVERSION\tNAME\tPROTO\tIP\tPORT\tTARGET")
+	for _, t := range tables {
+		for _, r := range t.Routes {
+			target := r.Target
+			if r.CNAME != "" {
+				target = "cname " + r.CNAME
+			} else if r.Action != "" {
+				target = r.Action
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n", t.Name, t.Version,
+				dash(r.Name), r.Proto, dash(r.Ip), dash(r.Port), dash(target))
+		}
+	}
+}
+
+func writeResolution(out io.Writer, res api.Resolution) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	if res.CNAME != "" {
+		fmt.Fprintf(w, "%s\tCNAME\t%s\n", res.Name, res.CNAME)
+	}
+	for _, ip := range res.IPs {
+		fmt.Fprintf(w, "%s\tIP\t%s\n", res.Name, ip)
+	}
+	for _, srv := range res.SRV {
+		fmt.Fprintf(w, "%s\tSRV\t%d %d %d %s\n", res.Name, srv.Priority, srv.Weight, srv.Port, srv.Target)
+	}
+	for _, ptr := range res.PTR {
+		fmt.Fprintf(w, "%s\tPTR\t%s\n", res.Name, ptr)
+	}
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
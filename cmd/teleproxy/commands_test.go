@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+
+	"github.com/datawire/teleproxy/internal/pkg/api"
+	"github.com/datawire/teleproxy/internal/pkg/route"
+	"github.com/datawire/teleproxy/pkg/teleproxy"
+)
+
+func TestCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "commands")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "api.sock")
+
+	// a fake teleproxy api with one table
+	table := route.Table{Name: "foo", Version: 2, Routes: []route.Route{
+		{Name: "bar", Ip: "1.2.3.4", Proto: "tcp", Target: "1234"},
+	}}
+	var patch route.Patch
+	handler := http.NewServeMux()
+	reply := func(w http.ResponseWriter, obj interface{}) {
+		if err := json.NewEncoder(w).Encode(obj); err != nil {
+			t.Error(err)
+		}
+	}
+	handler.HandleFunc("/api/v1/ports", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, api.Ports{Chain: "teleproxy", DNS: "1233", Proxy: "1234", API: "5678"})
+	})
+	handler.HandleFunc("/api/v1/search", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, []string{"svc.cluster.local.", ""})
+	})
+	handler.HandleFunc("/api/v1/exclude", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, []string{})
+	})
+	handler.HandleFunc("/api/v1/conflicts", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, []string{})
+	})
+	handler.HandleFunc("/api/v1/tables/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/tables/":
+			reply(w, []route.Table{table})
+		case "/api/v1/tables/foo":
+			if r.Method == http.MethodPatch {
+				patch = route.Patch{}
+				if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+					t.Error(err)
+				}
+				table = table.Apply(patch)
+				table.Version++
+			}
+			reply(w, table)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	handler.HandleFunc("/api/v1/resolve/", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(ln)
+	defer server.Close()
+
+	run := func(args ...string) (string, error) {
+		tp := &cobra.Command{Use: "teleproxy", SilenceErrors: true, SilenceUsage: true}
+		addCommands(tp, &teleproxy.Teleproxy{APISocket: socket})
+		var out bytes.Buffer
+		tp.SetOutput(&out)
+		tp.SetArgs(args)
+		err := tp.Execute()
+		return out.String(), err
+	}
+
+	out, err := run("status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"proxy port:  1234", "search:      svc.cluster.local. .", "foo:       1 routes"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("status: expected %q in:\n%s", expected, out)
+		}
+	}
+
+	out, err = run("tables", "foo", "-o", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got route.Table
+	if err := json.Unmarshal([]byte(out), &got); err != nil || got.Name != "foo" || len(got.Routes) != 1 {
+		t.Errorf("tables: got %v, %v from:\n%s", got, err, out)
+	}
+
+	if _, err := run("tables", "nonexistent"); err == nil || err.Error() != "table nonexistent: not found" {
+		t.Errorf("tables: expected not found, got %v", err)
+	}
+	if _, err := run("resolve", "nonexistent"); err == nil || err.Error() != "name nonexistent: not found" {
+		t.Errorf("resolve: expected not found, got %v", err)
+	}
+	if _, err := run("status", "-o", "yaml"); err == nil {
+		t.Error("status: expected an error for -o yaml")
+	}
+
+	// the target defaults to the proxy port
+	out, err = run("routes", "add", "foo", "--name", "baz", "--ip", "1.2.3.5", "--port", "80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patch.Add) != 1 || patch.Add[0].Target != "1234" || patch.Add[0].Proto != "tcp" {
+		t.Errorf("routes add: got %+v", patch)
+	}
+	if !strings.Contains(out, "foo    3        baz   tcp    1.2.3.5  80    1234") {
+		t.Errorf("routes add: got:\n%s", out)
+	}
+
+	if _, err := run("routes", "delete", "foo", "bar", "baz"); err != nil {
+		t.Fatal(err)
+	}
+	if len(patch.Remove) != 2 || len(table.Routes) != 0 {
+		t.Errorf("routes delete: got %+v, %+v", patch, table)
+	}
+}
@@ -24,13 +24,38 @@ func main() {
 	}
 
 	tp.Flags().BoolVar(&tele.Version, "version", false, "alias for '-mode=version'")
-	tp.Flags().StringVar(&tele.Mode, "mode", "", "mode of operation ('intercept', 'bridge', or 'version')")
+	tp.Flags().StringVar(&tele.Mode, "mode", "", "mode of operation ('intercept', 'bridge', 'cleanup', or 'version')")
 	tp.Flags().StringVar(&tele.Kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file")
 	tp.Flags().StringVar(&tele.Context, "context", "", "context to use (default: the current context)")
 	tp.Flags().StringVar(&tele.Namespace, "namespace", "",
 		"namespace to use (default: the current namespace for the context")
 	tp.Flags().StringVar(&tele.DNSIP, "dns", "", "dns ip address")
-	tp.Flags().StringVar(&tele.FallbackIP, "fallback", "", "dns fallback")
+	tp.Flags().StringSliceVar(&tele.FallbackIPs, "fallback", nil,
+		"dns fallback servers, tried in order (default: the other nameservers in /etc/resolv.conf)")
+	tp.Flags().StringArrayVar(&tele.DNSForwards, "dns-forward", nil,
+		"send dns queries for a domain suffix to other servers, as suffix=server[,server...] (may be repeated)")
+	tp.Flags().StringArrayVar(&tele.Dialers, "dialer", nil,
+		"define a dialer for tables to connect through, as name=direct, name=socks5://host:port, or name=http://host:port (may be repeated)")
+	tp.Flags().StringVar(&tele.NATBackend, "nat-backend", "",
+		"linux firewall backend ('iptables' or 'nftables', default: iptables if installed)")
+	tp.Flags().StringSliceVar(&tele.Excludes, "exclude", nil,
+		"address, CIDR, or domain suffix that is never intercepted (may be repeated)")
+	tp.Flags().StringVar(&tele.RoutesFile, "routes-file", "",
+		"YAML or JSON file of routing tables to apply, and reapply whenever it changes (unnamed tables are called 'static')")
+	tp.Flags().StringVar(&tele.DNSPort, "dns-port", "",
+		"port to redirect dns queries to, or 0 to pick a free one (default: "+teleproxy.DNSRedirPort+")")
+	tp.Flags().StringVar(&tele.ProxyPort, "proxy-port", "",
+		"port to redirect intercepted connections to, or 0 to pick a free one (default: "+teleproxy.ProxyRedirPort+")")
+	tp.PersistentFlags().StringVar(&tele.ChainName, "chain-name", "",
+		"name of the firewall chain or table to install rules in, so that several teleproxies can run side by side (default: "+teleproxy.DefaultChainName+")")
+	tp.PersistentFlags().StringVar(&tele.APITokenFile, "api-token-file", "",
+		"file that the bearer token for the /api/v1 api is written to, readable only by root (default: /var/run/teleproxy-<chain-name>.token)")
+	tp.PersistentFlags().StringVar(&tele.APISocket, "api-socket", "",
+		"serve the /api/v1 api on this unix socket instead of with a bearer token")
+	tp.Flags().IntVar(&tele.APISocketUID, "api-socket-uid", -1,
+		"uid that may use the api socket besides root (default: $SUDO_UID)")
+	tp.Flags().BoolVar(&tele.NoLegacyAPI, "no-legacy-api", false,
+		"don't serve the unversioned, unauthenticated api")
 	tp.Flags().BoolVar(&tele.NoSearch, "no-search-override", false, "disable dns search override")
 	tp.Flags().BoolVar(&tele.NoCheck, "no-check", false, "disable self check")
 
@@ -38,6 +63,8 @@ func main() {
 		return teleproxy.RunTeleproxy(tele, Version)
 	}
 
+	addCommands(tp, tele)
+
 	err := tp.Execute()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
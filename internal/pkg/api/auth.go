@@ -0,0 +1,174 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Auth says who may use the api. The versioned api, under /api/v1/,
+// and the metrics are only served to requests that carry the bearer
+// Token, and to whoever is let in through the Socket. The unversioned
+// api is what older clients use, and is served to anybody unless
+// Legacy is off.
+type Auth struct {
+	// Token is the bearer token that requests over tcp must
+	// carry. If it is empty, the versioned api is only served
+	// over the Socket.
+	Token string
+
+	// Socket, if set, is the path of a unix socket that the api
+	// is served on as well, to root and to SocketUID.
+	Socket    string
+	SocketUID int
+
+	// Legacy serves the unversioned api.
+	Legacy bool
+}
+
+// NewToken returns a random bearer token.
+func NewToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// WriteToken writes token to a file that only its owner can read.
+func WriteToken(path, token string) error {
+	os.Remove(path)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrap(err, "writing api token")
+	}
+	_, err = f.WriteString(token + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return errors.Wrap(err, "writing api token")
+}
+
+// ReadToken reads a token written by WriteToken.
+func ReadToken(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b := make([]byte, 256)
+	n, err := f.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b[:n])), nil
+}
+
+// hasToken returns true if r carries token as its bearer token.
+func hasToken(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	given := r.Header.Get("Authorization")
+	if !strings.HasPrefix(given, "Bearer ") {
+		return false
+	}
+	given = given[len("Bearer "):]
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// unauthorized tells the client it needs a bearer token.
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// versioned serves the api in handler, which is registered under
+// /api/, at /api/v1/ to requests that authorized allows, and at /api/
+// as well if legacy is set. The /metrics in handler are served like
+// /api/v1/, or to anybody if legacy is set, since the legacy api
+// shows as much.
+func versioned(handler http.Handler, authorized func(*http.Request) bool, legacy bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			unauthorized(w)
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = "/api/" + strings.TrimPrefix(r.URL.Path, "/api/v1/")
+		r2.URL.RawPath = ""
+		handler.ServeHTTP(w, r2)
+	})
+	if legacy {
+		mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			handler.ServeHTTP(w, r)
+		})
+	}
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if !legacy && !authorized(r) {
+			unauthorized(w)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	return mux
+}
+
+// A peerListener only accepts unix socket connections from root and
+// from uid.
+type peerListener struct {
+	net.Listener
+	uid int
+}
+
+func (l peerListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uid, err := peerUID(conn.(*net.UnixConn))
+		if err == nil && (uid == 0 || uid == l.uid) {
+			return conn, nil
+		}
+		if err != nil {
+			log.Printf("API Server: rejecting connection: %v", err)
+		} else {
+			log.Printf("API Server: rejecting connection from uid %d", uid)
+		}
+		conn.Close()
+	}
+}
+
+// listenUnix listens on the unix socket at path, replacing whatever a
+// previous teleproxy left behind there, and lets uid connect to it.
+func listenUnix(path string, uid int) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err == nil && uid != 0 {
+		err = os.Chown(path, uid, -1)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return peerListener{ln, uid}, nil
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVersioned(t *testing.T) {
+	handler := http.NewServeMux()
+	handler.HandleFunc("/api/tables/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	handler.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("metrics"))
+	})
+
+	for _, legacy := range []bool{true, false} {
+		server := httptest.NewServer(versioned(handler, func(r *http.Request) bool {
+			return hasToken(r, "secret")
+		}, legacy))
+
+		get := func(path, authorization string) (int, string) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if authorization != "" {
+				req.Header.Set("Authorization", authorization)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			return resp.StatusCode, string(body)
+		}
+
+		legacyStatus, metricsStatus := http.StatusNotFound, http.StatusUnauthorized
+		if legacy {
+			legacyStatus, metricsStatus = http.StatusOK, http.StatusOK
+		}
+		for _, c := range []struct {
+			path, authorization string
+			status              int
+			body                string
+		}{
+			{"/api/v1/tables/foo", "Bearer secret", http.StatusOK, "/api/tables/foo"},
+			{"/api/v1/tables/foo", "", http.StatusUnauthorized, ""},
+			{"/api/v1/tables/foo", "Bearer wrong", http.StatusUnauthorized, ""},
+			{"/api/v1/tables/foo", "secret", http.StatusUnauthorized, ""},
+			{"/api/tables/foo", "", legacyStatus, "/api/tables/foo"},
+			{"/metrics", "Bearer secret", http.StatusOK, "metrics"},
+			{"/metrics", "", metricsStatus, "metrics"},
+		} {
+			status, body := get(c.path, c.authorization)
+			if status != c.status || (status == http.StatusOK && body != c.body) {
+				t.Errorf("legacy=%v %s with %q: got %d %q", legacy, c.path, c.authorization, status, body)
+			}
+		}
+		server.Close()
+	}
+}
+
+func TestSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "api.sock")
+
+	// something left behind by a previous teleproxy is replaced
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		uid     int
+		allowed bool
+	}{
+		{os.Getuid(), true},
+		{os.Getuid() + 1, os.Getuid() == 0},
+	} {
+		ln, err := listenUnix(path, c.uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})}
+		go server.Serve(ln)
+
+		client := http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}}
+		resp, err := client.Get("http://teleproxy/api/v1/ports")
+		if err == nil {
+			resp.Body.Close()
+		}
+		if allowed := err == nil && resp.StatusCode == http.StatusOK; allowed != c.allowed {
+			t.Errorf("uid %d: expected allowed=%v, got %v", c.uid, c.allowed, err)
+		}
+		server.Close()
+	}
+}
+
+func TestToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+
+	token := NewToken()
+	if token == NewToken() || len(token) != 64 {
+		t.Errorf("bad token: %q", token)
+	}
+	if err := WriteToken(path, token); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v, %v", info, err)
+	}
+	if read, err := ReadToken(path); err != nil || read != token {
+		t.Errorf("got %q, %v", read, err)
+	}
+}
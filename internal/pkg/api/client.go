@@ -0,0 +1,109 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A Client talks to the api of a running teleproxy, over its unix
+// socket if it has one, or else with its token.
+type Client struct {
+	client http.Client
+	base   string
+	token  string
+	legacy error
+}
+
+// NewClient creates a Client for the api served on socket, or if that
+// is empty, for the one whose token is in tokenFile. If the token
+// can't be read, e.g. because it is only readable by root, the Client
+// falls back on the unversioned api and Legacy returns the reason.
+func NewClient(socket, tokenFile string) *Client {
+	c := &Client{base: "http://teleproxy/api/v1"}
+	if socket != "" {
+		c.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		return c
+	}
+	token, err := ReadToken(tokenFile)
+	if err != nil {
+		c.base = "http://teleproxy/api"
+		c.legacy = err
+		return c
+	}
+	c.token = token
+	return c
+}
+
+// Legacy returns why the Client uses the unversioned api, or nil if
+// it doesn't.
+func (c *Client) Legacy() error {
+	return c.legacy
+}
+
+// Request sends body, if it isn't nil, as json to the api at path,
+// e.g. "/tables/", and returns the response.
+func (c *Client) Request(method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, c.base+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.client.Do(req)
+}
+
+// Do is like Request, but decodes the json response into result
+// unless that is nil, and turns error responses into errors.
+func (c *Client) Do(method, path string, body, result interface{}) error {
+	resp, err := c.Request(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &StatusError{Code: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	if result == nil {
+		return nil
+	}
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(result), "decoding %s", path)
+}
+
+// A StatusError is an error response from the api.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return http.StatusText(e.Code)
+	}
+	return e.Message
+}
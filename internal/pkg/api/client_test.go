@@ -0,0 +1,64 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "api.sock")
+
+	ln, err := listenUnix(path, os.Getuid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.NewServeMux()
+	handler.HandleFunc("/api/tables/", func(w http.ResponseWriter, r *http.Request) {
+		var body []string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		json.NewEncoder(w).Encode(append(body, r.Method))
+	})
+	server := &http.Server{Handler: versioned(handler, func(*http.Request) bool { return true }, false)}
+	go server.Serve(ln)
+	defer server.Close()
+
+	c := NewClient(path, "")
+	if err := c.Legacy(); err != nil {
+		t.Errorf("unexpected legacy: %v", err)
+	}
+
+	var result []string
+	if err := c.Do(http.MethodPatch, "/tables/foo", []string{"a"}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result[0] != "a" || result[1] != http.MethodPatch {
+		t.Errorf("got %q", result)
+	}
+
+	err = c.Do(http.MethodGet, "/tables/foo", nil, &result)
+	if se, ok := err.(*StatusError); !ok || se.Code != 400 || se.Message != "EOF" {
+		t.Errorf("expected a 400, got %#v", err)
+	}
+	err = c.Do(http.MethodGet, "/nonexistent", nil, nil)
+	if se, ok := err.(*StatusError); !ok || se.Code != 404 {
+		t.Errorf("expected a 404, got %#v", err)
+	}
+
+	// without a token, the client falls back on the unversioned
+	// api
+	if err := NewClient("", filepath.Join(dir, "nonexistent")).Legacy(); err == nil {
+		t.Error("expected legacy")
+	}
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// These aren't in x/sys/unix for darwin yet, see <sys/un.h> and
+// <sys/ucred.h>.
+const (
+	solLocal      = 0
+	localPeercred = 1
+)
+
+type xucred struct {
+	Version uint32
+	Uid     uint32
+	Ngroups int16
+	Groups  [16]uint32
+}
+
+// peerUID returns the uid of the process on the other end of conn.
+func peerUID(conn *net.UnixConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred xucred
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		size := uintptr(unsafe.Sizeof(cred))
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, solLocal, localPeercred,
+			uintptr(unsafe.Pointer(&cred)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(cred.Uid), nil
+}
@@ -3,22 +3,61 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/datawire/teleproxy/internal/pkg/dns"
 	"github.com/datawire/teleproxy/internal/pkg/interceptor"
+	"github.com/datawire/teleproxy/internal/pkg/proxy"
 	"github.com/datawire/teleproxy/internal/pkg/route"
 )
 
 type APIServer struct {
 	listener net.Listener
 	server   http.Server
+	// socket and socketServer serve the api on the Auth's
+	// unix socket, if it has one.
+	socket       net.Listener
+	socketServer http.Server
+	// stopping is closed when the server shuts down, so that
+	// streaming requests end rather than holding up the shutdown.
+	stopping chan struct{}
 }
 
-func NewAPIServer(iceptor *interceptor.Interceptor) (*APIServer, error) {
+// Ports describes where teleproxy redirects intercepted traffic, so
+// that a bridge in another process can point its routes there.
+type Ports struct {
+	Chain string `json:"chain"`
+	DNS   string `json:"dns"`
+	Proxy string `json:"proxy"`
+	API   string `json:"api"`
+}
+
+// A Resolution is what a name resolves to according to the routing
+// tables.
+type Resolution struct {
+	Name  string    `json:"name"`
+	IPs   []string  `json:"ips,omitempty"`
+	CNAME string    `json:"cname,omitempty"`
+	SRV   []dns.SRV `json:"srv,omitempty"`
+	PTR   []string  `json:"ptr,omitempty"`
+}
+
+func NewAPIServer(iceptor *interceptor.Interceptor, dnsServer *dns.Server, tracker *proxy.Tracker, ports Ports, auth Auth) (*APIServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	_, ports.API, err = net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+
+	stopping := make(chan struct{})
 	handler := http.NewServeMux()
 	tables := "/api/tables/"
 	handler.HandleFunc(tables, func(w http.ResponseWriter, r *http.Request) {
@@ -36,14 +75,43 @@ func NewAPIServer(iceptor *interceptor.Interceptor) (*APIServer, error) {
 			d := json.NewDecoder(r.Body)
 			var table []route.Table
 			err := d.Decode(&table)
+			if err == nil {
+				err = validate(table)
+			}
 			if err != nil {
 				http.Error(w, err.Error(), 400)
 			} else {
-				for _, t := range table {
-					iceptor.Update(t)
+				// the tables go in together or not at all
+				if err := iceptor.Update(table...); err != nil {
+					http.Error(w, err.Error(), updateStatus(err))
 				}
 				dns.Flush()
 			}
+		case http.MethodPatch:
+			if table == "" {
+				http.Error(w, "patch a single table", 405)
+				return
+			}
+			var patch route.Patch
+			err := json.NewDecoder(r.Body).Decode(&patch)
+			if err == nil {
+				err = validate([]route.Table{{Name: table, Routes: patch.Add}})
+			}
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			patched, err := iceptor.Patch(table, patch)
+			if err != nil {
+				http.Error(w, err.Error(), updateStatus(err))
+				return
+			}
+			dns.Flush()
+			result, err := json.MarshalIndent(patched, "", "  ")
+			if err != nil {
+				panic(err)
+			}
+			w.Write(append(result, '\n'))
 		case http.MethodDelete:
 			iceptor.Delete(table)
 		}
@@ -69,6 +137,196 @@ func NewAPIServer(iceptor *interceptor.Interceptor) (*APIServer, error) {
 			}
 		}
 	})
+	resolve := "/api/resolve/"
+	handler.HandleFunc(resolve, func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path[len(resolve):]
+		rs := iceptor.Resolve(name)
+		if name == "" || rs == nil {
+			http.NotFound(w, r)
+			return
+		}
+		result, err := json.MarshalIndent(Resolution{
+			Name:  name,
+			IPs:   rs.IPs,
+			CNAME: rs.CNAME,
+			SRV:   rs.SRV,
+			PTR:   rs.PTR,
+		}, "", "  ")
+		if err != nil {
+			panic(err)
+		} else {
+			w.Write(append(result, '\n'))
+		}
+	})
+	handler.HandleFunc("/api/watch", func(w http.ResponseWriter, r *http.Request) {
+		// the current state and then every change, as
+		// server-sent events if the client asks for them and
+		// one json object per line otherwise
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", 500)
+			return
+		}
+		events, done := iceptor.Watch()
+		defer done()
+
+		sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+		if sse {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		w.WriteHeader(http.StatusOK)
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					// we fell behind, the client
+					// has to start over
+					return
+				}
+				data, err := json.Marshal(e)
+				if err != nil {
+					panic(err)
+				}
+				if sse {
+					_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+				} else {
+					_, err = w.Write(append(data, '\n'))
+				}
+				if err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			case <-stopping:
+				return
+			}
+		}
+	})
+	handler.HandleFunc("/api/conflicts", func(w http.ResponseWriter, r *http.Request) {
+		result, err := json.MarshalIndent(iceptor.Conflicts(), "", "  ")
+		if err != nil {
+			panic(err)
+		} else {
+			w.Write(append(result, '\n'))
+		}
+	})
+	handler.HandleFunc("/api/exclude", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			result, err := json.Marshal(iceptor.GetExcludes())
+			if err != nil {
+				panic(err)
+			} else {
+				w.Write(result)
+			}
+		case http.MethodPost:
+			var excludes []string
+			d := json.NewDecoder(r.Body)
+			err := d.Decode(&excludes)
+			if err == nil {
+				err = interceptor.CheckExcludes(excludes)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+			} else if err := iceptor.SetExcludes(excludes); err != nil {
+				http.Error(w, err.Error(), 500)
+			} else {
+				dns.Flush()
+			}
+		}
+	})
+	handler.HandleFunc("/api/dns/stats", func(w http.ResponseWriter, r *http.Request) {
+		result, err := json.MarshalIndent(dnsServer.Stats(), "", "  ")
+		if err != nil {
+			panic(err)
+		} else {
+			w.Write(append(result, '\n'))
+		}
+	})
+	handler.HandleFunc("/api/dns/log", func(w http.ResponseWriter, r *http.Request) {
+		result, err := json.MarshalIndent(dnsServer.QueryLog(), "", "  ")
+		if err != nil {
+			panic(err)
+		} else {
+			w.Write(append(result, '\n'))
+		}
+	})
+	handler.HandleFunc("/api/dns/trace", func(w http.ResponseWriter, r *http.Request) {
+		// one json object per query, for as long as the client
+		// stays connected
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", 500)
+			return
+		}
+		trace, done := dnsServer.Trace()
+		defer done()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		e := json.NewEncoder(w)
+		for {
+			select {
+			case q := <-trace:
+				if err := e.Encode(q); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			case <-stopping:
+				return
+			}
+		}
+	})
+	handler.HandleFunc("/api/dns/forward", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			result, err := json.MarshalIndent(dnsServer.Forwards(), "", "  ")
+			if err != nil {
+				panic(err)
+			} else {
+				w.Write(append(result, '\n'))
+			}
+		case http.MethodPost:
+			var forwards map[string][]string
+			d := json.NewDecoder(r.Body)
+			err := d.Decode(&forwards)
+			if err == nil {
+				err = dns.CheckForwards(forwards)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+			} else if err := dnsServer.SetForwards(forwards); err != nil {
+				http.Error(w, err.Error(), 500)
+			}
+		}
+	})
+	handler.HandleFunc("/api/connections", func(w http.ResponseWriter, r *http.Request) {
+		result, err := json.MarshalIndent(tracker.Connections(), "", "  ")
+		if err != nil {
+			panic(err)
+		} else {
+			w.Write(append(result, '\n'))
+		}
+	})
+	handler.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		tracker.WriteMetrics(w)
+	})
+	handler.HandleFunc("/api/ports", func(w http.ResponseWriter, r *http.Request) {
+		result, err := json.MarshalIndent(ports, "", "  ")
+		if err != nil {
+			panic(err)
+		} else {
+			w.Write(append(result, '\n'))
+		}
+	})
 	handler.HandleFunc("/api/shutdown", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Goodbye!\n"))
 		p, err := os.FindProcess(os.Getpid())
@@ -78,17 +336,43 @@ func NewAPIServer(iceptor *interceptor.Interceptor) (*APIServer, error) {
 		p.Signal(os.Interrupt)
 	})
 
-	ln, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		return nil, err
-	}
-
-	return &APIServer{
+	a := &APIServer{
 		listener: ln,
 		server: http.Server{
-			Handler: handler,
+			Handler: versioned(handler, func(r *http.Request) bool {
+				return hasToken(r, auth.Token)
+			}, auth.Legacy),
 		},
-	}, nil
+		stopping: stopping,
+	}
+	if auth.Socket != "" {
+		a.socket, err = listenUnix(auth.Socket, auth.SocketUID)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		// the listener only lets in the peers that may use
+		// the api
+		a.socketServer.Handler = versioned(handler, func(*http.Request) bool { return true }, auth.Legacy)
+	}
+	return a, nil
+}
+
+// updateStatus is the http status for an error updating a table.
+func updateStatus(err error) int {
+	if _, ok := err.(*interceptor.VersionConflict); ok {
+		return http.StatusConflict
+	}
+	return 500
+}
+
+func validate(tables []route.Table) error {
+	for _, t := range tables {
+		if err := t.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (a *APIServer) Port() string {
@@ -106,11 +390,24 @@ func (a *APIServer) Start() {
 			log.Printf("API Server: %v", err)
 		}
 	}()
+	if a.socket != nil {
+		go func() {
+			if err := a.socketServer.Serve(a.socket); err != http.ErrServerClosed {
+				log.Printf("API Server: %v", err)
+			}
+		}()
+	}
 }
 
 func (a *APIServer) Stop() {
+	close(a.stopping)
 	if err := a.server.Shutdown(context.Background()); err != nil {
 		// Error from closing listeners, or context timeout:
 		log.Printf("API Server Shutdown: %v", err)
 	}
+	if a.socket != nil {
+		if err := a.socketServer.Shutdown(context.Background()); err != nil {
+			log.Printf("API Server Shutdown: %v", err)
+		}
+	}
 }
@@ -0,0 +1,174 @@
+package dns
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxCacheEntries bounds the size of the cache.
+const maxCacheEntries = 10000
+
+// A cache holds fallback answers for as long as their TTLs allow.
+// Negative answers (NXDOMAIN and empty answers) are cached for as
+// long as the SOA that came with them says, per RFC 2308.
+type cache struct {
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+	hits    uint64
+	misses  uint64
+	now     func() time.Time
+}
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type cacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// CacheStats describes the fallback cache.
+type CacheStats struct {
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+func newCache() *cache {
+	return &cache{entries: make(map[cacheKey]cacheEntry), now: time.Now}
+}
+
+func keyOf(r *dns.Msg) cacheKey {
+	q := r.Question[0]
+	return cacheKey{strings.ToLower(q.Name), q.Qtype, q.Qclass}
+}
+
+// get returns a copy of the cached answer to r, with its id and TTLs
+// adjusted, or nil if there isn't one.
+func (c *cache) get(r *dns.Msg) *dns.Msg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := keyOf(r)
+	now := c.now()
+	entry, ok := c.entries[key]
+	if ok && !now.Before(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return nil
+	}
+	c.hits++
+
+	msg := entry.msg.Copy()
+	msg.Id = r.Id
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	if opt := r.IsEdns0(); opt != nil {
+		msg.SetEdns0(maxUDPSize, opt.Do())
+	}
+	return msg
+}
+
+// put caches in as the answer to r if it is cacheable.
+func (c *cache) put(r, in *dns.Msg) {
+	ttl, ok := cacheTTL(in)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	msg := in.Copy()
+	// the OPT record belongs to the client that asked, not the
+	// answer
+	var extra []dns.RR
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if len(c.entries) >= maxCacheEntries {
+		c.evict(now)
+	}
+	c.entries[keyOf(r)] = cacheEntry{msg, now, now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// evict makes room in the cache, first by dropping expired entries,
+// and then arbitrary ones if that isn't enough.
+func (c *cache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < maxCacheEntries {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// cacheTTL returns how long in may be cached for, and false if it
+// shouldn't be cached at all.
+func cacheTTL(in *dns.Msg) (uint32, bool) {
+	if in.Truncated {
+		return 0, false
+	}
+
+	switch {
+	case in.Rcode == dns.RcodeSuccess && len(in.Answer) > 0:
+		ttl := in.Answer[0].Header().Ttl
+		for _, rr := range in.Answer {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		return ttl, true
+	case in.Rcode == dns.RcodeSuccess || in.Rcode == dns.RcodeNameError:
+		for _, rr := range in.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				if soa.Minttl < soa.Hdr.Ttl {
+					return soa.Minttl, true
+				}
+				return soa.Hdr.Ttl, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (c *cache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{len(c.entries), c.hits, c.misses}
+}
+
+// flush empties the cache.
+func (c *cache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[cacheKey]cacheEntry)
+}
@@ -1,9 +1,12 @@
 package dns
 
 import (
+	"context"
 	_log "log"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
@@ -13,90 +16,375 @@ import (
 
 type Server struct {
 	Listeners []string
-	Fallback  string
-	Resolve   func(string) string
+	// Fallbacks are the upstream servers (as host:port) that
+	// answer everything we don't, in order of preference. We
+	// fail over to the next one on a timeout or a SERVFAIL.
+	Fallbacks []string
+	// Timeout is how long to wait for a fallback server before
+	// trying the next one. Zero means a couple of seconds.
+	Timeout time.Duration
+	// Resolve returns the records for a fully qualified, lower
+	// case name, or nil if the name should be looked up with the
+	// Fallbacks instead.
+	Resolve func(string) *RecordSet
+	// QueryLogSize is how many recent queries QueryLog keeps. Zero
+	// means a thousand.
+	QueryLogSize int
+
+	initOnce  sync.Once
+	upstreams []*upstream
+	cache     *cache
+	queries   *queryLog
+
+	mu       sync.RWMutex
+	forwards map[string][]*upstream
+	servers  []*dns.Server
+}
+
+// Stats describes the state of the fallback servers, the servers
+// that names are forwarded to, and the cache of their answers.
+type Stats struct {
+	Cache     CacheStats                 `json:"cache"`
+	Upstreams []UpstreamStats            `json:"upstreams"`
+	Forwards  map[string][]UpstreamStats `json:"forwards"`
 }
 
+func (s *Server) init() {
+	s.initOnce.Do(func() {
+		for _, addr := range s.Fallbacks {
+			s.upstreams = append(s.upstreams, &upstream{addr: addr})
+		}
+		s.cache = newCache()
+		s.queries = newQueryLog(s.QueryLogSize)
+	})
+}
+
+// Stats returns the current Stats for the server.
+func (s *Server) Stats() Stats {
+	s.init()
+	now := time.Now()
+	result := Stats{Cache: s.cache.stats(), Upstreams: []UpstreamStats{}, Forwards: s.forwardStats(now)}
+	for _, u := range s.upstreams {
+		result.Upstreams = append(result.Upstreams, u.stats(now))
+	}
+	return result
+}
+
+// A RecordSet holds everything the Server answers with for a single
+// name.
+type RecordSet struct {
+	// IPs are answered as A or AAAA records depending on their
+	// address family.
+	IPs []string
+	// CNAME, if set, makes the name an alias and the other
+	// fields are ignored.
+	CNAME string
+	SRV   []SRV
+	// PTR holds the names for a reverse lookup.
+	PTR []string
+}
+
+// SRV is a single SRV record.
+type SRV struct {
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Port     uint16 `json:"port"`
+	Target   string `json:"target"`
+}
+
+// ReverseName returns the name used for reverse lookups of ip,
+// e.g. 1.2.0.192.in-addr.arpa. for 192.0.2.1, or the empty string if
+// ip isn't an address.
+func ReverseName(ip string) string {
+	name, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// maxChase bounds how many CNAMEs we follow when answering a query,
+// in case the routing tables contain a loop.
+const maxChase = 8
+
 func log(line string, args ...interface{}) {
 	_log.Printf("DNS: "+line, args...)
 }
 
+func (s *Server) resolve(domain string) *RecordSet {
+	if domain == "localhost." {
+		// BUG(lukeshu): I have no idea why a lookup
+		// for localhost even makes it to here on my
+		// home WiFi when connecting to a k3sctl
+		// cluster (but not a kubernaut.io cluster).
+		// But it does, so I need this in order to be
+		// productive at home.  We should really
+		// root-cause this, because it's weird.
+		return &RecordSet{IPs: []string{"127.0.0.1", "::1"}}
+	}
+	return s.Resolve(domain)
+}
+
+// answer returns the records of the given type in rs, with the given
+// name.
+func answer(name string, qtype uint16, rs *RecordSet) (result []dns.RR) {
+	hdr := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: 60}
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		// a name may have addresses of both families, each
+		// kind of query only gets the ones of its own
+		for _, ip := range rs.IPs {
+			parsed := net.ParseIP(ip)
+			switch {
+			case parsed == nil:
+			case qtype == dns.TypeA && parsed.To4() != nil:
+				result = append(result, &dns.A{Hdr: hdr, A: parsed})
+			case qtype == dns.TypeAAAA && parsed.To4() == nil:
+				result = append(result, &dns.AAAA{Hdr: hdr, AAAA: parsed})
+			}
+		}
+	case dns.TypeSRV:
+		for _, srv := range rs.SRV {
+			result = append(result, &dns.SRV{Hdr: hdr, Priority: srv.Priority, Weight: srv.Weight,
+				Port: srv.Port, Target: srv.Target})
+		}
+	case dns.TypePTR:
+		for _, ptr := range rs.PTR {
+			result = append(result, &dns.PTR{Hdr: hdr, Ptr: ptr})
+		}
+	}
+	return
+}
+
+// maxUDPSize is the largest udp response we are willing to send,
+// and what we advertise with EDNS0.
+const maxUDPSize = 4096
+
+// udpSize returns how big a udp response to r may be: 512 bytes,
+// unless the client asked for more with EDNS0.
+func udpSize(r *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if size > maxUDPSize {
+		size = maxUDPSize
+	}
+	return size
+}
+
+// truncate strips msg down to its header and question, and sets
+// the TC bit, if it is bigger than size. That tells the client to
+// retry over tcp. The OPT record is kept so that EDNS0 clients
+// still see it.
+func truncate(msg *dns.Msg, size int) {
+	if msg.Len() <= size {
+		return
+	}
+	opt := msg.IsEdns0()
+	msg.Truncated = true
+	msg.Answer = nil
+	msg.Ns = nil
+	msg.Extra = nil
+	if opt != nil {
+		msg.Extra = []dns.RR{opt}
+	}
+}
+
+// isTCP reports whether the query came in over tcp.
+func isTCP(w dns.ResponseWriter) bool {
+	_, ok := w.RemoteAddr().(*net.TCPAddr)
+	return ok
+}
+
+// reply sends msg back to the client, truncating it first if it is
+// too big for udp.
+func reply(w dns.ResponseWriter, r, msg *dns.Msg) {
+	if !isTCP(w) {
+		truncate(msg, udpSize(r))
+	}
+	w.WriteMsg(msg)
+}
+
+// fallback answers r from the cache if it can, and otherwise relays
+// it to each of the fallback servers (or the servers its name is
+// forwarded to) in turn until one of them answers. The request goes
+// out as-is, so any EDNS0 buffer size the client asked for is passed
+// through. It also returns where the answer came from: the address of
+// the server, or "cache".
+func (s *Server) fallback(r *dns.Msg, tcp bool) (*dns.Msg, string, error) {
+	s.init()
+	if in := s.cache.get(r); in != nil {
+		return in, "cache", nil
+	}
+
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	var in *dns.Msg
+	var from string
+	err := errors.New("no fallback servers")
+	for _, u := range s.upstreamsFor(strings.ToLower(r.Question[0].Name)) {
+		var msg *dns.Msg
+		msg, err = u.exchange(r, tcp, timeout)
+		if err == nil {
+			s.cache.put(r, msg)
+			return msg, u.addr, nil
+		}
+		if msg != nil {
+			in, from = msg, u.addr
+		}
+		log("%v, trying next fallback", err)
+	}
+	if in != nil {
+		// every server failed, but at least one of them had
+		// something to say about it
+		return in, from, nil
+	}
+	return nil, "", err
+}
+
 func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.init()
 	domain := strings.ToLower(r.Question[0].Name)
-	switch r.Question[0].Qtype {
-	case dns.TypeA:
-		var ip string
-		if domain == "localhost." {
-			// BUG(lukeshu): I have no idea why a lookup
-			// for localhost even makes it to here on my
-			// home WiFi when connecting to a k3sctl
-			// cluster (but not a kubernaut.io cluster).
-			// But it does, so I need this in order to be
-			// productive at home.  We should really
-			// root-cause this, because it's weird.
-			ip = "127.0.0.1"
-		} else {
-			ip = s.Resolve(domain)
-		}
-		if ip != "" {
-			log("QUERY %s -> %s", domain, ip)
+	qtype := r.Question[0].Qtype
+
+	q := Query{Time: time.Now(), Name: domain, Type: dns.Type(qtype).String(), Source: w.RemoteAddr().String()}
+	defer func() {
+		q.Latency = float64(time.Since(q.Time)) / float64(time.Millisecond)
+		s.queries.record(q)
+	}()
+
+	rs := s.resolve(domain)
+	if rs == nil {
+		log("QTYPE[%v] %s -> FALLBACK", qtype, domain)
+		in, from, err := s.fallback(r, isTCP(w))
+		if err != nil {
+			log(err.Error())
+			// answer anyway, so the client doesn't wait out its
+			// own timeout
 			msg := dns.Msg{}
-			msg.SetReply(r)
-			msg.Authoritative = true
-			// mac dns seems to fallback if you don't
-			// support recursion, if you have more than a
-			// single dns server, this will prevent us
-			// from intercepting all queries
+			msg.SetRcode(r, dns.RcodeServerFailure)
 			msg.RecursionAvailable = true
-			// if we don't give back the same domain
-			// requested, then mac dns seems to return an
-			// nxdomain
-			msg.Answer = append(msg.Answer, &dns.A{
-				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
-				A:   net.ParseIP(ip),
-			})
-			w.WriteMsg(&msg)
+			q.Result, q.Rcode, q.Answer, q.Error = "error", dns.RcodeToString[msg.Rcode], []string{}, err.Error()
+			reply(w, r, &msg)
 			return
 		}
-	default:
-		ip := s.Resolve(domain)
-		if ip != "" {
-			log("QTYPE[%v] %s -> EMPTY", r.Question[0].Qtype, domain)
-			msg := dns.Msg{}
-			msg.SetReply(r)
-			msg.Authoritative = true
-			msg.RecursionAvailable = true
-			w.WriteMsg(&msg)
-			return
+		q.Result, q.Upstream = "fallback", from
+		if from == "cache" {
+			q.Result, q.Upstream = "cached", ""
 		}
-	}
-	log("QTYPE[%v] %s -> FALLBACK", r.Question[0].Qtype, domain)
-	in, err := dns.Exchange(r, s.Fallback)
-	if err != nil {
-		log(err.Error())
+		q.Rcode, q.Answer = dns.RcodeToString[in.Rcode], answerStrings(in.Answer)
+		reply(w, r, in)
 		return
 	}
-	w.WriteMsg(in)
+
+	msg := dns.Msg{}
+	msg.SetReply(r)
+	msg.Authoritative = true
+	// mac dns seems to fallback if you don't support recursion,
+	// if you have more than a single dns server, this will
+	// prevent us from intercepting all queries
+	msg.RecursionAvailable = true
+	if opt := r.IsEdns0(); opt != nil {
+		msg.SetEdns0(maxUDPSize, opt.Do())
+	}
+
+	// if we don't give back the same domain requested, then mac
+	// dns seems to return an nxdomain
+	name := r.Question[0].Name
+	for n := 0; rs != nil && rs.CNAME != "" && qtype != dns.TypeCNAME && n < maxChase; n++ {
+		hdr := dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}
+		msg.Answer = append(msg.Answer, &dns.CNAME{Hdr: hdr, Target: rs.CNAME})
+		// if the alias points somewhere we don't know about,
+		// the client's resolver takes it from here
+		name = rs.CNAME
+		rs = s.resolve(strings.ToLower(name))
+	}
+	if rs != nil {
+		if qtype == dns.TypeCNAME && rs.CNAME != "" {
+			hdr := dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}
+			msg.Answer = append(msg.Answer, &dns.CNAME{Hdr: hdr, Target: rs.CNAME})
+		} else if rs.CNAME == "" {
+			msg.Answer = append(msg.Answer, answer(name, qtype, rs)...)
+		}
+	}
+
+	log("QUERY[%v] %s -> %d answers", qtype, domain, len(msg.Answer))
+	q.Result, q.Rcode, q.Answer = "intercepted", dns.RcodeToString[msg.Rcode], answerStrings(msg.Answer)
+	reply(w, r, &msg)
 }
 
+// Start listens for dns queries on every one of the Listeners, over
+// both udp and tcp. Clients fall back to tcp when an answer is too
+// big for udp, so we need both.
 func (s *Server) Start(p *supervisor.Process) error {
-	listeners := make([]net.PacketConn, len(s.Listeners))
-	for i, addr := range s.Listeners {
-		var err error
-		listeners[i], err = net.ListenPacket("udp", addr)
+	var servers []*dns.Server
+	for _, addr := range s.Listeners {
+		pc, err := net.ListenPacket("udp", addr)
 		if err != nil {
 			return errors.Wrap(err, "failed to set up udp listener")
 		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			pc.Close()
+			return errors.Wrap(err, "failed to set up tcp listener")
+		}
+		servers = append(servers,
+			&dns.Server{PacketConn: pc, Handler: s},
+			&dns.Server{Listener: l, Handler: s})
 		log("listening on %s", addr)
 	}
-	for _, listener := range listeners {
-		go func(listener net.PacketConn) {
-			srv := &dns.Server{PacketConn: listener, Handler: s}
+	// wait for every server to get going, so that Stop can't
+	// race with them starting up
+	started := make(chan error, 2*len(servers))
+	for _, srv := range servers {
+		srv.NotifyStartedFunc = func() { started <- nil }
+		go func(srv *dns.Server) {
 			if err := srv.ActivateAndServe(); err != nil {
-				log("failed to active udp server: %v", err)
+				log("failed to activate server: %v", err)
+				started <- err
 				p.Supervisor().Shutdown()
 			}
-		}(listener)
+		}(srv)
+	}
+	var err error
+	for range servers {
+		if e := <-started; e != nil && err == nil {
+			err = errors.Wrap(e, "failed to activate server")
+		}
 	}
+	if err != nil {
+		for _, srv := range servers {
+			srv.Shutdown()
+		}
+		return err
+	}
+	s.mu.Lock()
+	s.servers = append(s.servers, servers...)
+	s.mu.Unlock()
 	return nil
 }
+
+// Stop stops listening for dns queries, and waits for the ones that
+// are being answered to finish. Once ctx is done, Stop gives up
+// waiting and returns ctx's error.
+func (s *Server) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	servers := s.servers
+	s.servers = nil
+	s.mu.Unlock()
+
+	var result error
+	for _, srv := range servers {
+		if err := srv.ShutdownContext(ctx); err != nil && result == nil {
+			result = err
+		}
+	}
+	if result == nil {
+		log("stopped")
+	}
+	return result
+}
@@ -0,0 +1,492 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/pkg/supervisor"
+)
+
+// recorder is a dns.ResponseWriter that remembers the last message
+// written to it.
+type recorder struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (r *recorder) WriteMsg(m *dns.Msg) error {
+	r.msg = m
+	return nil
+}
+
+func (r *recorder) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+}
+
+func query(s *Server, name string, qtype uint16) *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+	w := &recorder{}
+	s.ServeDNS(w, req)
+	return w.msg
+}
+
+var records = map[string]*RecordSet{
+	"four.":                   {IPs: []string{"192.0.2.1"}},
+	"six.":                    {IPs: []string{"2001:db8::1"}},
+	"multi.":                  {IPs: []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}},
+	"alias.":                  {CNAME: "four."},
+	"loop.":                   {CNAME: "loop."},
+	"away.":                   {CNAME: "example.com."},
+	"_http._tcp.four.":        {SRV: []SRV{{Port: 80, Target: "four."}}},
+	"1.2.0.192.in-addr.arpa.": {PTR: []string{"four.", "multi."}},
+}
+
+func resolve(domain string) *RecordSet {
+	return records[domain]
+}
+
+func TestAddressQueries(t *testing.T) {
+	s := &Server{Resolve: resolve}
+
+	for _, tt := range []struct {
+		name     string
+		qtype    uint16
+		expected string
+	}{
+		{"four.", dns.TypeA, "192.0.2.1"},
+		{"four.", dns.TypeAAAA, ""},
+		{"six.", dns.TypeA, ""},
+		{"six.", dns.TypeAAAA, "2001:db8::1"},
+		{"localhost.", dns.TypeA, "127.0.0.1"},
+		{"localhost.", dns.TypeAAAA, "::1"},
+	} {
+		msg := query(s, tt.name, tt.qtype)
+		if msg == nil {
+			t.Errorf("%s %s: no reply", tt.name, dns.TypeToString[tt.qtype])
+			continue
+		}
+		if tt.expected == "" {
+			if len(msg.Answer) != 0 {
+				t.Errorf("%s %s: expected no answers, got %v", tt.name, dns.TypeToString[tt.qtype], msg.Answer)
+			}
+			continue
+		}
+		if len(msg.Answer) != 1 {
+			t.Errorf("%s %s: expected one answer, got %v", tt.name, dns.TypeToString[tt.qtype], msg.Answer)
+			continue
+		}
+		var actual net.IP
+		switch rr := msg.Answer[0].(type) {
+		case *dns.A:
+			actual = rr.A
+		case *dns.AAAA:
+			actual = rr.AAAA
+		}
+		if !actual.Equal(net.ParseIP(tt.expected)) {
+			t.Errorf("%s %s: got %v, expected %s", tt.name, dns.TypeToString[tt.qtype], msg.Answer[0], tt.expected)
+		}
+	}
+}
+
+func answers(msg *dns.Msg) (result []string) {
+	for _, rr := range msg.Answer {
+		result = append(result, rr.String())
+	}
+	return
+}
+
+func TestRecordQueries(t *testing.T) {
+	s := &Server{Resolve: resolve}
+
+	for _, tt := range []struct {
+		name     string
+		qtype    uint16
+		expected []string
+	}{
+		{"multi.", dns.TypeA, []string{
+			"multi.\t60\tIN\tA\t192.0.2.1",
+			"multi.\t60\tIN\tA\t192.0.2.2",
+		}},
+		{"multi.", dns.TypeAAAA, []string{
+			"multi.\t60\tIN\tAAAA\t2001:db8::1",
+		}},
+		{"alias.", dns.TypeA, []string{
+			"alias.\t60\tIN\tCNAME\tfour.",
+			"four.\t60\tIN\tA\t192.0.2.1",
+		}},
+		{"alias.", dns.TypeCNAME, []string{
+			"alias.\t60\tIN\tCNAME\tfour.",
+		}},
+		{"away.", dns.TypeA, []string{
+			"away.\t60\tIN\tCNAME\texample.com.",
+		}},
+		{"_http._tcp.four.", dns.TypeSRV, []string{
+			"_http._tcp.four.\t60\tIN\tSRV\t0 0 80 four.",
+		}},
+		{"1.2.0.192.in-addr.arpa.", dns.TypePTR, []string{
+			"1.2.0.192.in-addr.arpa.\t60\tIN\tPTR\tfour.",
+			"1.2.0.192.in-addr.arpa.\t60\tIN\tPTR\tmulti.",
+		}},
+		{"four.", dns.TypeMX, nil},
+	} {
+		msg := query(s, tt.name, tt.qtype)
+		if msg == nil {
+			t.Errorf("%s %s: no reply", tt.name, dns.TypeToString[tt.qtype])
+			continue
+		}
+		if !reflect.DeepEqual(answers(msg), tt.expected) {
+			t.Errorf("%s %s: got %q, expected %q", tt.name, dns.TypeToString[tt.qtype], answers(msg), tt.expected)
+		}
+	}
+
+	// a loop gives up eventually rather than hanging
+	if msg := query(s, "loop.", dns.TypeA); msg == nil || len(msg.Answer) != maxChase {
+		t.Errorf("loop: unexpected reply %v", msg)
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	for ip, expected := range map[string]string{
+		"192.0.2.1":   "1.2.0.192.in-addr.arpa.",
+		"2001:db8::1": "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+		"bogus":       "",
+	} {
+		if actual := ReverseName(ip); actual != expected {
+			t.Errorf("%s: got %q, expected %q", ip, actual, expected)
+		}
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	var ips []string
+	for i := 0; i < 100; i++ {
+		ips = append(ips, fmt.Sprintf("192.0.2.%d", i))
+	}
+	s := &Server{Resolve: func(domain string) *RecordSet {
+		return &RecordSet{IPs: ips}
+	}}
+
+	// too big for plain udp
+	msg := query(s, "big.", dns.TypeA)
+	if !msg.Truncated || len(msg.Answer) != 0 {
+		t.Errorf("expected a truncated reply, got %d answers", len(msg.Answer))
+	}
+
+	// but it fits in the buffer an EDNS0 client asks for
+	req := &dns.Msg{}
+	req.SetQuestion("big.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	w := &recorder{}
+	s.ServeDNS(w, req)
+	if w.msg.Truncated || len(w.msg.Answer) != len(ips) {
+		t.Errorf("expected %d answers, got %d (truncated=%v)", len(ips), len(w.msg.Answer), w.msg.Truncated)
+	}
+	if opt := w.msg.IsEdns0(); opt == nil || opt.UDPSize() != maxUDPSize {
+		t.Errorf("expected an OPT record, got %v", opt)
+	}
+}
+
+// fakeUpstream starts a dns server with the given handler on both
+// udp and tcp.
+func fakeUpstream(t *testing.T, handler dns.HandlerFunc) (addr string, stop func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: handler}
+	tcp := &dns.Server{Listener: l, Handler: handler}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	return pc.LocalAddr().String(), func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	}
+}
+
+func aRecord(r *dns.Msg, ip string, ttl uint32) dns.RR {
+	hdr := dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}
+	return &dns.A{Hdr: hdr, A: net.ParseIP(ip)}
+}
+
+func TestFallbackRetriesOverTCP(t *testing.T) {
+	// only answers fully over tcp, and sets the TC bit on every
+	// udp answer
+	addr, stop := fakeUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := &dns.Msg{}
+		msg.SetReply(r)
+		if isTCP(w) {
+			msg.Answer = append(msg.Answer, aRecord(r, "192.0.2.1", 60))
+		} else {
+			msg.Truncated = true
+		}
+		w.WriteMsg(msg)
+	})
+	defer stop()
+
+	s := &Server{
+		Fallbacks: []string{addr},
+		Resolve:   func(domain string) *RecordSet { return nil },
+	}
+	msg := query(s, "example.com.", dns.TypeA)
+	if msg == nil || msg.Truncated || len(msg.Answer) != 1 {
+		t.Errorf("expected the full answer, got %v", msg)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	broken, stop := fakeUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := &dns.Msg{}
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(msg)
+	})
+	defer stop()
+
+	// nothing ever answers here
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	var answered int32
+	working, stop := fakeUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&answered, 1)
+		msg := &dns.Msg{}
+		msg.SetReply(r)
+		if r.Question[0].Name == "nx.example.com." {
+			msg.Rcode = dns.RcodeNameError
+			msg.Ns = append(msg.Ns, &dns.SOA{
+				Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+				Ns:     "ns.example.com.",
+				Mbox:   "hostmaster.example.com.",
+				Minttl: 60,
+			})
+		} else {
+			msg.Answer = append(msg.Answer, aRecord(r, "192.0.2.1", 60))
+		}
+		w.WriteMsg(msg)
+	})
+	defer stop()
+
+	s := &Server{
+		Fallbacks: []string{broken, silent.LocalAddr().String(), working},
+		Timeout:   100 * time.Millisecond,
+		Resolve:   func(domain string) *RecordSet { return nil },
+	}
+
+	for _, name := range []string{"example.com.", "nx.example.com."} {
+		for n := 0; n < maxFailures; n++ {
+			msg := query(s, name, dns.TypeA)
+			if msg == nil || msg.Rcode == dns.RcodeServerFailure {
+				t.Fatalf("%s: expected an answer from the working server, got %v", name, msg)
+			}
+		}
+	}
+
+	// both answers came from the cache after the first time
+	if n := atomic.LoadInt32(&answered); n != 2 {
+		t.Errorf("expected 2 queries to reach the working server, got %d", n)
+	}
+
+	stats := s.Stats()
+	if stats.Cache.Entries != 2 || stats.Cache.Hits != 2*(maxFailures-1) {
+		t.Errorf("unexpected cache stats: %+v", stats.Cache)
+	}
+	for i, healthy := range []bool{true, true, true} {
+		if stats.Upstreams[i].Healthy != healthy {
+			t.Errorf("%d: unexpected stats: %+v", i, stats.Upstreams[i])
+		}
+	}
+	if stats.Upstreams[0].Failures != 2 || stats.Upstreams[1].Failures != 2 {
+		t.Errorf("unexpected upstream stats: %+v", stats.Upstreams)
+	}
+}
+
+func TestFallbackFailure(t *testing.T) {
+	// nothing ever answers here
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	s := &Server{
+		Fallbacks: []string{silent.LocalAddr().String()},
+		Timeout:   100 * time.Millisecond,
+		Resolve:   func(domain string) *RecordSet { return nil },
+	}
+	msg := query(s, "example.com.", dns.TypeA)
+	if msg == nil || msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL, got %v", msg)
+	}
+	if qs := s.QueryLog(); len(qs) != 1 || qs[0].Result != "error" || qs[0].Rcode != "SERVFAIL" {
+		t.Errorf("unexpected query log: %+v", qs)
+	}
+}
+
+func TestUpstreamHealth(t *testing.T) {
+	u := &upstream{addr: "a"}
+	other := &upstream{addr: "b"}
+	now := time.Now()
+	for n := 0; n < maxFailures; n++ {
+		if !u.healthy(now) {
+			t.Fatalf("unhealthy after %d failures", n)
+		}
+		u.record(0, errors.New("timeout"))
+	}
+	if u.healthy(time.Now()) {
+		t.Error("expected unhealthy")
+	}
+	if order := order([]*upstream{u, other}, time.Now()); order[0] != other {
+		t.Error("expected the healthy upstream to go first")
+	}
+	if !u.healthy(time.Now().Add(downTime)) {
+		t.Error("expected healthy once the down time is over")
+	}
+	u.record(0, nil)
+	if !u.healthy(time.Now()) {
+		t.Error("expected healthy after a success")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := newCache()
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	r := &dns.Msg{}
+	r.SetQuestion("example.com.", dns.TypeA)
+	in := &dns.Msg{}
+	in.SetReply(r)
+	in.Answer = append(in.Answer, aRecord(r, "192.0.2.1", 60), aRecord(r, "192.0.2.2", 30))
+	c.put(r, in)
+
+	now = now.Add(10 * time.Second)
+	msg := c.get(r)
+	if msg == nil || msg.Answer[0].Header().Ttl != 50 || msg.Answer[1].Header().Ttl != 20 {
+		t.Errorf("expected ttls to count down, got %v", msg)
+	}
+
+	// the smallest ttl decides when it expires
+	now = now.Add(20 * time.Second)
+	if msg := c.get(r); msg != nil {
+		t.Errorf("expected a miss, got %v", msg)
+	}
+}
+
+func TestQueryLog(t *testing.T) {
+	up, stop := fakeUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := &dns.Msg{}
+		msg.SetReply(r)
+		msg.Answer = append(msg.Answer, aRecord(r, "192.0.2.9", 60))
+		w.WriteMsg(msg)
+	})
+	defer stop()
+
+	s := &Server{Resolve: resolve, Fallbacks: []string{up}, QueryLogSize: 3}
+	trace, done := s.Trace()
+	defer done()
+
+	query(s, "four.", dns.TypeA)
+	query(s, "example.com.", dns.TypeA)
+	query(s, "example.com.", dns.TypeA)
+
+	expected := []Query{
+		{Name: "four.", Type: "A", Result: "intercepted", Rcode: "NOERROR", Answer: []string{"A 192.0.2.1"}},
+		{Name: "example.com.", Type: "A", Result: "fallback", Upstream: up, Rcode: "NOERROR", Answer: []string{"A 192.0.2.9"}},
+		{Name: "example.com.", Type: "A", Result: "cached", Rcode: "NOERROR", Answer: []string{"A 192.0.2.9"}},
+	}
+	check := func(got []Query, expected []Query) {
+		if len(got) != len(expected) {
+			t.Fatalf("got %v, expected %v", got, expected)
+		}
+		for i, q := range got {
+			if q.Source != "127.0.0.1:12345" || q.Time.IsZero() {
+				t.Errorf("bad source or time: %+v", q)
+			}
+			q.Source, q.Time, q.Latency = "", time.Time{}, 0
+			if !reflect.DeepEqual(q, expected[i]) {
+				t.Errorf("got %+v, expected %+v", q, expected[i])
+			}
+		}
+	}
+	check(s.QueryLog(), expected)
+
+	var traced []Query
+	for range expected {
+		traced = append(traced, <-trace)
+	}
+	check(traced, expected)
+
+	// the log only keeps the most recent queries
+	query(s, "six.", dns.TypeAAAA)
+	entries := s.QueryLog()
+	if len(entries) != 3 || entries[0].Result != "fallback" || entries[2].Name != "six." {
+		t.Errorf("got %+v", entries)
+	}
+
+	done()
+	if _, ok := <-trace; ok {
+		// the fourth query is still buffered
+		if _, ok := <-trace; ok {
+			t.Error("trace not closed")
+		}
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	// find a port that's free for both udp and tcp
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	s := &Server{Listeners: []string{addr}, Resolve: resolve}
+	sup := supervisor.WithContext(context.Background())
+	sup.Supervise(&supervisor.Worker{
+		Name: "dns",
+		Work: func(p *supervisor.Process) error {
+			if err := s.Start(p); err != nil {
+				return err
+			}
+			for _, network := range []string{"udp", "tcp"} {
+				c := &dns.Client{Net: network, Timeout: 5 * time.Second}
+				r := &dns.Msg{}
+				r.SetQuestion("four.", dns.TypeA)
+				msg, _, err := c.Exchange(r, addr)
+				if err != nil || len(msg.Answer) != 1 {
+					t.Errorf("%s: got %v, %v", network, msg, err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := s.Stop(ctx); err != nil {
+				return err
+			}
+			if conn, err := net.Dial("tcp", addr); err == nil {
+				conn.Close()
+				t.Error("still listening after stopping")
+			}
+			return nil
+		},
+	})
+	for _, err := range sup.Run() {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// normalizeSuffix turns "*.corp.example.com", ".corp.example.com",
+// and "Corp.Example.com." all into "corp.example.com.".
+func normalizeSuffix(suffix string) (string, error) {
+	result := strings.ToLower(strings.Trim(strings.TrimPrefix(strings.TrimSpace(suffix), "*."), "."))
+	if result == "" || strings.ContainsAny(result, " /:*") {
+		return "", errors.Errorf("bad domain suffix: %q", suffix)
+	}
+	return result + ".", nil
+}
+
+// normalizeServer adds the default dns port to addr if it doesn't
+// have one.
+func normalizeServer(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if net.ParseIP(addr) != nil {
+		return net.JoinHostPort(addr, "53"), nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || port == "" {
+		return "", errors.Errorf("bad dns server: %q", addr)
+	}
+	return addr, nil
+}
+
+// ParseForward parses a forwarding rule of the form
+// "suffix=server[,server...]", e.g. "corp.example.com=10.0.0.53" or
+// "consul=127.0.0.1:8600".
+func ParseForward(spec string) (suffix string, servers []string, err error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return "", nil, errors.Errorf("bad forwarding rule, expected suffix=server[,server...]: %q", spec)
+	}
+	return parts[0], strings.Split(parts[1], ","), nil
+}
+
+// normalizeForwards validates a set of forwarding rules and puts the
+// suffixes and servers into canonical form.
+func normalizeForwards(forwards map[string][]string) (map[string][]string, error) {
+	result := make(map[string][]string, len(forwards))
+	for suffix, servers := range forwards {
+		normalized, err := normalizeSuffix(suffix)
+		if err != nil {
+			return nil, err
+		}
+		if len(servers) == 0 {
+			return nil, errors.Errorf("no servers for %s", suffix)
+		}
+		for _, server := range servers {
+			addr, err := normalizeServer(server)
+			if err != nil {
+				return nil, errors.Wrapf(err, "forwarding %s", suffix)
+			}
+			result[normalized] = append(result[normalized], addr)
+		}
+	}
+	return result, nil
+}
+
+// CheckForwards returns an error if any of the forwarding rules are
+// malformed.
+func CheckForwards(forwards map[string][]string) error {
+	_, err := normalizeForwards(forwards)
+	return err
+}
+
+// SetForwards replaces the forwarding rules. Queries for names under
+// one of the suffixes go to that suffix's servers (the longest
+// matching suffix wins) rather than to the Fallbacks. Since cached
+// answers may have come from a server that no longer applies, this
+// empties the cache.
+func (s *Server) SetForwards(forwards map[string][]string) error {
+	s.init()
+	normalized, err := normalizeForwards(forwards)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// reuse the upstreams we already know about, so they keep
+	// their health
+	known := make(map[string]*upstream)
+	for _, upstreams := range s.forwards {
+		for _, u := range upstreams {
+			known[u.addr] = u
+		}
+	}
+	next := make(map[string][]*upstream, len(normalized))
+	for suffix, servers := range normalized {
+		for _, addr := range servers {
+			u, ok := known[addr]
+			if !ok {
+				u = &upstream{addr: addr}
+				known[addr] = u
+			}
+			next[suffix] = append(next[suffix], u)
+		}
+		log("FORWARD %s -> %s", suffix, strings.Join(servers, ","))
+	}
+	s.forwards = next
+	s.cache.flush()
+	return nil
+}
+
+// Forwards returns the current forwarding rules.
+func (s *Server) Forwards() map[string][]string {
+	s.init()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make(map[string][]string, len(s.forwards))
+	for suffix, upstreams := range s.forwards {
+		result[suffix] = []string{}
+		for _, u := range upstreams {
+			result[suffix] = append(result[suffix], u.addr)
+		}
+	}
+	return result
+}
+
+// upstreamsFor returns the servers to ask about name, in the order to
+// ask them.
+func (s *Server) upstreamsFor(name string) []*upstream {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	best := ""
+	for suffix := range s.forwards {
+		if (name == suffix || strings.HasSuffix(name, "."+suffix)) && len(suffix) > len(best) {
+			best = suffix
+		}
+	}
+	if best != "" {
+		return order(s.forwards[best], time.Now())
+	}
+	return order(s.upstreams, time.Now())
+}
+
+func (s *Server) forwardStats(now time.Time) map[string][]UpstreamStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make(map[string][]UpstreamStats, len(s.forwards))
+	for suffix, upstreams := range s.forwards {
+		for _, u := range upstreams {
+			result[suffix] = append(result[suffix], u.stats(now))
+		}
+	}
+	return result
+}
@@ -0,0 +1,85 @@
+package dns
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseForward(t *testing.T) {
+	suffix, servers, err := ParseForward("*.corp.example.com=10.0.0.53,[2001:db8::53]:5353")
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalized, err := normalizeForwards(map[string][]string{suffix: servers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{"corp.example.com.": {"10.0.0.53:53", "[2001:db8::53]:5353"}}
+	if !reflect.DeepEqual(normalized, expected) {
+		t.Errorf("got %v, expected %v", normalized, expected)
+	}
+
+	for _, bad := range []string{"corp.example.com", "=10.0.0.53", "consul=bogus", "consul="} {
+		suffix, servers, err := ParseForward(bad)
+		if err == nil {
+			err = CheckForwards(map[string][]string{suffix: servers})
+		}
+		if err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+// answering returns a fake upstream that answers every A query with
+// ip.
+func answering(t *testing.T, ip string) (string, func()) {
+	return fakeUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := &dns.Msg{}
+		msg.SetReply(r)
+		msg.Answer = append(msg.Answer, aRecord(r, ip, 60))
+		w.WriteMsg(msg)
+	})
+}
+
+func TestForwards(t *testing.T) {
+	def, stop := answering(t, "192.0.2.1")
+	defer stop()
+	corp, stop := answering(t, "192.0.2.2")
+	defer stop()
+	vpn, stop := answering(t, "192.0.2.3")
+	defer stop()
+
+	s := &Server{
+		Fallbacks: []string{def},
+		Resolve:   func(domain string) *RecordSet { return nil },
+	}
+	err := s.SetForwards(map[string][]string{
+		"corp.example.com":     {corp},
+		"vpn.corp.example.com": {vpn},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name, expected string) {
+		msg := query(s, name, dns.TypeA)
+		if msg == nil || len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != expected {
+			t.Errorf("%s: expected %s, got %v", name, expected, msg)
+		}
+	}
+
+	check("example.com.", "192.0.2.1")
+	check("notcorp.example.com.", "192.0.2.1")
+	check("corp.example.com.", "192.0.2.2")
+	check("www.Corp.example.com.", "192.0.2.2")
+	check("host.vpn.corp.example.com.", "192.0.2.3")
+
+	// changing the rules takes effect right away, the cache
+	// notwithstanding
+	if err := s.SetForwards(nil); err != nil {
+		t.Fatal(err)
+	}
+	check("www.corp.example.com.", "192.0.2.1")
+}
@@ -0,0 +1,119 @@
+package dns
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultQueryLogSize is how many queries the Server remembers when
+// QueryLogSize isn't set.
+const defaultQueryLogSize = 1000
+
+// traceBuffer is how many entries a trace subscriber may fall behind
+// by before entries are dropped for it.
+const traceBuffer = 100
+
+// A Query describes one query the Server answered.
+type Query struct {
+	Time   time.Time `json:"time"`
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	Source string    `json:"source"`
+	// Result is "intercepted" if the routing tables answered,
+	// "fallback" if an upstream server did, "cached" if the
+	// answer came from the cache, and "error" if nobody did.
+	Result string `json:"result"`
+	// Upstream is the server that answered a fallback query.
+	Upstream string   `json:"upstream,omitempty"`
+	Rcode    string   `json:"rcode,omitempty"`
+	Answer   []string `json:"answer"`
+	Error    string   `json:"error,omitempty"`
+	// Latency is how long answering took, in milliseconds.
+	Latency float64 `json:"latency"`
+}
+
+// A queryLog is a ring buffer of the most recent queries, plus the
+// channels of anybody tracing them as they happen.
+type queryLog struct {
+	mu      sync.Mutex
+	entries []Query
+	next    int
+	full    bool
+	traces  map[chan Query]struct{}
+}
+
+func newQueryLog(size int) *queryLog {
+	if size <= 0 {
+		size = defaultQueryLogSize
+	}
+	return &queryLog{entries: make([]Query, size), traces: make(map[chan Query]struct{})}
+}
+
+func (l *queryLog) record(q Query) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = q
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+	for ch := range l.traces {
+		select {
+		case ch <- q:
+		default:
+			// a slow reader shouldn't hold up dns
+		}
+	}
+}
+
+// list returns the queries in the log, oldest first.
+func (l *queryLog) list() []Query {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]Query{}, l.entries[:l.next]...)
+	}
+	return append(append([]Query{}, l.entries[l.next:]...), l.entries[:l.next]...)
+}
+
+func (l *queryLog) subscribe() (<-chan Query, func()) {
+	ch := make(chan Query, traceBuffer)
+	l.mu.Lock()
+	l.traces[ch] = struct{}{}
+	l.mu.Unlock()
+	return ch, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if _, ok := l.traces[ch]; ok {
+			delete(l.traces, ch)
+			close(ch)
+		}
+	}
+}
+
+// QueryLog returns the most recent queries, oldest first.
+func (s *Server) QueryLog() []Query {
+	s.init()
+	return s.queries.list()
+}
+
+// Trace returns a channel that receives every query from now on, and
+// a function to call to stop receiving them. Queries are dropped
+// rather than waited for if the channel isn't drained fast enough.
+func (s *Server) Trace() (<-chan Query, func()) {
+	s.init()
+	return s.queries.subscribe()
+}
+
+// answerStrings renders rrs compactly, e.g. "A 10.0.0.1".
+func answerStrings(rrs []dns.RR) []string {
+	result := []string{}
+	for _, rr := range rrs {
+		data := strings.TrimPrefix(rr.String(), rr.Header().String())
+		result = append(result, dns.Type(rr.Header().Rrtype).String()+" "+data)
+	}
+	return result
+}
@@ -1,7 +1,6 @@
 package dns
 
 import (
-	"runtime"
 	"strings"
 
 	"github.com/datawire/teleproxy/pkg/supervisor"
@@ -12,11 +11,10 @@ type searchDomains struct {
 	Domains   string
 }
 
+// OverrideSearchDomains sets the search domains of every network
+// service to domains, and returns a function that puts back the ones
+// they had before.
 func OverrideSearchDomains(p *supervisor.Process, domains string) func() {
-	if runtime.GOOS != "darwin" {
-		return func() {}
-	}
-
 	ifaces, err := getIfaces(p)
 	if err != nil {
 		panic(err)
@@ -42,6 +40,12 @@ func OverrideSearchDomains(p *supervisor.Process, domains string) func() {
 	}
 }
 
+// CleanupSearchDomains is a no-op on darwin, where the search domains
+// are only overridden for as long as teleproxy is running.
+func CleanupSearchDomains(p *supervisor.Process) error {
+	return nil
+}
+
 func getIfaces(p *supervisor.Process) (ifaces []string, err error) {
 	lines, err := p.Command("networksetup", "-listallnetworkservices").Capture(nil)
 	if err != nil {
@@ -0,0 +1,473 @@
+package dns
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/pkg/supervisor"
+)
+
+var (
+	// resolvConf is the file we rewrite when systemd-resolved
+	// isn't in charge of dns.
+	resolvConf = "/etc/resolv.conf"
+
+	// searchStatePath records how the search domains were
+	// overridden, so that they can be put back even if teleproxy
+	// dies without doing so itself.
+	searchStatePath = "/var/run/teleproxy-search.json"
+)
+
+const (
+	methodResolved   = "systemd-resolved"
+	methodResolvConf = "resolv.conf"
+
+	// resolvedStub is the address glibc talks to when
+	// systemd-resolved is handling dns.
+	resolvedStub = "127.0.0.53"
+)
+
+// searchState is what we record about an override in
+// searchStatePath.
+type searchState struct {
+	Method string `json:"method"`
+
+	// Links holds the domains each systemd-resolved link had
+	// before we changed them.
+	Links []linkDomains `json:"links,omitempty"`
+
+	// Original is what resolv.conf contained, and Symlink where it
+	// pointed if it was a symlink. Rewritten is what we replaced it
+	// with, so that we can tell if somebody else has changed it
+	// since.
+	Original  string `json:"original,omitempty"`
+	Symlink   string `json:"symlink,omitempty"`
+	Rewritten string `json:"rewritten,omitempty"`
+}
+
+type linkDomains struct {
+	Index   int      `json:"index"`
+	Domains []domain `json:"domains"`
+}
+
+// A domain is a systemd-resolved link domain. Routing domains only
+// decide which link's servers are asked about a name, they are never
+// searched.
+type domain struct {
+	Name    string `json:"name"`
+	Routing bool   `json:"routing,omitempty"`
+}
+
+// OverrideSearchDomains sets the system search domains to domains, a
+// space separated list, and returns a function that puts back the
+// ones that were there before. It uses systemd-resolved's D-Bus API
+// when systemd-resolved is what glibc asks, and otherwise rewrites
+// /etc/resolv.conf. What it changed is recorded so that
+// CleanupSearchDomains can undo it after a crash.
+func OverrideSearchDomains(p *supervisor.Process, domains string) func() {
+	// put back anything left over from a teleproxy that didn't
+	// get to clean up after itself
+	if err := CleanupSearchDomains(p); err != nil {
+		log("not overriding search domains: %v", err)
+		return func() {}
+	}
+
+	var st *searchState
+	var err error
+	if usesResolved(p) {
+		st, err = overrideResolved(p, strings.Fields(domains))
+	} else {
+		st, err = overrideResolvConf(domains)
+	}
+	if err != nil {
+		log("error overriding search domains: %v", err)
+	}
+	if st == nil {
+		return func() {}
+	}
+	log("overrode search domains with %s: %s", st.Method, domains)
+
+	return func() {
+		if err := restoreSearch(p, st); err != nil {
+			log("error restoring search domains: %v", err)
+		}
+	}
+}
+
+// CleanupSearchDomains puts back the search domains from a previous
+// override that was never undone, if there was one.
+func CleanupSearchDomains(p *supervisor.Process) error {
+	bytes, err := ioutil.ReadFile(searchStatePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st searchState
+	if err := json.Unmarshal(bytes, &st); err != nil {
+		return errors.Wrapf(err, "parsing %s", searchStatePath)
+	}
+	log("restoring search domains left overridden with %s", st.Method)
+	return restoreSearch(p, &st)
+}
+
+func saveSearchState(st *searchState) error {
+	bytes, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(searchStatePath, bytes, 0600)
+}
+
+func restoreSearch(p *supervisor.Process, st *searchState) error {
+	var err error
+	switch st.Method {
+	case methodResolved:
+		err = restoreResolved(p, st)
+	case methodResolvConf:
+		err = restoreResolvConf(st)
+	default:
+		err = errors.Errorf("unknown search override method: %q", st.Method)
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Remove(searchStatePath)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// writeFile replaces path atomically where it can. That isn't
+// possible when path is a mount point (e.g. resolv.conf in a
+// container), so it is written in place then.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".teleproxy.tmp"
+	err := ioutil.WriteFile(tmp, data, perm)
+	if err == nil {
+		err = os.Rename(tmp, path)
+		if err != nil {
+			os.Remove(tmp)
+			err = ioutil.WriteFile(path, data, perm)
+		}
+	}
+	return err
+}
+
+// usesResolved reports whether lookups go through systemd-resolved,
+// i.e. it is running and resolv.conf points at its stub.
+func usesResolved(p *supervisor.Process) bool {
+	bytes, err := ioutil.ReadFile(resolvConf)
+	if err != nil || !contains(nameservers(string(bytes)), resolvedStub) {
+		return false
+	}
+	err = p.Command("busctl", "call", "org.freedesktop.resolve1", "/org/freedesktop/resolve1",
+		"org.freedesktop.DBus.Peer", "Ping").Run()
+	return err == nil
+}
+
+func nameservers(contents string) (result []string) {
+	for _, line := range strings.Split(contents, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			result = append(result, fields[1])
+		}
+	}
+	return
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteResolvConf replaces the search and domain lines of contents
+// with a single search line for domains.
+func rewriteResolvConf(contents, domains string) string {
+	var lines []string
+	added := false
+	for _, line := range strings.Split(strings.TrimSuffix(contents, "\n"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && (fields[0] == "search" || fields[0] == "domain") {
+			if !added {
+				lines = append(lines, "# search domains overridden by teleproxy", "search "+domains)
+				added = true
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if !added {
+		lines = append(lines, "# search domains overridden by teleproxy", "search "+domains)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func overrideResolvConf(domains string) (*searchState, error) {
+	st := &searchState{Method: methodResolvConf}
+	if target, err := os.Readlink(resolvConf); err == nil {
+		st.Symlink = target
+	}
+	bytes, err := ioutil.ReadFile(resolvConf)
+	if err != nil {
+		return nil, err
+	}
+	st.Original = string(bytes)
+	st.Rewritten = rewriteResolvConf(st.Original, domains)
+
+	// record the state first, so that a crash part way through
+	// still gets cleaned up
+	if err := saveSearchState(st); err != nil {
+		return nil, err
+	}
+	if err := writeFile(resolvConf, []byte(st.Rewritten), 0644); err != nil {
+		os.Remove(searchStatePath)
+		return nil, err
+	}
+	return st, nil
+}
+
+func restoreResolvConf(st *searchState) error {
+	bytes, err := ioutil.ReadFile(resolvConf)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && string(bytes) != st.Rewritten {
+		// somebody (e.g. a dhcp client) has written it since, so
+		// what they wrote is more current than what we saved
+		log("%s has changed since teleproxy rewrote it, leaving it alone", resolvConf)
+		return nil
+	}
+
+	if st.Symlink != "" {
+		tmp := resolvConf + ".teleproxy.tmp"
+		os.Remove(tmp)
+		err = os.Symlink(st.Symlink, tmp)
+		if err == nil {
+			err = os.Rename(tmp, resolvConf)
+		}
+		if err == nil {
+			return nil
+		}
+		os.Remove(tmp)
+	}
+	return writeFile(resolvConf, []byte(st.Original), 0644)
+}
+
+// overrideResolved replaces the search domains of every link that
+// systemd-resolved has dns servers for. Their routing domains are
+// kept so that any split dns setup keeps working. The root domain
+// means no search domains at all.
+func overrideResolved(p *supervisor.Process, domains []string) (*searchState, error) {
+	links, err := resolvedLinks(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(links) == 0 {
+		return nil, errors.New("systemd-resolved has no links with dns servers")
+	}
+
+	st := &searchState{Method: methodResolved, Links: links}
+	if err := saveSearchState(st); err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		var next []domain
+		for _, d := range link.Domains {
+			if d.Routing {
+				next = append(next, d)
+			}
+		}
+		for _, name := range domains {
+			if name = strings.Trim(name, "."); name != "" {
+				next = append(next, domain{Name: name})
+			}
+		}
+		if err := setLinkDomains(p, link.Index, next); err != nil {
+			restoreResolved(p, st)
+			os.Remove(searchStatePath)
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+func restoreResolved(p *supervisor.Process, st *searchState) error {
+	var result error
+	for _, link := range st.Links {
+		if err := setLinkDomains(p, link.Index, link.Domains); err != nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func resolvedProperty(p *supervisor.Process, name string) ([]string, error) {
+	out, err := p.Command("busctl", "get-property", "org.freedesktop.resolve1", "/org/freedesktop/resolve1",
+		"org.freedesktop.resolve1.Manager", name).Capture(nil)
+	if err != nil {
+		return nil, err
+	}
+	return tokenize(out)
+}
+
+// resolvedLinks returns the links systemd-resolved has dns servers
+// for along with their current domains.
+func resolvedLinks(p *supervisor.Process) ([]linkDomains, error) {
+	servers, err := resolvedProperty(p, "DNS")
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := parseDNS(servers)
+	if err != nil {
+		return nil, err
+	}
+	domains, err := resolvedProperty(p, "Domains")
+	if err != nil {
+		return nil, err
+	}
+	byLink, err := parseDomains(domains)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []linkDomains
+	for _, index := range indexes {
+		result = append(result, linkDomains{Index: index, Domains: byLink[index]})
+	}
+	return result, nil
+}
+
+func setLinkDomains(p *supervisor.Process, index int, domains []domain) error {
+	args := []string{"call", "org.freedesktop.resolve1", "/org/freedesktop/resolve1",
+		"org.freedesktop.resolve1.Manager", "SetLinkDomains", "ia(sb)",
+		strconv.Itoa(index), strconv.Itoa(len(domains))}
+	for _, d := range domains {
+		args = append(args, d.Name, strconv.FormatBool(d.Routing))
+	}
+	return p.Command("busctl", args...).Run()
+}
+
+// tokenize splits busctl's output into its values, unquoting strings.
+func tokenize(out string) ([]string, error) {
+	var result []string
+	rest := strings.TrimSpace(out)
+	for rest != "" {
+		var token string
+		if rest[0] == '"' {
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(rest) {
+				return nil, errors.Errorf("unterminated string in busctl output: %q", out)
+			}
+			var err error
+			token, err = strconv.Unquote(rest[:end+1])
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing busctl output: %q", out)
+			}
+			rest = rest[end+1:]
+		} else {
+			end := strings.IndexAny(rest, " \t\n")
+			if end < 0 {
+				end = len(rest)
+			}
+			token = rest[:end]
+			rest = rest[end:]
+		}
+		result = append(result, token)
+		rest = strings.TrimSpace(rest)
+	}
+	return result, nil
+}
+
+// values checks that tokens holds an array of the given signature
+// and returns its element count and elements.
+func values(tokens []string, signature string) (int, []string, error) {
+	if len(tokens) < 2 || tokens[0] != signature {
+		return 0, nil, errors.Errorf("expected %s, got %v", signature, tokens)
+	}
+	n, err := strconv.Atoi(tokens[1])
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "parsing %s", signature)
+	}
+	return n, tokens[2:], nil
+}
+
+// parseDNS returns the links that have servers in the value of the
+// Manager's DNS property, a(iiay). Link 0 holds the global servers,
+// which aren't any link's.
+func parseDNS(tokens []string) ([]int, error) {
+	n, rest, err := values(tokens, "a(iiay)")
+	if err != nil {
+		return nil, err
+	}
+	var result []int
+	for i := 0; i < n; i++ {
+		if len(rest) < 3 {
+			return nil, errors.Errorf("short a(iiay): %v", tokens)
+		}
+		index, err := strconv.Atoi(rest[0])
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(rest[2])
+		if err != nil || len(rest) < 3+size {
+			return nil, errors.Errorf("bad a(iiay): %v", tokens)
+		}
+		rest = rest[3+size:]
+		if index != 0 && !containsInt(result, index) {
+			result = append(result, index)
+		}
+	}
+	return result, nil
+}
+
+// parseDomains groups the value of the Manager's Domains property,
+// a(isb), by link.
+func parseDomains(tokens []string) (map[int][]domain, error) {
+	n, rest, err := values(tokens, "a(isb)")
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 3*n {
+		return nil, errors.Errorf("bad a(isb): %v", tokens)
+	}
+	result := make(map[int][]domain)
+	for i := 0; i < n; i++ {
+		index, err := strconv.Atoi(rest[3*i])
+		if err != nil {
+			return nil, err
+		}
+		routing, err := strconv.ParseBool(rest[3*i+2])
+		if err != nil {
+			return nil, err
+		}
+		result[index] = append(result[index], domain{Name: rest[3*i+1], Routing: routing})
+	}
+	return result, nil
+}
+
+func containsInt(list []int, n int) bool {
+	for _, x := range list {
+		if x == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package dns
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/datawire/teleproxy/pkg/supervisor"
+)
+
+func TestRewriteResolvConf(t *testing.T) {
+	original := "# generated\nnameserver 10.0.0.53\ndomain corp.example.com\nsearch corp.example.com example.com\noptions ndots:2\n"
+	expected := "# generated\nnameserver 10.0.0.53\n# search domains overridden by teleproxy\nsearch .\noptions ndots:2\n"
+	if result := rewriteResolvConf(original, "."); result != expected {
+		t.Errorf("got %q, expected %q", result, expected)
+	}
+
+	expected = "nameserver 10.0.0.53\n# search domains overridden by teleproxy\nsearch .\n"
+	if result := rewriteResolvConf("nameserver 10.0.0.53\n", "."); result != expected {
+		t.Errorf("got %q, expected %q", result, expected)
+	}
+}
+
+// withResolvConf points the search override at a temporary
+// resolv.conf for the duration of a test.
+func withResolvConf(t *testing.T, contents string, symlink bool) (string, func()) {
+	dir, err := ioutil.TempDir("", "search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "resolv.conf")
+	target := path
+	if symlink {
+		target = filepath.Join(dir, "stub-resolv.conf")
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(target, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	savedConf, savedState := resolvConf, searchStatePath
+	resolvConf, searchStatePath = path, filepath.Join(dir, "search.json")
+	return path, func() {
+		resolvConf, searchStatePath = savedConf, savedState
+		os.RemoveAll(dir)
+	}
+}
+
+func read(t *testing.T, path string) string {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bytes)
+}
+
+func TestOverrideResolvConf(t *testing.T) {
+	original := "nameserver 10.0.0.53\nsearch example.com\n"
+	for _, symlink := range []bool{false, true} {
+		path, done := withResolvConf(t, original, symlink)
+		supervisor.MustRun("override", func(p *supervisor.Process) error {
+			restore := OverrideSearchDomains(p, ".")
+			if contents := read(t, path); contents != rewriteResolvConf(original, ".") {
+				t.Errorf("not overridden: %q", contents)
+			}
+			restore()
+			return nil
+		})
+		if contents := read(t, path); contents != original {
+			t.Errorf("not restored: %q", contents)
+		}
+		if _, err := os.Readlink(path); (err == nil) != symlink {
+			t.Errorf("symlink %v, got %v", symlink, err)
+		}
+		if _, err := os.Stat(searchStatePath); !os.IsNotExist(err) {
+			t.Errorf("state left behind: %v", err)
+		}
+		done()
+	}
+}
+
+func TestCleanupSearchDomains(t *testing.T) {
+	original := "nameserver 10.0.0.53\nsearch example.com\n"
+	path, done := withResolvConf(t, original, false)
+	defer done()
+
+	supervisor.MustRun("crash", func(p *supervisor.Process) error {
+		// never call the restore function, as if we crashed
+		OverrideSearchDomains(p, ".")
+		return CleanupSearchDomains(p)
+	})
+	if contents := read(t, path); contents != original {
+		t.Errorf("not restored: %q", contents)
+	}
+
+	// if somebody else has rewritten it in the meantime, theirs
+	// wins
+	supervisor.MustRun("changed", func(p *supervisor.Process) error {
+		OverrideSearchDomains(p, ".")
+		if err := ioutil.WriteFile(path, []byte("nameserver 10.0.0.1\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return CleanupSearchDomains(p)
+	})
+	if contents := read(t, path); contents != "nameserver 10.0.0.1\n" {
+		t.Errorf("clobbered: %q", contents)
+	}
+}
+
+func TestParseResolved(t *testing.T) {
+	tokens, err := tokenize(`a(iiay) 3 0 2 4 1 1 1 1 2 2 4 10 0 0 53 3 10 16 32 1 13 184 0 0 0 0 0 0 0 0 0 0 0 83` + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	links, err := parseDNS(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(links, []int{2, 3}) {
+		t.Errorf("got links %v", links)
+	}
+
+	tokens, err = tokenize(`a(isb) 3 0 "global.example" false 2 "corp.example.com" false 2 "~consul" true`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domains, err := parseDomains(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[int][]domain{
+		0: {{Name: "global.example"}},
+		2: {{Name: "corp.example.com"}, {Name: "~consul", Routing: true}},
+	}
+	if !reflect.DeepEqual(domains, expected) {
+		t.Errorf("got %v, expected %v", domains, expected)
+	}
+
+	if _, err := parseDomains([]string{"a(isb)", "2", "0", "x", "false"}); err == nil {
+		t.Error("expected an error for short output")
+	}
+}
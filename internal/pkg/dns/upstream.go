@@ -0,0 +1,124 @@
+package dns
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultTimeout is how long we wait for an upstream before
+	// moving on to the next one.
+	defaultTimeout = 2 * time.Second
+
+	// maxFailures is how many queries in a row an upstream may
+	// fail before we stop trying it first.
+	maxFailures = 3
+
+	// downTime is how long an upstream that has failed too many
+	// times in a row is skipped for.
+	downTime = 30 * time.Second
+)
+
+// An upstream is one of the fallback servers along with what we know
+// about its health.
+type upstream struct {
+	addr string
+
+	mu          sync.Mutex
+	queries     uint64
+	failures    uint64
+	consecutive int
+	downUntil   time.Time
+	lastError   string
+	rtt         time.Duration
+}
+
+// UpstreamStats describes the health of a fallback server.
+type UpstreamStats struct {
+	Address   string `json:"address"`
+	Healthy   bool   `json:"healthy"`
+	Queries   uint64 `json:"queries"`
+	Failures  uint64 `json:"failures"`
+	LastError string `json:"lastError,omitempty"`
+	// RTT is the round trip time of the last successful query,
+	// in milliseconds.
+	RTT float64 `json:"rtt"`
+}
+
+func (u *upstream) healthy(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !now.Before(u.downUntil)
+}
+
+func (u *upstream) record(rtt time.Duration, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.queries++
+	if err == nil {
+		u.consecutive = 0
+		u.downUntil = time.Time{}
+		u.rtt = rtt
+		return
+	}
+	u.failures++
+	u.consecutive++
+	u.lastError = err.Error()
+	if u.consecutive >= maxFailures {
+		u.downUntil = time.Now().Add(downTime)
+	}
+}
+
+func (u *upstream) stats(now time.Time) UpstreamStats {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return UpstreamStats{
+		Address:   u.addr,
+		Healthy:   !now.Before(u.downUntil),
+		Queries:   u.queries,
+		Failures:  u.failures,
+		LastError: u.lastError,
+		RTT:       float64(u.rtt) / float64(time.Millisecond),
+	}
+}
+
+// exchange sends r to the upstream. If a udp answer comes back
+// truncated, the query is retried over tcp so that we have the whole
+// answer. A SERVFAIL counts as a failure.
+func (u *upstream) exchange(r *dns.Msg, tcp bool, timeout time.Duration) (*dns.Msg, error) {
+	in, rtt, err := u.try(r, tcp, timeout)
+	if err == nil && in.Rcode == dns.RcodeServerFailure {
+		err = errors.Errorf("%s: SERVFAIL", u.addr)
+	}
+	u.record(rtt, err)
+	return in, err
+}
+
+func (u *upstream) try(r *dns.Msg, tcp bool, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	if !tcp {
+		in, rtt, err := (&dns.Client{Net: "udp", Timeout: timeout}).Exchange(r, u.addr)
+		if err != nil || !in.Truncated {
+			return in, rtt, err
+		}
+		log("QTYPE[%v] %s -> TRUNCATED, RETRYING OVER TCP", r.Question[0].Qtype, r.Question[0].Name)
+	}
+	return (&dns.Client{Net: "tcp", Timeout: timeout}).Exchange(r, u.addr)
+}
+
+// order returns the upstreams in the order to try them: the healthy
+// ones in their configured order, and then the rest as a last
+// resort.
+func order(upstreams []*upstream, now time.Time) []*upstream {
+	var healthy, down []*upstream
+	for _, u := range upstreams {
+		if u.healthy(now) {
+			healthy = append(healthy, u)
+		} else {
+			down = append(down, u)
+		}
+	}
+	return append(healthy, down...)
+}
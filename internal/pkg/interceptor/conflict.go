@@ -0,0 +1,239 @@
+package interceptor
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/datawire/teleproxy/internal/pkg/dns"
+	"github.com/datawire/teleproxy/internal/pkg/nat"
+	rt "github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+// A Claim is one table's route for a contested name or address.
+type Claim struct {
+	Table    string   `json:"table"`
+	Priority int      `json:"priority"`
+	Route    rt.Route `json:"route"`
+}
+
+// A Conflict records that more than one table disagrees about where a
+// name resolves ("name") or where traffic for an address goes
+// ("address"). The claims are in order of precedence, so the first
+// one is the one in effect.
+type Conflict struct {
+	Kind   string  `json:"kind"`
+	Key    string  `json:"key"`
+	Claims []Claim `json:"claims"`
+}
+
+// merged is the result of combining every table into the set of
+// names and nat mappings that are actually in effect. Each name maps
+// to all of the routes for it in the table that won it, and records
+// holds the dns records generated from those routes, and dialers the
+// dialer of the table that won each nat mapping.
+type merged struct {
+	domains   map[string][]rt.Route
+	records   map[string]*dns.RecordSet
+	mappings  map[nat.Address]string
+	dialers   map[nat.Address]string
+	conflicts []Conflict
+}
+
+// precedence sorts tables so that the one that wins a conflict comes
+// first: higher priorities win, and ties go to the table whose name
+// sorts first.
+func precedence(tables map[string]rt.Table) []rt.Table {
+	result := make([]rt.Table, 0, len(tables))
+	for _, t := range tables {
+		result = append(result, t)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Priority != result[j].Priority {
+			return result[i].Priority > result[j].Priority
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// merge works out what should be in effect given all of the tables
+// and the exclude list. Within a table, earlier routes win over later
+// ones.
+func merge(tables map[string]rt.Table, ex excludes) merged {
+	m := merged{
+		domains:  make(map[string][]rt.Route),
+		mappings: make(map[nat.Address]string),
+		dialers:  make(map[nat.Address]string),
+	}
+
+	winners := make(map[string]string)
+	names := make(map[string][]Claim)
+	addresses := make(map[nat.Address][]Claim)
+	var nameOrder []string
+	var addressOrder []nat.Address
+
+	for _, table := range precedence(tables) {
+		for _, route := range ex.filter(table.Routes) {
+			claim := Claim{table.Name, table.Priority, route}
+
+			// only individual addresses have a name that
+			// resolves, CIDR routes just intercept
+			if route.Name != "" && !route.IsCIDR() {
+				domain := route.Domain()
+				if _, ok := winners[domain]; !ok {
+					winners[domain] = table.Name
+					nameOrder = append(nameOrder, domain)
+				}
+				if winners[domain] == table.Name {
+					m.domains[domain] = append(m.domains[domain], route)
+				}
+				names[domain] = append(names[domain], claim)
+			}
+
+			if route.Target == "" {
+				continue
+			}
+			switch route.Proto {
+			case "tcp", "udp":
+			default:
+				log.Printf("INT: unrecognized protocol: %v", route)
+				continue
+			}
+			addr := nat.Address{Proto: route.Proto, Ip: route.Ip, Port: route.Port}
+			if _, ok := m.mappings[addr]; !ok {
+				m.mappings[addr] = route.Target
+				m.dialers[addr] = table.Dialer
+				addressOrder = append(addressOrder, addr)
+			}
+			addresses[addr] = append(addresses[addr], claim)
+		}
+	}
+
+	for _, domain := range nameOrder {
+		claims := names[domain]
+		if disagree(claims, func(r rt.Route) string { return r.Ip + r.CNAME }) {
+			m.conflicts = append(m.conflicts, Conflict{"name", domain, claims})
+		}
+	}
+	for _, addr := range addressOrder {
+		claims := addresses[addr]
+		if disagree(claims, func(r rt.Route) string { return r.Target }) {
+			key := fmt.Sprintf("%s:%s:%s", addr.Proto, addr.Ip, addr.Port)
+			m.conflicts = append(m.conflicts, Conflict{"address", key, claims})
+		}
+	}
+
+	m.records = records(m.domains)
+	return m
+}
+
+// disagree reports whether any table other than the winning one has
+// a value for the given field of its routes that the winning table
+// doesn't.
+func disagree(claims []Claim, field func(rt.Route) string) bool {
+	winner := claims[0].Table
+	values := make(map[string]bool)
+	for _, c := range claims {
+		if c.Table == winner {
+			values[field(c.Route)] = true
+		}
+	}
+	for _, c := range claims {
+		if !values[field(c.Route)] {
+			return true
+		}
+	}
+	return false
+}
+
+// records generates the dns records for the given names: address
+// records (or a CNAME) for each name, SRV records for its named
+// ports, and PTR records for the reverse lookups of its addresses.
+func records(domains map[string][]rt.Route) map[string]*dns.RecordSet {
+	result := make(map[string]*dns.RecordSet)
+	get := func(name string) *dns.RecordSet {
+		rs, ok := result[name]
+		if !ok {
+			rs = &dns.RecordSet{}
+			result[name] = rs
+		}
+		return rs
+	}
+
+	for domain, routes := range domains {
+		rs := get(domain)
+		for _, route := range routes {
+			if route.CNAME != "" {
+				if rs.CNAME == "" {
+					rs.CNAME = strings.ToLower(strings.TrimSuffix(route.CNAME, ".") + ".")
+				}
+				continue
+			}
+
+			if !contains(rs.IPs, route.Ip) {
+				rs.IPs = append(rs.IPs, route.Ip)
+			}
+			if reverse := dns.ReverseName(route.Ip); reverse != "" {
+				ptr := get(reverse)
+				if !contains(ptr.PTR, domain) {
+					ptr.PTR = append(ptr.PTR, domain)
+				}
+			}
+
+			for _, srv := range route.SRV {
+				record := dns.SRV{Port: uint16(srv.Port), Target: domain}
+				rs := get(srv.Domain(route))
+				if !containsSRV(rs.SRV, record) {
+					rs.SRV = append(rs.SRV, record)
+				}
+			}
+		}
+	}
+
+	// keep the answers in a stable order
+	for _, rs := range result {
+		sort.Strings(rs.PTR)
+		sort.Slice(rs.SRV, func(i, j int) bool {
+			return rs.SRV[i].Port < rs.SRV[j].Port
+		})
+	}
+
+	return result
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsSRV(list []dns.SRV, srv dns.SRV) bool {
+	for _, x := range list {
+		if x == srv {
+			return true
+		}
+	}
+	return false
+}
+
+// changes returns the nat changes that get from the old mappings to
+// the new ones. Removals go first.
+func changes(old, new map[nat.Address]string) []nat.Change {
+	var clears, forwards []nat.Change
+	for addr := range old {
+		if _, ok := new[addr]; !ok {
+			clears = append(clears, nat.ClearChange(addr.Proto, addr.Ip, addr.Port))
+		}
+	}
+	for addr, target := range new {
+		if old[addr] != target {
+			forwards = append(forwards, nat.ForwardChange(addr.Proto, addr.Ip, addr.Port, target))
+		}
+	}
+	return append(clears, forwards...)
+}
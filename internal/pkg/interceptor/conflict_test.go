@@ -0,0 +1,109 @@
+package interceptor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/datawire/teleproxy/internal/pkg/dns"
+	"github.com/datawire/teleproxy/internal/pkg/nat"
+	rt "github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+func TestMerge(t *testing.T) {
+	tables := map[string]rt.Table{
+		"kubernetes": {Name: "kubernetes", Routes: []rt.Route{
+			{Name: "foo", Ip: "10.0.0.1", Proto: "tcp", Target: "1234"},
+			{Name: "bar", Ip: "10.0.0.2", Proto: "tcp", Target: "1234"},
+		}},
+		"docker": {Name: "docker", Routes: []rt.Route{
+			{Name: "foo", Ip: "172.17.0.2", Proto: "tcp"},
+			{Name: "bar", Ip: "10.0.0.2", Proto: "tcp"},
+		}},
+		"mine": {Name: "mine", Priority: 10, Routes: []rt.Route{
+			{Name: "baz", Ip: "10.0.0.2", Proto: "tcp", Target: "5678"},
+		}},
+	}
+
+	m := merge(tables, excludes{})
+
+	// docker sorts before kubernetes
+	if ip := m.domains["foo."][0].Ip; ip != "172.17.0.2" {
+		t.Errorf("foo resolved to %s", ip)
+	}
+	// the higher priority table wins the address
+	addr := nat.Address{Proto: "tcp", Ip: "10.0.0.2"}
+	if target := m.mappings[addr]; target != "5678" {
+		t.Errorf("%v forwarded to %s", addr, target)
+	}
+
+	// bar agrees everywhere, so it isn't a conflict
+	expected := []struct{ kind, key, winner string }{
+		{"name", "foo.", "docker"},
+		{"address", "tcp:10.0.0.2:", "mine"},
+	}
+	if len(m.conflicts) != len(expected) {
+		t.Fatalf("got %d conflicts, expected %d: %v", len(m.conflicts), len(expected), m.conflicts)
+	}
+	for i, e := range expected {
+		c := m.conflicts[i]
+		if c.Kind != e.kind || c.Key != e.key || c.Claims[0].Table != e.winner {
+			t.Errorf("got %v, expected %v", c, e)
+		}
+	}
+
+	// the result doesn't depend on map order
+	for n := 0; n < 10; n++ {
+		again := merge(tables, excludes{})
+		if !reflect.DeepEqual(again.domains, m.domains) || !reflect.DeepEqual(again.mappings, m.mappings) {
+			t.Fatal("merge is not deterministic")
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	a := nat.Address{Proto: "tcp", Ip: "10.0.0.1"}
+	b := nat.Address{Proto: "tcp", Ip: "10.0.0.2"}
+	c := nat.Address{Proto: "tcp", Ip: "10.0.0.3"}
+	old := map[nat.Address]string{a: "1", b: "1"}
+	new := map[nat.Address]string{b: "2", c: "1"}
+
+	result := changes(old, new)
+	if len(result) != 3 {
+		t.Fatalf("got %v", result)
+	}
+	if result[0] != nat.ClearChange("tcp", "10.0.0.1", "") {
+		t.Errorf("expected the clear first, got %v", result)
+	}
+}
+
+func TestRecords(t *testing.T) {
+	tables := map[string]rt.Table{
+		"kubernetes": {Name: "kubernetes", Routes: []rt.Route{
+			{Name: "web.ns.svc.cluster.local", Ip: "10.0.0.1", Proto: "tcp", Target: "1234",
+				SRV: []rt.SRV{{Service: "https", Proto: "tcp", Port: 443}, {Service: "http", Proto: "tcp", Port: 80}}},
+			{Name: "db.ns.svc.cluster.local", Ip: "10.1.0.1", Proto: "tcp", Target: "1234"},
+			{Name: "db.ns.svc.cluster.local", Ip: "10.1.0.2", Proto: "tcp", Target: "1234"},
+			{Name: "alias.ns.svc.cluster.local", CNAME: "Example.com"},
+			{Name: "other.ns.svc.cluster.local", Ip: "10.0.0.1", Proto: "tcp", Target: "1234"},
+		}},
+	}
+
+	records := merge(tables, excludes{}).records
+
+	for name, expected := range map[string]*dns.RecordSet{
+		"web.ns.svc.cluster.local.": {IPs: []string{"10.0.0.1"}},
+		"db.ns.svc.cluster.local.":  {IPs: []string{"10.1.0.1", "10.1.0.2"}},
+		"_http._tcp.web.ns.svc.cluster.local.": {SRV: []dns.SRV{
+			{Port: 80, Target: "web.ns.svc.cluster.local."},
+		}},
+		"alias.ns.svc.cluster.local.": {CNAME: "example.com."},
+		"1.0.0.10.in-addr.arpa.": {PTR: []string{
+			"other.ns.svc.cluster.local.",
+			"web.ns.svc.cluster.local.",
+		}},
+	} {
+		if !reflect.DeepEqual(records[name], expected) {
+			t.Errorf("%s: got %+v, expected %+v", name, records[name], expected)
+		}
+	}
+}
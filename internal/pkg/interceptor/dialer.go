@@ -0,0 +1,67 @@
+package interceptor
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/datawire/teleproxy/internal/pkg/nat"
+	rt "github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+// dialerFor returns the dialer for a connection to ip and port, taken
+// from the most specific of the mappings that cover it: a single
+// address beats a CIDR (and a narrower CIDR a wider one), and a
+// mapping for particular ports beats one for all ports.
+func dialerFor(dialers map[nat.Address]string, proto string, ip net.IP, port string) string {
+	best, bestBits, bestPorts := "", -1, false
+	for addr, dialer := range dialers {
+		bits, ok := covers(addr, proto, ip, port)
+		if !ok {
+			continue
+		}
+		ports := addr.Port != ""
+		if bits > bestBits || (bits == bestBits && ports && !bestPorts) {
+			best, bestBits, bestPorts = dialer, bits, ports
+		}
+	}
+	return best
+}
+
+// covers reports whether addr covers ip and port, and if so the
+// length of its prefix.
+func covers(addr nat.Address, proto string, ip net.IP, port string) (int, bool) {
+	if addr.Proto != proto || ip == nil {
+		return 0, false
+	}
+
+	bits := 0
+	if strings.Contains(addr.Ip, "/") {
+		_, network, err := net.ParseCIDR(addr.Ip)
+		if err != nil || !network.Contains(ip) {
+			return 0, false
+		}
+		bits, _ = network.Mask.Size()
+	} else {
+		parsed := net.ParseIP(addr.Ip)
+		if parsed == nil || !parsed.Equal(ip) {
+			return 0, false
+		}
+		bits = 8 * len(parsed)
+	}
+
+	if addr.Port == "" {
+		return bits, true
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, false
+	}
+	for _, part := range strings.Split(addr.Port, ",") {
+		from, to, err := rt.ParsePortRange(part)
+		if err == nil && uint16(n) >= from && uint16(n) <= to {
+			return bits, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,38 @@
+package interceptor
+
+import (
+	"net"
+	"testing"
+
+	rt "github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+func TestDialerFor(t *testing.T) {
+	tables := map[string]rt.Table{
+		"cluster": {Name: "cluster", Dialer: "kubernetes", Routes: []rt.Route{
+			{Ip: "10.96.0.0/12", Proto: "tcp", Target: "1234"},
+		}},
+		"wide": {Name: "wide", Routes: []rt.Route{
+			{Ip: "10.0.0.0/8", Proto: "tcp", Target: "1234"},
+		}},
+		"local": {Name: "local", Dialer: "direct", Routes: []rt.Route{
+			{Name: "db", Ip: "10.96.0.10", Proto: "tcp", Port: "5432,6000-6010", Target: "1234"},
+		}},
+	}
+	dialers := merge(tables, excludes{}).dialers
+
+	for _, tt := range []struct {
+		ip, port, expected string
+	}{
+		{"10.96.0.10", "5432", "direct"},
+		{"10.96.0.10", "6005", "direct"},
+		{"10.96.0.10", "80", "kubernetes"},
+		{"10.97.1.1", "80", "kubernetes"},
+		{"10.1.1.1", "80", ""},
+		{"192.0.2.1", "80", ""},
+	} {
+		if dialer := dialerFor(dialers, "tcp", net.ParseIP(tt.ip), tt.port); dialer != tt.expected {
+			t.Errorf("%s:%s: got %q, expected %q", tt.ip, tt.port, dialer, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package interceptor
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	rt "github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+// excludes is the parsed form of the exclude list. Each entry is
+// either an address or CIDR, which is never intercepted, or a domain
+// suffix, which is never resolved.
+type excludes struct {
+	list    []string
+	nets    []*net.IPNet
+	domains []string
+}
+
+func parseExcludes(list []string) (excludes, error) {
+	result := excludes{list: []string{}}
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		result.list = append(result.list, entry)
+
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return excludes{}, errors.Errorf("bad exclude: %q", entry)
+			}
+			result.nets = append(result.nets, network)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			result.nets = append(result.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else {
+			domain := strings.ToLower(strings.Trim(entry, "."))
+			if domain == "" || strings.ContainsAny(domain, " /:") {
+				return excludes{}, errors.Errorf("bad exclude: %q", entry)
+			}
+			result.domains = append(result.domains, domain+".")
+		}
+	}
+	return result, nil
+}
+
+// CheckExcludes returns an error if any entry in the list is neither
+// an address, a CIDR, nor a domain suffix.
+func CheckExcludes(list []string) error {
+	_, err := parseExcludes(list)
+	return err
+}
+
+// cidrs returns the entries that the translator needs to know about.
+func (e excludes) cidrs() (result []string) {
+	for _, network := range e.nets {
+		result = append(result, network.String())
+	}
+	return
+}
+
+// domain reports whether the fully qualified name falls under one of
+// the excluded suffixes.
+func (e excludes) domain(name string) bool {
+	name = strings.ToLower(name)
+	for _, suffix := range e.domains {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether everything the route would intercept is
+// excluded, either by name or by address. Routes that merely overlap
+// an excluded network are kept, the translator carves the excluded
+// part out of them.
+func (e excludes) covers(route rt.Route) bool {
+	if route.Name != "" && e.domain(route.Domain()) {
+		return true
+	}
+
+	var ip net.IP
+	ones := -1
+	if route.IsCIDR() {
+		var network *net.IPNet
+		var err error
+		ip, network, err = net.ParseCIDR(route.Ip)
+		if err != nil {
+			return false
+		}
+		ones, _ = network.Mask.Size()
+	} else {
+		ip = net.ParseIP(route.Ip)
+		if ip == nil {
+			return false
+		}
+	}
+
+	for _, network := range e.nets {
+		size, _ := network.Mask.Size()
+		if network.Contains(ip) && (ones < 0 || size <= ones) {
+			return true
+		}
+	}
+	return false
+}
+
+// BootstrapTable is the table with the routes teleproxy needs for
+// itself, to its dns server and its api. It can't be deleted, and
+// nothing in it may be excluded.
+const BootstrapTable = "bootstrap"
+
+// protect returns an error if the excludes cover any route in the
+// bootstrap table, since excluding those would quietly cut teleproxy
+// off from its own dns server or api.
+func (e excludes) protect(tables map[string]rt.Table) error {
+	for _, route := range tables[BootstrapTable].Routes {
+		if e.covers(route) {
+			return errors.Errorf("excludes %v cover %s, which teleproxy needs for itself", e.list, route.Key())
+		}
+	}
+	return nil
+}
+
+// filter returns the routes that aren't covered by the excludes.
+func (e excludes) filter(routes []rt.Route) (result []rt.Route) {
+	for _, route := range routes {
+		if !e.covers(route) {
+			result = append(result, route)
+		}
+	}
+	return
+}
@@ -0,0 +1,88 @@
+package interceptor
+
+import (
+	"testing"
+
+	rt "github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+func TestParseExcludes(t *testing.T) {
+	for _, bad := range []string{"10.0.0.0/33", "foo/bar", "."} {
+		if err := CheckExcludes([]string{bad}); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+
+	ex, err := parseExcludes([]string{"10.1.0.0/16", "192.0.2.1", "2001:db8::/32", ".Corp.Example.com."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.1.0.0/16", "192.0.2.1/32", "2001:db8::/32"}
+	actual := ex.cidrs()
+	if len(actual) != len(expected) {
+		t.Fatalf("got %v, expected %v", actual, expected)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("got %v, expected %v", actual, expected)
+		}
+	}
+}
+
+var covered = []struct {
+	route rt.Route
+	ok    bool
+}{
+	{rt.Route{Name: "foo", Ip: "10.1.2.3"}, true},
+	{rt.Route{Name: "foo", Ip: "10.2.2.3"}, false},
+	{rt.Route{Name: "foo", Ip: "192.0.2.1"}, true},
+	{rt.Route{Name: "foo", Ip: "192.0.2.2"}, false},
+	{rt.Route{Name: "foo", Ip: "2001:db8::1"}, true},
+	{rt.Route{Name: "vpn.corp.example.com", Ip: "10.2.2.3"}, true},
+	{rt.Route{Name: "corp.example.com", Ip: "10.2.2.3"}, true},
+	{rt.Route{Name: "notcorp.example.com", Ip: "10.2.2.3"}, false},
+	{rt.Route{Ip: "10.1.128.0/17"}, true},
+	// overlapping CIDRs are carved up by the translator
+	{rt.Route{Ip: "10.0.0.0/8"}, false},
+	{rt.Route{Ip: "10.96.0.0/12"}, false},
+}
+
+func TestCovers(t *testing.T) {
+	ex, err := parseExcludes([]string{"10.1.0.0/16", "192.0.2.1", "2001:db8::/32", "corp.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range covered {
+		if ex.covers(tt.route) != tt.ok {
+			t.Errorf("%v: expected covered=%v", tt.route, tt.ok)
+		}
+	}
+}
+
+func TestProtect(t *testing.T) {
+	tables := map[string]rt.Table{
+		BootstrapTable: {Name: BootstrapTable, Routes: []rt.Route{
+			{Ip: "192.0.2.53", Proto: "udp", Target: "1233"},
+			{Name: "teleproxy", Ip: "127.254.254.254", Proto: "tcp", Target: "8000"},
+		}},
+		"other": {Name: "other", Routes: []rt.Route{{Name: "foo", Ip: "10.1.2.3", Proto: "tcp", Target: "1234"}}},
+	}
+	for _, tt := range []struct {
+		excludes []string
+		ok       bool
+	}{
+		{[]string{"10.1.0.0/16"}, true},
+		{[]string{"127.0.0.0/8"}, false},
+		{[]string{"192.0.2.53"}, false},
+		{[]string{"192.0.2.0/24"}, false},
+		{[]string{"teleproxy"}, false},
+	} {
+		ex, err := parseExcludes(tt.excludes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ex.protect(tables); (err == nil) != tt.ok {
+			t.Errorf("%v: expected ok=%v, got %v", tt.excludes, tt.ok, err)
+		}
+	}
+}
@@ -2,13 +2,18 @@ package interceptor
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/datawire/teleproxy/pkg/supervisor"
 
+	"github.com/datawire/teleproxy/internal/pkg/dns"
 	"github.com/datawire/teleproxy/internal/pkg/nat"
 	rt "github.com/datawire/teleproxy/internal/pkg/route"
 )
@@ -16,22 +21,49 @@ import (
 type Interceptor struct {
 	translator *nat.Translator
 	tables     map[string]rt.Table
+	expires    map[string]time.Time
+	// versions outlive the tables, so that a table that is
+	// deleted and created again doesn't reuse old versions
+	versions   map[string]uint64
 	tablesLock sync.RWMutex
 
-	domains     map[string]rt.Route
+	// domains, mappings, and conflicts are all worked out from
+	// the tables and excludes together. Everything here is
+	// protected by domainsLock since it decides what Resolve may
+	// answer.
+	domains     map[string][]rt.Route
+	records     map[string]*dns.RecordSet
+	mappings    map[nat.Address]string
+	dialers     map[nat.Address]string
+	conflicts   []Conflict
+	excludes    excludes
 	domainsLock sync.RWMutex
 
 	search     []string
 	searchLock sync.RWMutex
 
+	watchers watchers
+
 	work chan func(*supervisor.Process) error
 }
 
-func NewInterceptor(name string) *Interceptor {
+// NewInterceptor creates an Interceptor whose firewall rules live
+// under the given name. The natBackend is passed through to the
+// nat.Translator and may be empty to pick a default.
+func NewInterceptor(name, natBackend string) *Interceptor {
+	translator := nat.NewTranslator(name)
+	translator.Backend = natBackend
 	ret := &Interceptor{
 		tables:     make(map[string]rt.Table),
-		translator: nat.NewTranslator(name),
-		domains:    make(map[string]rt.Route),
+		expires:    make(map[string]time.Time),
+		versions:   make(map[string]uint64),
+		translator: translator,
+		domains:    make(map[string][]rt.Route),
+		records:    make(map[string]*dns.RecordSet),
+		mappings:   make(map[nat.Address]string),
+		dialers:    make(map[nat.Address]string),
+		conflicts:  []Conflict{},
+		excludes:   excludes{list: []string{}},
 		search:     []string{""},
 		work:       make(chan func(*supervisor.Process) error),
 	}
@@ -40,11 +72,17 @@ func NewInterceptor(name string) *Interceptor {
 }
 
 func (i *Interceptor) Work(p *supervisor.Process) error {
-	i.translator.Enable(p)
+	if err := i.translator.Enable(p); err != nil {
+		// leave it locked, there is nothing to update
+		return err
+	}
 	i.tablesLock.Unlock()
 
 	p.Ready()
 
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-p.Shutdown():
@@ -52,6 +90,8 @@ func (i *Interceptor) Work(p *supervisor.Process) error {
 			i.translator.Disable(p)
 			// leave it locked
 			return nil
+		case now := <-ticker.C:
+			i.expire(p, now)
 		case f := <-i.work:
 			err := f(p)
 			if err != nil {
@@ -61,11 +101,11 @@ func (i *Interceptor) Work(p *supervisor.Process) error {
 	}
 }
 
-// Resolve looks up the given query in the (FIXME: somewhere), trying
-// all the suffixes in the search path, and returns a Route on success
-// or nil on failure. This implementation does not count the number of
-// dots in the query.
-func (i *Interceptor) Resolve(query string) *rt.Route {
+// Resolve looks up the given query in the records generated from the
+// routing tables, trying all the suffixes in the search path, and
+// returns the records on success or nil on failure. This
+// implementation does not count the number of dots in the query.
+func (i *Interceptor) Resolve(query string) *dns.RecordSet {
 	if !strings.HasSuffix(query, ".") {
 		query += "."
 	}
@@ -84,17 +124,63 @@ func (i *Interceptor) Resolve(query string) *rt.Route {
 
 	for _, suffix := range i.search {
 		name := query + suffix
-		value, ok := i.domains[strings.ToLower(name)]
+		if i.excludes.domain(name) {
+			continue
+		}
+		value, ok := i.records[strings.ToLower(name)]
 		if ok {
-			return &value
+			return value
 		}
 	}
 	return nil
 }
 
-func (i *Interceptor) Destination(conn *net.TCPConn) (string, error) {
-	_, host, err := i.translator.GetOriginalDst(conn)
-	return host, err
+// Destination returns where an intercepted connection was originally
+// headed, and the dialer of the table that intercepted it.
+func (i *Interceptor) Destination(conn *net.TCPConn) (host, dialer string, err error) {
+	_, host, err = i.translator.GetOriginalDst(conn)
+	if err != nil {
+		return "", "", err
+	}
+
+	ip, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return "", "", err
+	}
+	i.domainsLock.RLock()
+	defer i.domainsLock.RUnlock()
+	return host, dialerFor(i.dialers, "tcp", net.ParseIP(ip), port), nil
+}
+
+// DestinationUDP returns where a datagram from src, that was
+// redirected to local, was originally headed, and the dialer of the
+// table that intercepted it.
+func (i *Interceptor) DestinationUDP(src, local *net.UDPAddr) (host, dialer string, err error) {
+	host, err = i.translator.GetOriginalDstUDP(src, local)
+	if err != nil {
+		return "", "", err
+	}
+
+	ip, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return "", "", err
+	}
+	i.domainsLock.RLock()
+	defer i.domainsLock.RUnlock()
+	return host, dialerFor(i.dialers, "udp", net.ParseIP(ip), port), nil
+}
+
+// ServiceName returns the name that ip resolves to according to the
+// routing tables, or the empty string if there isn't one.
+func (i *Interceptor) ServiceName(ip string) string {
+	i.domainsLock.RLock()
+	defer i.domainsLock.RUnlock()
+
+	rs, ok := i.records[dns.ReverseName(ip)]
+	if !ok || len(rs.PTR) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(rs.PTR[0], ".")
 }
 
 func (i *Interceptor) Render(table string) string {
@@ -146,109 +232,294 @@ func (i *Interceptor) Delete(table string) bool {
 			return nil
 		}
 
+		var empty []rt.Table
 		for _, name := range names {
-			if name != "bootstrap" {
-				err := i.update(p, rt.Table{Name: name})
-				if err != nil {
-					return err
-				}
+			if name != BootstrapTable {
+				empty = append(empty, rt.Table{Name: name})
 			}
 		}
-
-		result <- true
+		result <- i.update(p, empty...) == nil
 		return nil
 	}
 
 	return <-result
 }
 
-func (i *Interceptor) Update(table rt.Table) {
-	result := make(chan struct{})
+// A VersionConflict is returned when a table is updated or patched
+// with a Version other than its current one, i.e. when somebody else
+// changed it first.
+type VersionConflict struct {
+	Table    string
+	Expected uint64
+	Actual   uint64
+}
+
+func (v *VersionConflict) Error() string {
+	return fmt.Sprintf("table %s is at version %d, not %d", v.Table, v.Actual, v.Expected)
+}
+
+// checkVersion returns a VersionConflict unless version is zero or
+// the current version of the table. The caller must hold .tablesLock.
+func (i *Interceptor) checkVersion(table string, version uint64) error {
+	if version != 0 && version != i.versions[table] {
+		return &VersionConflict{Table: table, Expected: version, Actual: i.versions[table]}
+	}
+	return nil
+}
+
+// Update replaces the named tables. All of the resulting NAT changes
+// are applied as a single batch; if that fails, the error is
+// returned and the previous versions of the tables stay in effect.
+// If a table has a Version, it must be the current one, and if any
+// of them isn't, none of the tables are changed.
+func (i *Interceptor) Update(tables ...rt.Table) error {
+	result := make(chan error)
+	i.work <- func(p *supervisor.Process) error {
+		i.tablesLock.Lock()
+		defer i.tablesLock.Unlock()
+		i.domainsLock.Lock()
+		defer i.domainsLock.Unlock()
+		for _, table := range tables {
+			if err := i.checkVersion(table.Name, table.Version); err != nil {
+				result <- err
+				return nil
+			}
+		}
+		result <- i.update(p, tables...)
+		return nil
+	}
+	return <-result
+}
+
+// Patch changes some of the routes in the named table, creating it if
+// need be, and returns the result. Like Update, it either takes
+// effect entirely or not at all.
+func (i *Interceptor) Patch(name string, patch rt.Patch) (rt.Table, error) {
+	type patched struct {
+		table rt.Table
+		err   error
+	}
+	result := make(chan patched)
 	i.work <- func(p *supervisor.Process) error {
-		defer close(result)
 		i.tablesLock.Lock()
 		defer i.tablesLock.Unlock()
 		i.domainsLock.Lock()
 		defer i.domainsLock.Unlock()
-		return i.update(p, table)
+		if err := i.checkVersion(name, patch.Version); err != nil {
+			result <- patched{err: err}
+			return nil
+		}
+		table, ok := i.tables[name]
+		if !ok {
+			table = rt.Table{Name: name}
+		}
+		table = table.Apply(patch)
+		if err := i.update(p, table); err != nil {
+			result <- patched{err: err}
+			return nil
+		}
+		table.Version = i.versions[name]
+		result <- patched{table: table}
+		return nil
 	}
-	<-result
+	r := <-result
+	return r.table, r.err
 }
 
-// .update() assumes that both .tablesLock and .domainsLock are held
-// for writing.  Ensuring that is the case is the caller's
-// responsibility.
-func (i *Interceptor) update(p *supervisor.Process, table rt.Table) error {
-	oldTable, ok := i.tables[table.Name]
+// .update() replaces the given tables in one batch, so that either
+// all of them take effect or none do. It assumes that both
+// .tablesLock and .domainsLock are held for writing.  Ensuring that
+// is the case is the caller's responsibility.
+func (i *Interceptor) update(p *supervisor.Process, updates ...rt.Table) error {
+	tables := make(map[string]rt.Table, len(i.tables)+len(updates))
+	for name, t := range i.tables {
+		tables[name] = t
+	}
+	versions := make(map[string]uint64, len(updates))
+	var names []string
+	for _, table := range updates {
+		version, ok := versions[table.Name]
+		if !ok {
+			version = i.versions[table.Name]
+			names = append(names, table.Name)
+		}
+		// bridges post their tables over and over, and that
+		// shouldn't count as a change
+		table.Version = version
+		if old, ok := tables[table.Name]; !ok || !sameTable(old, table) {
+			table.Version++
+		}
+		versions[table.Name] = table.Version
+		if table.Routes == nil || len(table.Routes) == 0 {
+			delete(tables, table.Name)
+		} else {
+			tables[table.Name] = table
+		}
+	}
+
+	err := i.apply(p, tables, i.excludes)
+	if err != nil {
+		log.Printf("INT: failed to update %s, keeping previous rules: %v", strings.Join(names, ", "), err)
+		return err
+	}
 
-	oldRoutes := make(map[string]rt.Route)
-	if ok {
-		for _, route := range oldTable.Routes {
-			oldRoutes[route.Name] = route
+	for _, name := range names {
+		i.versions[name] = versions[name]
+		// every update renews the lease, even if nothing changed
+		if table, ok := tables[name]; ok && table.TTL > 0 {
+			i.expires[name] = time.Now().Add(time.Duration(table.TTL) * time.Second)
+		} else {
+			delete(i.expires, name)
 		}
 	}
+	return nil
+}
 
-	for _, newRoute := range table.Routes {
-		oldRoute, oldRouteOk := oldRoutes[newRoute.Name]
-		// A nil Route (when oldRouteOk != true) will compare
-		// inequal to any valid new Route.
-		if newRoute != oldRoute {
-			// delete the old version
-			if oldRouteOk {
-				switch newRoute.Proto {
-				case "tcp":
-					i.translator.ClearTCP(p, oldRoute.Ip, oldRoute.Port)
-				case "udp":
-					i.translator.ClearUDP(p, oldRoute.Ip, oldRoute.Port)
-				default:
-					log.Printf("INT: unrecognized protocol: %v", newRoute)
-				}
-			}
-			// and add the new version
-			if newRoute.Target != "" {
-				switch newRoute.Proto {
-				case "tcp":
-					i.translator.ForwardTCP(p, newRoute.Ip, newRoute.Port, newRoute.Target)
-				case "udp":
-					i.translator.ForwardUDP(p, newRoute.Ip, newRoute.Port, newRoute.Target)
-				default:
-					log.Printf("INT: unrecognized protocol: %v", newRoute)
-				}
-			}
+// apply makes the given tables and excludes take effect. Since
+// several tables may claim the same name or address, what is in
+// effect is worked out from all of the tables at once, and the whole
+// difference from what is currently in effect is handed to the
+// translator in one batch. Nothing is modified unless that batch
+// is applied successfully. The same locks as .update() must be held.
+func (i *Interceptor) apply(p *supervisor.Process, tables map[string]rt.Table, ex excludes) error {
+	if err := ex.protect(tables); err != nil {
+		return err
+	}
+	next := merge(tables, ex)
 
-			if newRoute.Name != "" {
-				log.Printf("INT: STORE %v->%v", newRoute.Domain(), newRoute)
-				i.domains[newRoute.Domain()] = newRoute
-			}
+	natChanges := changes(i.mappings, next.mappings)
+	if !equal(ex.cidrs(), i.excludes.cidrs()) {
+		err := i.translator.ApplyExcludes(p, ex.cidrs(), natChanges)
+		if err != nil {
+			return err
 		}
+		log.Printf("INT: EXCLUDE %v", ex.list)
+	} else if len(natChanges) > 0 {
+		err := i.translator.Apply(p, natChanges)
+		if err != nil {
+			return err
+		}
+	}
 
-		// remove the route from our map of old routes so we
-		// don't end up deleting it below
-		delete(oldRoutes, newRoute.Name)
+	for domain, routes := range i.domains {
+		if _, ok := next.domains[domain]; !ok {
+			log.Printf("INT: CLEAR %v->%v", domain, routes)
+			i.watchers.emit(Event{Type: "clear", Domain: domain})
+		}
 	}
+	for domain, routes := range next.domains {
+		if !reflect.DeepEqual(i.domains[domain], routes) {
+			log.Printf("INT: STORE %v->%v", domain, routes)
+			i.watchers.emit(Event{Type: "store", Domain: domain, Routes: routes})
+		}
+	}
+	if len(next.conflicts) != len(i.conflicts) {
+		log.Printf("INT: %d conflicts between tables, see /api/conflicts", len(next.conflicts))
+	}
+
+	i.tables = tables
+	i.excludes = ex
+	i.domains = next.domains
+	i.records = next.records
+	i.mappings = next.mappings
+	i.dialers = next.dialers
+	i.conflicts = next.conflicts
+	return nil
+}
 
-	for _, route := range oldRoutes {
-		log.Printf("INT: CLEAR %v->%v", route.Domain(), route)
-		delete(i.domains, route.Domain())
+// sameTable returns true if a and b differ at most in their Version.
+func sameTable(a, b rt.Table) bool {
+	a.Version, b.Version = 0, 0
+	return reflect.DeepEqual(a, b)
+}
 
-		switch route.Proto {
-		case "tcp":
-			i.translator.ClearTCP(p, route.Ip, route.Port)
-		case "udp":
-			i.translator.ClearUDP(p, route.Ip, route.Port)
-		default:
-			log.Printf("INT: unrecognized protocol: %v", route)
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
+	}
+	return true
+}
+
+// expiryInterval is how often we check for tables whose lease has
+// run out.
+const expiryInterval = time.Second
 
+// expired returns the names of the tables whose lease has run out
+// by now. The caller must hold .tablesLock.
+func (i *Interceptor) expired(now time.Time) (names []string) {
+	for name, deadline := range i.expires {
+		if !now.Before(deadline) {
+			names = append(names, name)
+		}
 	}
+	sort.Strings(names)
+	return
+}
 
-	if table.Routes == nil || len(table.Routes) == 0 {
-		delete(i.tables, table.Name)
-	} else {
-		i.tables[table.Name] = table
+// expire removes the tables that haven't been refreshed within their
+// TTL, along with their nat rules. If removing a table fails, it is
+// retried on the next tick.
+func (i *Interceptor) expire(p *supervisor.Process, now time.Time) {
+	i.tablesLock.Lock()
+	defer i.tablesLock.Unlock()
+	i.domainsLock.Lock()
+	defer i.domainsLock.Unlock()
+
+	for _, name := range i.expired(now) {
+		log.Printf("INT: table %s expired", name)
+		_ = i.update(p, rt.Table{Name: name})
 	}
+}
 
-	return nil
+// SetExcludes replaces the exclude list. Each entry is an address or
+// CIDR that is never intercepted, or a domain suffix that is never
+// resolved. The exclude list takes precedence over every table, so
+// any routes it covers are removed from the firewall (and routes it
+// no longer covers are reinstated) in the same batch as the
+// exclusions themselves.
+func (i *Interceptor) SetExcludes(list []string) error {
+	next, err := parseExcludes(list)
+	if err != nil {
+		return err
+	}
+
+	result := make(chan error)
+	i.work <- func(p *supervisor.Process) error {
+		i.tablesLock.Lock()
+		defer i.tablesLock.Unlock()
+		i.domainsLock.Lock()
+		defer i.domainsLock.Unlock()
+
+		err := i.apply(p, i.tables, next)
+		if err != nil {
+			log.Printf("INT: failed to update excludes, keeping previous rules: %v", err)
+		}
+		result <- err
+		return nil
+	}
+	return <-result
+}
+
+// Conflicts returns the names and addresses that more than one table
+// disagrees about, along with which table won.
+func (i *Interceptor) Conflicts() []Conflict {
+	i.domainsLock.RLock()
+	defer i.domainsLock.RUnlock()
+
+	return i.conflicts
+}
+
+// GetExcludes retrieves the current exclude list
+func (i *Interceptor) GetExcludes() []string {
+	i.domainsLock.RLock()
+	defer i.domainsLock.RUnlock()
+
+	return i.excludes.list
 }
 
 // SetSearchPath updates the DNS search path used by the resolver
@@ -257,6 +528,7 @@ func (i *Interceptor) SetSearchPath(paths []string) {
 	defer i.searchLock.Unlock()
 
 	i.search = paths
+	i.watchers.emit(Event{Type: "search", Search: paths})
 }
 
 // GetSearchPath retrieves the current search path
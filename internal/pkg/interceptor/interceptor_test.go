@@ -0,0 +1,183 @@
+package interceptor
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	rt "github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+func TestExpired(t *testing.T) {
+	i := NewInterceptor("test", "")
+	now := time.Now()
+	i.expires["a"] = now.Add(-time.Second)
+	i.expires["b"] = now.Add(time.Second)
+	i.expires["c"] = now
+
+	names := i.expired(now)
+	if len(names) != 2 || names[0] != "a" || names[1] != "c" {
+		t.Errorf("got %v, expected [a c]", names)
+	}
+	if names := i.expired(now.Add(2 * time.Second)); len(names) != 3 {
+		t.Errorf("got %v, expected all tables", names)
+	}
+}
+
+func TestServiceName(t *testing.T) {
+	i := NewInterceptor("test", "")
+	i.records = merge(map[string]rt.Table{
+		"kubernetes": {Name: "kubernetes", Routes: []rt.Route{
+			{Name: "db.ns.svc.cluster.local", Ip: "10.1.0.1", Proto: "tcp", Target: "1234"},
+		}},
+	}, excludes{}).records
+
+	if name := i.ServiceName("10.1.0.1"); name != "db.ns.svc.cluster.local" {
+		t.Errorf("got %q", name)
+	}
+	if name := i.ServiceName("10.1.0.2"); name != "" {
+		t.Errorf("got %q for an unknown address", name)
+	}
+}
+
+// serve does the interceptor's work without a translator, which is
+// fine for as long as none of the routes need firewall rules.
+func serve(i *Interceptor) (stop func()) {
+	i.tablesLock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case f := <-i.work:
+				f(nil)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func TestVersions(t *testing.T) {
+	i := NewInterceptor("test", "")
+	defer serve(i)()
+
+	foo := rt.Route{Name: "foo", Ip: "192.0.2.1", Proto: "tcp"}
+	bar := rt.Route{Name: "bar", Ip: "192.0.2.2", Proto: "tcp"}
+	version := func() uint64 {
+		i.tablesLock.RLock()
+		defer i.tablesLock.RUnlock()
+		return i.tables["t"].Version
+	}
+
+	if err := i.Update(rt.Table{Name: "t", Routes: []rt.Route{foo}}); err != nil || version() != 1 {
+		t.Fatalf("got version %d, %v", version(), err)
+	}
+	// posting the same thing again isn't a change
+	if err := i.Update(rt.Table{Name: "t", Routes: []rt.Route{foo}}); err != nil || version() != 1 {
+		t.Errorf("got version %d, %v", version(), err)
+	}
+
+	table, err := i.Patch("t", rt.Patch{Version: 1, Add: []rt.Route{bar}})
+	if err != nil || table.Version != 2 || len(table.Routes) != 2 || version() != 2 {
+		t.Errorf("got %+v, %v", table, err)
+	}
+
+	// somebody who hasn't seen version 2 can't change it
+	if _, err := i.Patch("t", rt.Patch{Version: 1, Remove: []string{"foo"}}); err == nil {
+		t.Error("expected a conflict")
+	} else if v, ok := err.(*VersionConflict); !ok || v.Expected != 1 || v.Actual != 2 {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := i.Update(rt.Table{Name: "t", Version: 1}); err == nil {
+		t.Error("expected a conflict")
+	}
+
+	// but without a version anything goes
+	table, err = i.Patch("t", rt.Patch{Remove: []string{"foo", "bar"}})
+	if err != nil || len(table.Routes) != 0 || table.Version != 3 {
+		t.Errorf("got %+v, %v", table, err)
+	}
+	if i.Render("t") != "" {
+		t.Error("expected the empty table to be deleted")
+	}
+
+	// a table that comes back doesn't start over
+	table, err = i.Patch("t", rt.Patch{Version: 3, Add: []rt.Route{foo}})
+	if err != nil || table.Version != 4 {
+		t.Errorf("got %+v, %v", table, err)
+	}
+
+	// if any of the tables is out of date, none of them change
+	err = i.Update(rt.Table{Name: "u", Routes: []rt.Route{bar}}, rt.Table{Name: "t", Version: 3})
+	if _, ok := err.(*VersionConflict); !ok {
+		t.Errorf("expected a conflict, got %v", err)
+	}
+	if i.Render("u") != "" || version() != 4 {
+		t.Errorf("expected nothing to change, got version %d and table u %s", version(), i.Render("u"))
+	}
+	if err := i.Update(rt.Table{Name: "u", Routes: []rt.Route{bar}}, rt.Table{Name: "t", Version: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if i.Render("u") == "" || i.Render("t") != "" || version() != 0 {
+		t.Errorf("expected u to replace t, got %q and %q", i.Render("u"), i.Render("t"))
+	}
+}
+
+func TestWatch(t *testing.T) {
+	i := NewInterceptor("test", "")
+	defer serve(i)()
+
+	foo := rt.Route{Name: "foo", Ip: "192.0.2.1", Proto: "tcp"}
+	bar := rt.Route{Name: "bar", Ip: "192.0.2.2", Proto: "tcp"}
+	if err := i.Update(rt.Table{Name: "t", Routes: []rt.Route{foo}}); err != nil {
+		t.Fatal(err)
+	}
+
+	events, done := i.Watch()
+	defer done()
+	next := func() Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+			return Event{}
+		}
+	}
+
+	// the current state comes first
+	e := next()
+	if e.Type != "state" || !reflect.DeepEqual(e.Domains, map[string][]rt.Route{"foo.": {foo}}) ||
+		!reflect.DeepEqual(e.Search, []string{""}) {
+		t.Errorf("unexpected state: %+v", e)
+	}
+
+	// and then the changes
+	if err := i.Update(rt.Table{Name: "t", Routes: []rt.Route{bar}}); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]Event{}
+	for n := 0; n < 2; n++ {
+		e := next()
+		got[e.Type] = e
+	}
+	if e := got["clear"]; e.Domain != "foo." {
+		t.Errorf("unexpected clear: %+v", e)
+	}
+	if e := got["store"]; e.Domain != "bar." || !reflect.DeepEqual(e.Routes, []rt.Route{bar}) {
+		t.Errorf("unexpected store: %+v", e)
+	}
+
+	i.SetSearchPath([]string{"default.svc.cluster.local.", ""})
+	if e := next(); e.Type != "search" || len(e.Search) != 2 {
+		t.Errorf("unexpected search: %+v", e)
+	}
+
+	// a watcher that doesn't keep up is dropped
+	for n := 0; n <= watchBuffer; n++ {
+		i.SetSearchPath([]string{""})
+	}
+	for range events {
+	}
+}
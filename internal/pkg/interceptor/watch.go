@@ -0,0 +1,87 @@
+package interceptor
+
+import (
+	"sync"
+
+	rt "github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+// watchBuffer is how many events a watcher may fall behind by before
+// it is dropped.
+const watchBuffer = 100
+
+// An Event describes a change to what the Interceptor resolves. A
+// watcher first gets a "state" event with every domain that has
+// routes and the search path, and then a "store" or "clear" event
+// whenever a domain gets new routes or loses all of them, and a
+// "search" event whenever the search path changes.
+type Event struct {
+	Type    string                `json:"type"`
+	Domain  string                `json:"domain,omitempty"`
+	Routes  []rt.Route            `json:"routes,omitempty"`
+	Domains map[string][]rt.Route `json:"domains,omitempty"`
+	Search  []string              `json:"search,omitempty"`
+}
+
+// watchers are the channels of everybody watching an Interceptor.
+type watchers struct {
+	mu    sync.Mutex
+	chans map[chan Event]struct{}
+}
+
+func (w *watchers) add(ch chan Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.chans == nil {
+		w.chans = make(map[chan Event]struct{})
+	}
+	w.chans[ch] = struct{}{}
+}
+
+func (w *watchers) remove(ch chan Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.chans[ch]; ok {
+		delete(w.chans, ch)
+		close(ch)
+	}
+}
+
+// emit sends e to every watcher. Since a watcher that misses an event
+// would have the wrong idea of the state, one that can't keep up is
+// dropped instead, and can start over by watching again.
+func (w *watchers) emit(e Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.chans {
+		select {
+		case ch <- e:
+		default:
+			delete(w.chans, ch)
+			close(ch)
+		}
+	}
+}
+
+// Watch returns a channel that receives the current state and then
+// every change to it, and a function to call to stop watching. The
+// channel is closed if the watcher falls too far behind.
+func (i *Interceptor) Watch() (<-chan Event, func()) {
+	ch := make(chan Event, watchBuffer)
+
+	// holding the locks (in the same order as Resolve) keeps
+	// changes from slipping in between the state and the first
+	// change
+	i.searchLock.RLock()
+	defer i.searchLock.RUnlock()
+	i.domainsLock.RLock()
+	defer i.domainsLock.RUnlock()
+
+	domains := make(map[string][]rt.Route, len(i.domains))
+	for domain, routes := range i.domains {
+		domains[domain] = routes
+	}
+	ch <- Event{Type: "state", Domains: domains, Search: i.search}
+	i.watchers.add(ch)
+	return ch, func() { i.watchers.remove(ch) }
+}
@@ -0,0 +1,179 @@
+// +build linux
+
+package nat
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ctnetlink message and attribute types, see
+// linux/netfilter/nfnetlink_conntrack.h
+const (
+	ipctnlMsgCtGet = 1
+
+	ctaTupleOrig  = 1
+	ctaTupleReply = 2
+
+	ctaTupleIP    = 1
+	ctaTupleProto = 2
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	ctaProtoNum     = 1
+	ctaProtoSrcPort = 2
+	ctaProtoDstPort = 3
+
+	nlmsgHeaderLen = 16
+	nfgenHeaderLen = 4
+)
+
+// GetOriginalDstUDP returns where a datagram from src, that was
+// redirected to local, was originally headed. SO_ORIGINAL_DST only
+// works for tcp, so this asks conntrack directly for the flow whose
+// reply goes from local back to src.
+func (t *Translator) GetOriginalDstUDP(src, local *net.UDPAddr) (host string, err error) {
+	sock, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return "", os.NewSyscallError("socket", err)
+	}
+	defer unix.Close(sock)
+	if err := unix.Bind(sock, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return "", os.NewSyscallError("bind", err)
+	}
+
+	request, err := conntrackRequest(unix.IPPROTO_UDP, local, src)
+	if err != nil {
+		return "", err
+	}
+	if err := unix.Sendto(sock, request, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return "", os.NewSyscallError("sendto", err)
+	}
+
+	buf := make([]byte, unix.Getpagesize())
+	n, _, err := unix.Recvfrom(sock, buf, 0)
+	if err != nil {
+		return "", os.NewSyscallError("recvfrom", err)
+	}
+	ip, port, err := parseConntrackReply(buf[:n])
+	if err != nil {
+		return "", errors.Wrapf(err, "looking up original destination of %v", src)
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
+
+// conntrackRequest builds a ctnetlink get request for the flow whose
+// reply tuple goes from src to dst.
+func conntrackRequest(proto byte, src, dst *net.UDPAddr) ([]byte, error) {
+	family := byte(unix.AF_INET)
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	srcType, dstType := uint16(ctaIPv4Src), uint16(ctaIPv4Dst)
+	if srcIP == nil || dstIP == nil {
+		family = unix.AF_INET6
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		srcType, dstType = ctaIPv6Src, ctaIPv6Dst
+		if srcIP == nil || dstIP == nil {
+			return nil, errors.Errorf("bad addresses: %v, %v", src, dst)
+		}
+	}
+
+	port := func(p int) []byte {
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(p))
+		return b
+	}
+	tuple := attr(ctaTupleReply|unix.NLA_F_NESTED,
+		attr(ctaTupleIP|unix.NLA_F_NESTED, attr(srcType, srcIP), attr(dstType, dstIP)),
+		attr(ctaTupleProto|unix.NLA_F_NESTED,
+			attr(ctaProtoNum, []byte{proto}),
+			attr(ctaProtoSrcPort, port(src.Port)),
+			attr(ctaProtoDstPort, port(dst.Port))))
+
+	msg := make([]byte, nlmsgHeaderLen+nfgenHeaderLen, nlmsgHeaderLen+nfgenHeaderLen+len(tuple))
+	msg = append(msg, tuple...)
+	binary.LittleEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.LittleEndian.PutUint16(msg[4:], unix.NFNL_SUBSYS_CTNETLINK<<8|ipctnlMsgCtGet)
+	binary.LittleEndian.PutUint16(msg[6:], unix.NLM_F_REQUEST)
+	// nfgenmsg: family, version, and a zero resource id
+	msg[nlmsgHeaderLen] = family
+	msg[nlmsgHeaderLen+1] = unix.NFNETLINK_V0
+	return msg, nil
+}
+
+// attr encodes a netlink attribute whose value is the concatenation
+// of values.
+func attr(kind uint16, values ...[]byte) []byte {
+	length := 4
+	for _, v := range values {
+		length += len(v)
+	}
+	result := make([]byte, 4, align(length))
+	binary.LittleEndian.PutUint16(result[0:], uint16(length))
+	binary.LittleEndian.PutUint16(result[2:], kind)
+	for _, v := range values {
+		result = append(result, v...)
+	}
+	return result[:cap(result)]
+}
+
+func align(n int) int {
+	return (n + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+}
+
+// attrs splits b into netlink attributes, keyed by type with the
+// nested flag masked off.
+func attrs(b []byte) map[uint16][]byte {
+	result := make(map[uint16][]byte)
+	for len(b) >= 4 {
+		length := int(binary.LittleEndian.Uint16(b[0:]))
+		kind := binary.LittleEndian.Uint16(b[2:]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+		if length < 4 || length > len(b) {
+			break
+		}
+		result[kind] = b[4:length]
+		if align(length) >= len(b) {
+			break
+		}
+		b = b[align(length):]
+	}
+	return result
+}
+
+// parseConntrackReply returns the original destination from the
+// answer to a conntrack request.
+func parseConntrackReply(msg []byte) (net.IP, int, error) {
+	if len(msg) < nlmsgHeaderLen {
+		return nil, 0, errors.New("short netlink message")
+	}
+	if binary.LittleEndian.Uint16(msg[4:]) == unix.NLMSG_ERROR {
+		if len(msg) < nlmsgHeaderLen+4 {
+			return nil, 0, errors.New("short netlink error")
+		}
+		errno := -int32(binary.LittleEndian.Uint32(msg[nlmsgHeaderLen:]))
+		return nil, 0, os.NewSyscallError("conntrack", unix.Errno(errno))
+	}
+	if len(msg) < nlmsgHeaderLen+nfgenHeaderLen {
+		return nil, 0, errors.New("short conntrack message")
+	}
+
+	orig := attrs(attrs(msg[nlmsgHeaderLen+nfgenHeaderLen:])[ctaTupleOrig])
+	ips := attrs(orig[ctaTupleIP])
+	ports := attrs(orig[ctaTupleProto])
+	ip := net.IP(ips[ctaIPv4Dst])
+	if ip == nil {
+		ip = net.IP(ips[ctaIPv6Dst])
+	}
+	port := ports[ctaProtoDstPort]
+	if (len(ip) != net.IPv4len && len(ip) != net.IPv6len) || len(port) != 2 {
+		return nil, 0, errors.New("conntrack answer has no original destination")
+	}
+	return ip, int(binary.BigEndian.Uint16(port)), nil
+}
@@ -0,0 +1,128 @@
+// +build linux
+
+package nat
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/datawire/teleproxy/pkg/supervisor"
+)
+
+func TestConntrackMessages(t *testing.T) {
+	src := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+	dst := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	request, err := conntrackRequest(unix.IPPROTO_UDP, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(binary.LittleEndian.Uint32(request)) != len(request) {
+		t.Errorf("bad length: %d", len(request))
+	}
+	tuple := attrs(attrs(request[nlmsgHeaderLen+nfgenHeaderLen:])[ctaTupleReply])
+	if ip := net.IP(attrs(tuple[ctaTupleIP])[ctaIPv4Src]); !ip.Equal(src.IP) {
+		t.Errorf("bad source: %v", ip)
+	}
+	if port := attrs(tuple[ctaTupleProto])[ctaProtoDstPort]; binary.BigEndian.Uint16(port) != 40000 {
+		t.Errorf("bad port: %v", port)
+	}
+
+	// an answer looks just like the request, with the original
+	// tuple filled in
+	orig := attr(ctaTupleOrig|unix.NLA_F_NESTED,
+		attr(ctaTupleIP|unix.NLA_F_NESTED,
+			attr(ctaIPv6Src, net.ParseIP("fd00::2")), attr(ctaIPv6Dst, net.ParseIP("fd00::1"))),
+		attr(ctaTupleProto|unix.NLA_F_NESTED,
+			attr(ctaProtoNum, []byte{unix.IPPROTO_UDP}),
+			attr(ctaProtoSrcPort, []byte{0x9c, 0x40}),
+			attr(ctaProtoDstPort, []byte{0, 53})))
+	answer := append(request[:nlmsgHeaderLen+nfgenHeaderLen:nlmsgHeaderLen+nfgenHeaderLen], orig...)
+	ip, port, err := parseConntrackReply(answer)
+	if err != nil || !ip.Equal(net.ParseIP("fd00::1")) || port != 53 {
+		t.Errorf("got %v, %v, %v", ip, port, err)
+	}
+
+	failure := make([]byte, nlmsgHeaderLen+4)
+	binary.LittleEndian.PutUint16(failure[4:], unix.NLMSG_ERROR)
+	errno := -int32(unix.ENOENT)
+	binary.LittleEndian.PutUint32(failure[nlmsgHeaderLen:], uint32(errno))
+	if _, _, err := parseConntrackReply(failure); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestOriginalDstUDP(t *testing.T) {
+	for _, env := range environments {
+		env := env
+		t.Run(env.backend, func(t *testing.T) {
+			if env.backend == "iptables" {
+				if _, err := exec.LookPath("iptables"); err != nil {
+					t.Skip(err)
+				}
+			}
+			sup := supervisor.WithContext(context.Background())
+			sup.Supervise(&supervisor.Worker{
+				Name: "nat",
+				Work: func(p *supervisor.Process) error {
+					defer sup.Shutdown()
+					env.setup()
+					defer env.teardown()
+					tr := NewTranslator("test-table")
+					env.configure(tr)
+					tr.Enable(p)
+					defer tr.Disable(p)
+					checkOriginalDstUDP(t, p, tr)
+					return nil
+				},
+			})
+			if errs := sup.Run(); len(errs) > 0 {
+				t.Errorf("unexpected errors: %v", errs)
+			}
+		})
+	}
+}
+
+func checkOriginalDstUDP(t *testing.T, p *supervisor.Process, tr *Translator) {
+	srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+	local := srv.LocalAddr().(*net.UDPAddr)
+
+	err = tr.Apply(p, []Change{ForwardChange("udp", "10.123.0.1", "9999", strconv.Itoa(local.Port))})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cli, err := net.Dial("udp", "10.123.0.1:9999")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cli.Close()
+	if _, err := cli.Write([]byte("hello")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var buf [16]byte
+	srv.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, from, err := srv.ReadFromUDP(buf[:])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	host, err := tr.GetOriginalDstUDP(from, local)
+	if err != nil || host != "10.123.0.1:9999" {
+		t.Errorf("got %q, %v", host, err)
+	}
+}
@@ -2,13 +2,27 @@ package nat
 
 import (
 	"fmt"
+	"net"
 	"sort"
 	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/pkg/supervisor"
 )
 
 type commonTranslator struct {
 	Name     string
 	Mappings map[Address]string
+	// Backend selects the firewall implementation on platforms
+	// that have more than one. On linux this is "iptables" or
+	// "nftables", and the empty string picks whichever is
+	// available. It is ignored elsewhere.
+	Backend string
+	// Excludes lists the networks that are never redirected, even
+	// if one of the Mappings covers them. They are kept in CIDR
+	// notation and sorted.
+	Excludes []string
 }
 
 type Address struct {
@@ -26,11 +40,124 @@ func (e *Entry) String() string {
 	return fmt.Sprintf("%s:%s->%s", e.Destination.Proto, e.Destination.Ip, e.Port)
 }
 
+// destNet parses a destination, which is either a single address or
+// a CIDR, into a network. A single address becomes a /32 for IPv4 or
+// a /128 for IPv6.
+func destNet(dest string) (*net.IPNet, error) {
+	if strings.Contains(dest, "/") {
+		_, network, err := net.ParseCIDR(dest)
+		return network, err
+	}
+	ip := net.ParseIP(dest)
+	if ip == nil {
+		return nil, errors.Errorf("bad ip: %q", dest)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// isIPv6 reports whether dest is an IPv6 address or network.
+// IPv4-mapped IPv6 addresses count as IPv4.
+func isIPv6(dest string) bool {
+	network, err := destNet(dest)
+	return err == nil && network.IP.To4() == nil
+}
+
+// destCIDR returns dest in CIDR notation.
+func destCIDR(dest string) string {
+	network, err := destNet(dest)
+	if err != nil {
+		return dest
+	}
+	return network.String()
+}
+
+// colonRanges rewrites port ranges from our "8000-9000" notation to
+// the "8000:9000" notation that both iptables and pf use.
+func colonRanges(portspec string) string {
+	return strings.Replace(portspec, "-", ":", -1)
+}
+
+func splitPorts(portspec string) (result []string) {
+	for _, part := range strings.Split(portspec, ",") {
+		result = append(result, strings.TrimSpace(part))
+	}
+	return
+}
+
+// A Change is one element of a batch handed to Translator.Apply. It
+// forwards Destination to Port, or removes any existing mapping for
+// Destination if Port is empty.
+type Change Entry
+
+// ForwardChange returns a Change that forwards proto traffic for
+// ip/port to toPort.
+func ForwardChange(proto, ip, port, toPort string) Change {
+	return Change{Address{proto, ip, port}, toPort}
+}
+
+// ClearChange returns a Change that removes the mapping for proto
+// traffic to ip/port.
+func ClearChange(proto, ip, port string) Change {
+	return Change{Destination: Address{proto, ip, port}}
+}
+
+// next returns the mappings that result from applying changes to the
+// current mappings. The current mappings are left untouched so that
+// a failed batch can simply be discarded.
+func (t *commonTranslator) next(changes []Change) map[Address]string {
+	result := make(map[Address]string, len(t.Mappings))
+	for k, v := range t.Mappings {
+		result[k] = v
+	}
+	for _, c := range changes {
+		if c.Port == "" {
+			delete(result, c.Destination)
+		} else {
+			result[c.Destination] = c.Port
+		}
+	}
+	return result
+}
+
+// Apply installs a whole batch of changes in a single firewall
+// transaction. If the batch fails, none of it takes effect and the
+// previously installed mappings stay in place.
+func (t *Translator) Apply(p *supervisor.Process, changes []Change) error {
+	return t.ApplyExcludes(p, t.Excludes, changes)
+}
+
+// normalizeExcludes validates a list of addresses and CIDRs and
+// returns them as sorted CIDRs without duplicates.
+func normalizeExcludes(excludes []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var result []string
+	for _, x := range excludes {
+		network, err := destNet(x)
+		if err != nil {
+			return nil, errors.Wrap(err, "exclude")
+		}
+		cidr := network.String()
+		if !seen[cidr] {
+			seen[cidr] = true
+			result = append(result, cidr)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
 func (t *Translator) sorted() []Entry {
-	entries := make([]Entry, len(t.Mappings))
+	return sortedEntries(t.Mappings)
+}
+
+func sortedEntries(mappings map[Address]string) []Entry {
+	entries := make([]Entry, len(mappings))
 
 	index := 0
-	for k, v := range t.Mappings {
+	for k, v := range mappings {
 		entries[index] = Entry{k, v}
 		index += 1
 	}
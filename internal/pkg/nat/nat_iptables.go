@@ -3,144 +3,218 @@
 package nat
 
 import (
-	"fmt"
-	"net"
+	"os/exec"
 	"strings"
-	"syscall"
+
+	"github.com/pkg/errors"
 
 	"github.com/datawire/teleproxy/pkg/supervisor"
 )
 
-type Translator struct {
-	commonTranslator
+// iptables is the backend that programs the nat table by forking the
+// iptables binary, and ip6tables for IPv6 destinations.
+type iptables struct{}
+
+// A family bundles together the binaries and loopback address used
+// for one IP version.
+type family struct {
+	ipt      string
+	restore  string
+	loopback string
+}
+
+var (
+	ipv4 = family{"iptables", "iptables-restore", "127.0.0.1/32"}
+	ipv6 = family{"ip6tables", "ip6tables-restore", "::1/128"}
+)
+
+func familyOf(a Address) family {
+	if isIPv6(a.Ip) {
+		return ipv6
+	}
+	return ipv4
+}
+
+// families returns the families we should set up. IPv6 is optional
+// since not every host has ip6tables (or an IPv6 nat table).
+func (i *iptables) families() []family {
+	result := []family{ipv4}
+	if i.hasIPv6() {
+		result = append(result, ipv6)
+	}
+	return result
+}
+
+func (i *iptables) hasIPv6() bool {
+	_, err := exec.LookPath(ipv6.ipt)
+	return err == nil
 }
 
-func (t *Translator) ipt(p *supervisor.Process, args ...string) {
-	cmd := p.Command("iptables", append([]string{"-t", "nat"}, args...)...)
+func (i *iptables) ipt(p *supervisor.Process, f family, args ...string) error {
+	cmd := p.Command(f.ipt, append([]string{"-t", "nat"}, args...)...)
 	err := cmd.Start()
 	if err != nil {
 		panic(err)
 	}
-	cmd.Wait()
+	return cmd.Wait()
 }
 
-func (t *Translator) Enable(p *supervisor.Process) {
-	// XXX: -D only removes one copy of the rule, need to figure out how to remove all copies just in case
-	t.ipt(p, "-D", "OUTPUT", "-j", t.Name)
-	// we need to be in the PREROUTING chain in order to get traffic
-	// from docker containers, not sure you would *always* want this,
-	// but probably makes sense as a default
-	t.ipt(p, "-D", "PREROUTING", "-j", t.Name)
-	t.ipt(p, "-N", t.Name)
-	t.ipt(p, "-F", t.Name)
-	t.ipt(p, "-I", "OUTPUT", "1", "-j", t.Name)
-	t.ipt(p, "-I", "PREROUTING", "1", "-j", t.Name)
-	t.ipt(p, "-A", t.Name, "-j", "RETURN", "--dest", "127.0.0.1/32", "-p", "tcp")
+// maxJumps bounds how many copies of our jump rule we will try to
+// delete from a single builtin chain.
+const maxJumps = 100
+
+// removeJumps removes every jump to our chain from OUTPUT and
+// PREROUTING. A crashed or killed teleproxy may have left any number
+// of them behind, and -D only removes one copy at a time, so keep
+// going until it fails.
+func (i *iptables) removeJumps(p *supervisor.Process, f family, chain string) {
+	for _, builtin := range []string{"OUTPUT", "PREROUTING"} {
+		for n := 0; n < maxJumps; n++ {
+			if i.ipt(p, f, "-D", builtin, "-j", chain) != nil {
+				break
+			}
+		}
+	}
 }
 
-func (t *Translator) Disable(p *supervisor.Process) {
-	// XXX: -D only removes one copy of the rule, need to figure out how to remove all copies just in case
-	t.ipt(p, "-D", "OUTPUT", "-j", t.Name)
-	t.ipt(p, "-D", "PREROUTING", "-j", t.Name)
-	t.ipt(p, "-F", t.Name)
-	t.ipt(p, "-X", t.Name)
-}
+func (i *iptables) enable(p *supervisor.Process, t *Translator) error {
+	for _, f := range i.families() {
+		i.removeJumps(p, f, t.Name)
+		i.ipt(p, f, "-N", t.Name)
+		i.ipt(p, f, "-F", t.Name)
+		// we need to be in the PREROUTING chain in order to get traffic
+		// from docker containers, not sure you would *always* want this,
+		// but probably makes sense as a default
+		i.ipt(p, f, "-I", "OUTPUT", "1", "-j", t.Name)
+		i.ipt(p, f, "-I", "PREROUTING", "1", "-j", t.Name)
+		i.ipt(p, f, "-A", t.Name, "-j", "RETURN", "--dest", f.loopback, "-p", "tcp")
+	}
 
-func (t *Translator) ForwardTCP(p *supervisor.Process, ip, port, toPort string) {
-	t.forward(p, "tcp", ip, port, toPort)
+	// flushing the chain took out whatever we had installed, so
+	// forget it, or the next apply would skip rules that are no
+	// longer there, and put it back
+	mappings, excludes := t.Mappings, t.Excludes
+	t.Mappings = make(map[Address]string)
+	t.Excludes = nil
+	if err := i.apply(p, t, mappings, excludes); err != nil {
+		p.Logf("unable to reinstall rules: %v", err)
+		return nil
+	}
+	t.Mappings = mappings
+	t.Excludes = excludes
+	return nil
 }
 
-func (t *Translator) ForwardUDP(p *supervisor.Process, ip, port, toPort string) {
-	t.forward(p, "udp", ip, port, toPort)
+func (i *iptables) disable(p *supervisor.Process, t *Translator) {
+	for _, f := range i.families() {
+		i.removeJumps(p, f, t.Name)
+		i.ipt(p, f, "-F", t.Name)
+		i.ipt(p, f, "-X", t.Name)
+	}
 }
 
-func (t *Translator) forward(p *supervisor.Process, protocol, ip, port, toPort string) {
-	t.clear(p, protocol, ip, port)
-	args := []string{"-A", t.Name, "-j", "REDIRECT", "-p", protocol, "--dest", ip + "/32"}
-	if port != "" {
-		if strings.Contains(port, ",") {
-			args = append(args, "-m", "multiport", "--dports", port)
-		} else {
-			args = append(args, "--dport", port)
+// apply turns the difference between the current and next mappings
+// into an iptables-restore transaction per address family. With
+// --noflush the rest of the nat table is left alone, and if any line
+// fails the whole transaction is discarded. If the IPv6 transaction
+// fails after the IPv4 one went through, the IPv4 one is undone.
+func (i *iptables) apply(p *supervisor.Process, t *Translator, next map[Address]string, excludes []string) error {
+	lines := map[family][]string{}
+	undo := map[family][]string{}
+	// exclusions are inserted at the top of the chain so that they
+	// win over any redirect
+	for _, x := range missing(t.Excludes, excludes) {
+		f := familyOf(Address{Ip: x})
+		lines[f] = append(lines[f], i.exclude("-D", t.Name, x))
+		undo[f] = append(undo[f], i.exclude("-I", t.Name, x))
+	}
+	for _, x := range missing(excludes, t.Excludes) {
+		f := familyOf(Address{Ip: x})
+		lines[f] = append(lines[f], i.exclude("-I", t.Name, x))
+		undo[f] = append([]string{i.exclude("-D", t.Name, x)}, undo[f]...)
+	}
+	for _, entry := range sortedEntries(t.Mappings) {
+		if next[entry.Destination] != entry.Port {
+			f := familyOf(entry.Destination)
+			lines[f] = append(lines[f], i.rule("-D", t.Name, entry.Destination, entry.Port))
+			undo[f] = append(undo[f], i.rule("-A", t.Name, entry.Destination, entry.Port))
 		}
 	}
-	args = append(args, "--to-ports", toPort)
-	t.ipt(p, args...)
-	t.Mappings[Address{protocol, ip, port}] = toPort
-}
+	for _, entry := range sortedEntries(next) {
+		if t.Mappings[entry.Destination] != entry.Port {
+			f := familyOf(entry.Destination)
+			lines[f] = append(lines[f], i.rule("-A", t.Name, entry.Destination, entry.Port))
+			undo[f] = append([]string{i.rule("-D", t.Name, entry.Destination, entry.Port)}, undo[f]...)
+		}
+	}
+
+	if len(lines[ipv6]) > 0 && !i.hasIPv6() {
+		// don't let IPv6 routes take the IPv4 ones down with
+		// them on hosts without ip6tables
+		p.Logf("WARNING: %s not found, skipping %d IPv6 rules", ipv6.ipt, len(lines[ipv6]))
+		delete(lines, ipv6)
+	}
 
-func (t *Translator) ClearTCP(p *supervisor.Process, ip, port string) {
-	t.clear(p, "tcp", ip, port)
+	err := i.restore(p, ipv4, lines[ipv4])
+	if err != nil {
+		return err
+	}
+	err = i.restore(p, ipv6, lines[ipv6])
+	if err != nil {
+		if uerr := i.restore(p, ipv4, undo[ipv4]); uerr != nil {
+			p.Logf("unable to roll back IPv4 rules: %v", uerr)
+		}
+		return err
+	}
+	return nil
 }
 
-func (t *Translator) ClearUDP(p *supervisor.Process, ip, port string) {
-	t.clear(p, "udp", ip, port)
+func (i *iptables) restore(p *supervisor.Process, f family, lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	input := "*nat\n" + strings.Join(lines, "\n") + "\nCOMMIT\n"
+	cmd := p.Command(f.restore, "--noflush")
+	cmd.Stdin = strings.NewReader(input)
+	err := cmd.Run()
+	if err != nil {
+		return errors.Wrapf(err, "%s (%d rules)", f.restore, len(lines))
+	}
+	return nil
 }
 
-func (t *Translator) clear(p *supervisor.Process, protocol, ip, port string) {
-	if previous, exists := t.Mappings[Address{protocol, ip, port}]; exists {
-		args := []string{"-D", t.Name, "-j", "REDIRECT", "-p", protocol, "--dest", ip + "/32"}
-		if port != "" {
-			if strings.Contains(port, ",") {
-				args = append(args, "-m", "multiport", "--dports", port)
-			} else {
-				args = append(args, "--dport", port)
-			}
+func (i *iptables) rule(op, chain string, a Address, toPort string) string {
+	args := []string{op, chain, "-j", "REDIRECT", "-p", a.Proto, "--dest", destCIDR(a.Ip)}
+	if a.Port != "" {
+		ports := colonRanges(a.Port)
+		if strings.Contains(ports, ",") {
+			args = append(args, "-m", "multiport", "--dports", ports)
+		} else {
+			args = append(args, "--dport", ports)
 		}
-		args = append(args, "--to-ports", previous)
-		t.ipt(p, args...)
-		delete(t.Mappings, Address{protocol, ip, port})
 	}
+	return strings.Join(append(args, "--to-ports", toPort), " ")
 }
 
-const (
-	SO_ORIGINAL_DST      = 80
-	IP6T_SO_ORIGINAL_DST = 80
-)
-
-// get the original destination for the socket when redirect by linux iptables
-// refer to https://raw.githubusercontent.com/missdeer/avege/master/src/inbound/redir/redir_iptables.go
-//
-func (t *Translator) GetOriginalDst(conn *net.TCPConn) (rawaddr []byte, host string, err error) {
-	var addr *syscall.IPv6Mreq
-
-	// Get original destination
-	// this is the only syscall in the Golang libs that I can find that returns 16 bytes
-	// Example result: &{Multiaddr:[2 0 31 144 206 190 36 45 0 0 0 0 0 0 0 0] Interface:0}
-	// port starts at the 3rd byte and is 2 bytes long (31 144 = port 8080)
-	// IPv6 version, didn't find a way to detect network family
-	//addr, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IPV6, IP6T_SO_ORIGINAL_DST)
-	// IPv4 address starts at the 5th byte, 4 bytes long (206 190 36 45)
-	rawConn, err := conn.SyscallConn()
-	if err != nil {
-		return nil, "", err
+func (i *iptables) exclude(op, chain, dest string) string {
+	args := []string{op, chain}
+	if op == "-I" {
+		args = append(args, "1")
 	}
+	return strings.Join(append(args, "-j", "RETURN", "--dest", dest), " ")
+}
 
-	err = rawConn.Control(func(fd uintptr) {
-		addr, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, SO_ORIGINAL_DST)
-	})
-	if err != nil {
-		return nil, "", err
-	}
-
-	// \attention: IPv4 only!!!
-	// address type, 1 - IPv4, 4 - IPv6, 3 - hostname, only IPv4 is supported now
-	rawaddr = append(rawaddr, byte(1))
-	// raw IP address, 4 bytes for IPv4 or 16 bytes for IPv6, only IPv4 is supported now
-	rawaddr = append(rawaddr, addr.Multiaddr[4])
-	rawaddr = append(rawaddr, addr.Multiaddr[5])
-	rawaddr = append(rawaddr, addr.Multiaddr[6])
-	rawaddr = append(rawaddr, addr.Multiaddr[7])
-	// port
-	rawaddr = append(rawaddr, addr.Multiaddr[2])
-	rawaddr = append(rawaddr, addr.Multiaddr[3])
-
-	host = fmt.Sprintf("%d.%d.%d.%d:%d",
-		addr.Multiaddr[4],
-		addr.Multiaddr[5],
-		addr.Multiaddr[6],
-		addr.Multiaddr[7],
-		uint16(addr.Multiaddr[2])<<8+uint16(addr.Multiaddr[3]))
-
-	return rawaddr, host, nil
+// missing returns the elements of a that are not in b.
+func missing(a, b []string) (result []string) {
+	in := make(map[string]bool, len(b))
+	for _, s := range b {
+		in[s] = true
+	}
+	for _, s := range a {
+		if !in[s] {
+			result = append(result, s)
+		}
+	}
+	return
 }
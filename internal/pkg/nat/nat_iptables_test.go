@@ -2,14 +2,154 @@
 
 package nat
 
-// we don't yet have any iptables config cases to test against
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
 
-type env struct{}
+	"github.com/datawire/teleproxy/pkg/supervisor"
+)
 
-var environments = []env{
-	{},
+// fakeBinaries puts scripts with the given names first on the PATH,
+// and nothing else, so that we can see what a backend runs without
+// touching the real firewall. Each script records its arguments and
+// input in the returned log, and fails if its name is in fail.
+func fakeBinaries(t *testing.T, names []string, fail ...string) (log func() string, done func()) {
+	dir, err := ioutil.TempDir("", "nat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logPath := filepath.Join(dir, "log")
+	for _, name := range names {
+		status := 0
+		for _, f := range fail {
+			if f == name {
+				status = 1
+			}
+		}
+		script := fmt.Sprintf("#!/bin/sh\necho \"%s $*\" >> %s\n", name, logPath)
+		if strings.HasSuffix(name, "-restore") {
+			script += fmt.Sprintf("while read -r line; do echo \"$line\" >> %s; done\n", logPath)
+		}
+		script += fmt.Sprintf("exit %d\n", status)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir)
+	return func() string {
+			bytes, _ := ioutil.ReadFile(logPath)
+			return string(bytes)
+		}, func() {
+			os.Setenv("PATH", path)
+			os.RemoveAll(dir)
+		}
 }
 
-func (e *env) setup() {}
+// tempStateDir points StateDir at a temporary directory until done
+// is called.
+func tempStateDir(t *testing.T) (done func()) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := StateDir
+	StateDir = dir
+	return func() {
+		StateDir = saved
+		os.RemoveAll(dir)
+	}
+}
+
+// withProcess runs f in a supervisor process.
+func withProcess(t *testing.T, f func(p *supervisor.Process)) {
+	sup := supervisor.WithContext(context.Background())
+	sup.Supervise(&supervisor.Worker{
+		Name: "test",
+		Work: func(p *supervisor.Process) error {
+			f(p)
+			sup.Shutdown()
+			return nil
+		},
+	})
+	if errs := sup.Run(); len(errs) > 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
+
+func TestIptablesEnable(t *testing.T) {
+	log, done := fakeBinaries(t, []string{"iptables", "iptables-restore"})
+	defer done()
+
+	withProcess(t, func(p *supervisor.Process) {
+		tr := NewTranslator("test-table")
+		tr.Mappings[Address{"tcp", "192.0.2.1", ""}] = "1234"
+		tr.Excludes = []string{"192.0.2.0/24"}
+		impl := &iptables{}
+		impl.enable(p, tr)
+
+		// enabling flushes the chain, so what we had has to be
+		// put back
+		out := log()
+		for _, expected := range []string{
+			"iptables -t nat -F test-table",
+			"-I test-table 1 -j RETURN --dest 192.0.2.0/24",
+			"-A test-table -j REDIRECT -p tcp --dest 192.0.2.1/32 --to-ports 1234",
+		} {
+			if !strings.Contains(out, expected) {
+				t.Errorf("expected %q in:\n%s", expected, out)
+			}
+		}
+		if tr.Mappings[Address{"tcp", "192.0.2.1", ""}] != "1234" || len(tr.Excludes) != 1 {
+			t.Errorf("lost state: %v, %v", tr.Mappings, tr.Excludes)
+		}
+	})
+}
 
-func (e *env) teardown() {}
+func TestIptablesEnableFailure(t *testing.T) {
+	_, done := fakeBinaries(t, []string{"iptables", "iptables-restore"}, "iptables-restore")
+	defer done()
+
+	withProcess(t, func(p *supervisor.Process) {
+		tr := NewTranslator("test-table")
+		tr.Mappings[Address{"tcp", "192.0.2.1", ""}] = "1234"
+		impl := &iptables{}
+		impl.enable(p, tr)
+
+		// nothing got put back, so the next apply needs to
+		// know that
+		if len(tr.Mappings) != 0 {
+			t.Errorf("expected no mappings, got %v", tr.Mappings)
+		}
+	})
+}
+
+func TestIptablesWithoutIPv6(t *testing.T) {
+	log, done := fakeBinaries(t, []string{"iptables", "iptables-restore"})
+	defer done()
+	defer tempStateDir(t)()
+
+	withProcess(t, func(p *supervisor.Process) {
+		tr := NewTranslator("test-table")
+		tr.Backend = "iptables"
+		err := tr.Apply(p, []Change{
+			ForwardChange("tcp", "192.0.2.1", "", "1234"),
+			ForwardChange("tcp", "2001:db8::1", "", "1234"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := log()
+		if !strings.Contains(out, "-A test-table -j REDIRECT -p tcp --dest 192.0.2.1/32 --to-ports 1234") {
+			t.Errorf("expected the IPv4 rule in:\n%s", out)
+		}
+		if strings.Contains(out, "2001:db8::1") {
+			t.Errorf("expected no IPv6 rule in:\n%s", out)
+		}
+	})
+}
@@ -0,0 +1,269 @@
+// +build linux
+
+package nat
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/datawire/teleproxy/pkg/supervisor"
+)
+
+type Translator struct {
+	commonTranslator
+	impl backend
+}
+
+// platformState is empty on linux: the state file says everything
+// there is to undo.
+type platformState struct{}
+
+func (t *Translator) platformState() platformState {
+	return platformState{}
+}
+
+// A backend is the part of the Translator that actually programs
+// the kernel. Linux has two ways of doing that: forking the iptables
+// binary, or talking to nftables over netlink.
+type backend interface {
+	enable(p *supervisor.Process, t *Translator) error
+	disable(p *supervisor.Process, t *Translator)
+	// apply atomically replaces t.Mappings and t.Excludes with
+	// next and excludes in the kernel. It must not modify t, and
+	// it must leave the previously installed rules alone if it
+	// fails.
+	apply(p *supervisor.Process, t *Translator, next map[Address]string, excludes []string) error
+}
+
+func (t *Translator) backend(p *supervisor.Process) backend {
+	if t.impl != nil {
+		return t.impl
+	}
+
+	name := t.Backend
+	if name == "" {
+		// prefer iptables when it is around since that is
+		// what we have always done, but fall back to talking
+		// to nftables directly on hosts that no longer ship
+		// the iptables binary
+		if _, err := exec.LookPath("iptables"); err == nil {
+			name = "iptables"
+		} else {
+			name = "nftables"
+		}
+		p.Logf("automatically selected %s backend", name)
+		t.Backend = name
+	}
+
+	switch name {
+	case "iptables":
+		t.impl = &iptables{}
+	case "nftables":
+		t.impl = &nftables{}
+	default:
+		panic(fmt.Sprintf("unrecognized nat backend: %q", name))
+	}
+
+	return t.impl
+}
+
+// Enable sets up the firewall so that Apply can install rules, and
+// returns an error if it can't.
+func (t *Translator) Enable(p *supervisor.Process) error {
+	// if a previous incarnation died without cleaning up, it may
+	// have used a different backend than we are about to, so
+	// clean up based on what it recorded
+	st, err := LoadState(t.Name)
+	if err != nil {
+		p.Log(err)
+	}
+	if st != nil {
+		p.Logf("cleaning up after previous run")
+		if err := NewTranslator(t.Name).cleanup(p, st); err != nil {
+			p.Log(err)
+		}
+	}
+
+	if err := t.backend(p).enable(p, t); err != nil {
+		return err
+	}
+	t.saveState(p)
+	return nil
+}
+
+func (t *Translator) Disable(p *supervisor.Process) {
+	t.backend(p).disable(p, t)
+	t.removeState(p)
+}
+
+// cleanup removes whatever st says was installed. If st doesn't say
+// which backend was in use, it tries all of the ones available.
+func (t *Translator) cleanup(p *supervisor.Process, st *State) error {
+	backends := []string{st.Backend}
+	if st.Backend == "" {
+		backends = []string{"nftables"}
+		if _, err := exec.LookPath("iptables"); err == nil {
+			backends = append(backends, "iptables")
+		}
+	}
+
+	for _, name := range backends {
+		// the binary may have gone away since the state was
+		// recorded, and the backend can't run without it
+		if name == "iptables" {
+			if _, err := exec.LookPath("iptables"); err != nil {
+				return errors.Wrap(err, "cleaning up iptables rules")
+			}
+		}
+		t.Backend = name
+		t.impl = nil
+		t.backend(p).disable(p, t)
+	}
+
+	return nil
+}
+
+func (t *Translator) ForwardTCP(p *supervisor.Process, ip, port, toPort string) {
+	t.forward(p, "tcp", ip, port, toPort)
+}
+
+func (t *Translator) ForwardUDP(p *supervisor.Process, ip, port, toPort string) {
+	t.forward(p, "udp", ip, port, toPort)
+}
+
+func (t *Translator) forward(p *supervisor.Process, protocol, ip, port, toPort string) {
+	err := t.Apply(p, []Change{ForwardChange(protocol, ip, port, toPort)})
+	if err != nil {
+		p.Log(err)
+	}
+}
+
+func (t *Translator) ClearTCP(p *supervisor.Process, ip, port string) {
+	t.clear(p, "tcp", ip, port)
+}
+
+func (t *Translator) ClearUDP(p *supervisor.Process, ip, port string) {
+	t.clear(p, "udp", ip, port)
+}
+
+func (t *Translator) clear(p *supervisor.Process, protocol, ip, port string) {
+	err := t.Apply(p, []Change{ClearChange(protocol, ip, port)})
+	if err != nil {
+		p.Log(err)
+	}
+}
+
+// ApplyExcludes is like Apply, except that it also replaces the
+// list of excluded destinations as part of the same transaction.
+func (t *Translator) ApplyExcludes(p *supervisor.Process, excludes []string, changes []Change) error {
+	excludes, err := normalizeExcludes(excludes)
+	if err != nil {
+		return err
+	}
+	next := t.next(changes)
+	err = t.backend(p).apply(p, t, next, excludes)
+	if err != nil {
+		return err
+	}
+	t.Mappings = next
+	t.Excludes = excludes
+	t.saveState(p)
+	return nil
+}
+
+const (
+	SO_ORIGINAL_DST      = 80
+	IP6T_SO_ORIGINAL_DST = 80
+)
+
+// get the original destination for the socket when redirect by linux iptables
+// refer to https://raw.githubusercontent.com/missdeer/avege/master/src/inbound/redir/redir_iptables.go
+//
+// This works the same for both backends since nftables redirects are
+// tracked by the same conntrack machinery.
+func (t *Translator) GetOriginalDst(conn *net.TCPConn) (rawaddr []byte, host string, err error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// A connection that arrived over IPv4 shows up with an IPv4
+	// local address even on a dual stack listener, and the
+	// kernel keeps its original destination at the IPv4 level.
+	local := conn.LocalAddr().(*net.TCPAddr)
+	if local.IP.To4() == nil {
+		return getOriginalDst6(rawConn)
+	}
+
+	var addr *syscall.IPv6Mreq
+
+	// Get original destination
+	// this is the only syscall in the Golang libs that I can find that returns 16 bytes
+	// Example result: &{Multiaddr:[2 0 31 144 206 190 36 45 0 0 0 0 0 0 0 0] Interface:0}
+	// port starts at the 3rd byte and is 2 bytes long (31 144 = port 8080)
+	// IPv4 address starts at the 5th byte, 4 bytes long (206 190 36 45)
+	cerr := rawConn.Control(func(fd uintptr) {
+		addr, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, SO_ORIGINAL_DST)
+	})
+	if cerr != nil {
+		return nil, "", cerr
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	// address type, 1 - IPv4, 4 - IPv6, 3 - hostname
+	rawaddr = append(rawaddr, byte(1))
+	// raw IP address, 4 bytes for IPv4
+	rawaddr = append(rawaddr, addr.Multiaddr[4])
+	rawaddr = append(rawaddr, addr.Multiaddr[5])
+	rawaddr = append(rawaddr, addr.Multiaddr[6])
+	rawaddr = append(rawaddr, addr.Multiaddr[7])
+	// port
+	rawaddr = append(rawaddr, addr.Multiaddr[2])
+	rawaddr = append(rawaddr, addr.Multiaddr[3])
+
+	host = fmt.Sprintf("%d.%d.%d.%d:%d",
+		addr.Multiaddr[4],
+		addr.Multiaddr[5],
+		addr.Multiaddr[6],
+		addr.Multiaddr[7],
+		uint16(addr.Multiaddr[2])<<8+uint16(addr.Multiaddr[3]))
+
+	return rawaddr, host, nil
+}
+
+// getOriginalDst6 is the IPv6 flavor of GetOriginalDst. The kernel
+// hands back a whole sockaddr_in6 here, which is too big for
+// IPv6Mreq, so we borrow IPv6MTUInfo since it starts with one.
+func getOriginalDst6(rawConn syscall.RawConn) (rawaddr []byte, host string, err error) {
+	var info *unix.IPv6MTUInfo
+	cerr := rawConn.Control(func(fd uintptr) {
+		info, err = unix.GetsockoptIPv6MTUInfo(int(fd), unix.IPPROTO_IPV6, IP6T_SO_ORIGINAL_DST)
+	})
+	if cerr != nil {
+		return nil, "", cerr
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	// the port is in network byte order
+	portBytes := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+	port := uint16(portBytes[0])<<8 + uint16(portBytes[1])
+
+	// address type 4 - IPv6, then 16 bytes of address, then the port
+	rawaddr = append(rawaddr, byte(4))
+	rawaddr = append(rawaddr, info.Addr.Addr[:]...)
+	rawaddr = append(rawaddr, portBytes[0], portBytes[1])
+
+	host = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), fmt.Sprintf("%d", port))
+
+	return rawaddr, host, nil
+}
@@ -0,0 +1,40 @@
+// +build linux
+
+package nat
+
+import (
+	"testing"
+
+	"github.com/datawire/teleproxy/pkg/supervisor"
+)
+
+// we don't yet have any firewall config cases to test against, but
+// we do want to exercise both backends
+
+type env struct {
+	backend string
+}
+
+var environments = []env{
+	{backend: "iptables"},
+	{backend: "nftables"},
+}
+
+func (e *env) setup() {}
+
+func (e *env) teardown() {}
+
+func (e *env) configure(tr *Translator) {
+	tr.Backend = e.backend
+}
+
+func TestNftablesNotEnabled(t *testing.T) {
+	withProcess(t, func(p *supervisor.Process) {
+		tr := NewTranslator("test-table")
+		impl := &nftables{}
+		next := map[Address]string{{"tcp", "192.0.2.1", ""}: "1234"}
+		if err := impl.apply(p, tr, next, nil); err == nil {
+			t.Error("expected an error applying before enabling")
+		}
+	})
+}
@@ -0,0 +1,210 @@
+// +build linux
+
+package nat
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+
+	nft "github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/datawire/teleproxy/internal/pkg/route"
+	"github.com/datawire/teleproxy/pkg/supervisor"
+)
+
+// nftables is the backend that programs a dedicated nftables table
+// directly over netlink. Everything teleproxy installs lives in that
+// one table, so removing the table removes every trace of us.
+//
+// Rather than tracking individual rule handles, every batch of
+// changes rewrites the whole redirect chain in a single netlink
+// batch. The kernel applies a netlink batch atomically, so the chain
+// is never observed half-updated and a failed batch changes nothing.
+type nftables struct {
+	table    *nft.Table
+	redirect *nft.Chain
+}
+
+func (n *nftables) enable(p *supervisor.Process, t *Translator) error {
+	n.table = &nft.Table{Name: t.Name, Family: nft.TableFamilyINet}
+	n.redirect = &nft.Chain{Name: "redirect", Table: n.table}
+
+	// deleting a table that doesn't exist fails the whole batch,
+	// so get rid of any leftovers on their own first
+	c := &nft.Conn{}
+	c.DelTable(n.table)
+	_ = c.Flush()
+
+	c = &nft.Conn{}
+	c.AddTable(n.table)
+	c.AddChain(n.redirect)
+	// we need to be in the prerouting hook in order to get
+	// traffic from docker containers, not sure you would *always*
+	// want this, but probably makes sense as a default
+	hooks := []struct {
+		name string
+		hook nft.ChainHook
+	}{
+		{"output", nft.ChainHookOutput},
+		{"prerouting", nft.ChainHookPrerouting},
+	}
+	for _, h := range hooks {
+		base := c.AddChain(&nft.Chain{
+			Name:     h.name,
+			Table:    n.table,
+			Type:     nft.ChainTypeNAT,
+			Hooknum:  h.hook,
+			Priority: nft.ChainPriorityNATDest,
+		})
+		c.AddRule(&nft.Rule{
+			Table: n.table,
+			Chain: base,
+			Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: n.redirect.Name}},
+		})
+	}
+	n.rules(p, c, t.Mappings, t.Excludes)
+	if err := c.Flush(); err != nil {
+		// nothing was created, so apply has nothing to work
+		// with either
+		n.table, n.redirect = nil, nil
+		return errors.Wrapf(err, "nftables: creating table %s", t.Name)
+	}
+	p.Logf("nftables: created table %s", t.Name)
+	return nil
+}
+
+func (n *nftables) disable(p *supervisor.Process, t *Translator) {
+	c := &nft.Conn{}
+	c.DelTable(&nft.Table{Name: t.Name, Family: nft.TableFamilyINet})
+	if err := c.Flush(); err != nil {
+		p.Logf("nftables: removing table %s: %v", t.Name, err)
+	}
+}
+
+// apply replaces the contents of the redirect chain with next and
+// excludes in one transaction.
+func (n *nftables) apply(p *supervisor.Process, t *Translator, next map[Address]string, excludes []string) error {
+	if n.table == nil {
+		return errors.New("nftables: not enabled")
+	}
+	c := &nft.Conn{}
+	c.FlushChain(n.redirect)
+	n.rules(p, c, next, excludes)
+	return errors.Wrap(c.Flush(), "nftables")
+}
+
+func (n *nftables) rules(p *supervisor.Process, c *nft.Conn, mappings map[Address]string, excludes []string) {
+	add := func(exprs ...expr.Any) {
+		c.AddRule(&nft.Rule{Table: n.table, Chain: n.redirect, Exprs: exprs})
+	}
+
+	for _, loopback := range []string{"127.0.0.1", "::1"} {
+		dst, _ := destNet(loopback)
+		match, _ := matchDest("tcp", dst, "")
+		add(append(match, &expr.Verdict{Kind: expr.VerdictReturn})...)
+	}
+
+	// excluded destinations return before any redirect gets a
+	// chance to match, whatever the protocol
+	for _, x := range excludes {
+		dst, err := destNet(x)
+		if err != nil {
+			p.Logf("nftables: skipping exclude %s: %v", x, err)
+			continue
+		}
+		match, _ := matchDest("", dst, "")
+		add(append(match, &expr.Verdict{Kind: expr.VerdictReturn})...)
+	}
+
+	for _, entry := range sortedEntries(mappings) {
+		dst, err := destNet(entry.Destination.Ip)
+		if err != nil {
+			p.Logf("nftables: skipping %s: %v", entry.String(), err)
+			continue
+		}
+		toPort, err := strconv.ParseUint(entry.Port, 10, 16)
+		if err != nil {
+			p.Logf("nftables: skipping %s: %v", entry.String(), err)
+			continue
+		}
+		for _, port := range splitPorts(entry.Destination.Port) {
+			match, err := matchDest(entry.Destination.Proto, dst, port)
+			if err != nil {
+				p.Logf("nftables: skipping %s: %v", entry.String(), err)
+				continue
+			}
+			add(append(match,
+				&expr.Immediate{Register: 1, Data: bigEndian16(uint16(toPort))},
+				&expr.Redir{RegisterProtoMin: 1})...)
+		}
+	}
+}
+
+// matchDest returns the expressions that match packets of the given
+// protocol (or any protocol, if it is empty) headed to dst (and port,
+// if it is not empty). Since our table is in the inet family, it
+// also matches on the IP version.
+func matchDest(proto string, dst *net.IPNet, port string) ([]expr.Any, error) {
+
+	// ip daddr lives at offset 16 of the IPv4 header, ip6 daddr
+	// at offset 24 of the IPv6 header
+	nfproto, offset, addr := byte(unix.NFPROTO_IPV4), uint32(16), dst.IP.To4()
+	if addr == nil {
+		nfproto, offset, addr = unix.NFPROTO_IPV6, 24, dst.IP.To16()
+	}
+
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+	}
+	if proto != "" {
+		l4proto := byte(unix.IPPROTO_TCP)
+		if proto == "udp" {
+			l4proto = unix.IPPROTO_UDP
+		}
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{l4proto}})
+	}
+	exprs = append(exprs,
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(addr))})
+
+	if ones, bits := dst.Mask.Size(); ones != bits {
+		// a network rather than a single address, so mask off
+		// the host part before comparing
+		exprs = append(exprs, &expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            uint32(len(addr)),
+			Mask:           []byte(dst.Mask),
+			Xor:            make([]byte, len(addr)),
+		})
+	}
+	exprs = append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr})
+
+	if port != "" {
+		from, to, err := route.ParsePortRange(port)
+		if err != nil {
+			return nil, err
+		}
+		// th dport
+		exprs = append(exprs, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2})
+		if from == to {
+			exprs = append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: bigEndian16(from)})
+		} else {
+			exprs = append(exprs, &expr.Range{Op: expr.CmpOpEq, Register: 1, FromData: bigEndian16(from), ToData: bigEndian16(to)})
+		}
+	}
+
+	return exprs, nil
+}
+
+func bigEndian16(n uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, n)
+	return b
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	ppf "github.com/datawire/pf"
+	"github.com/pkg/errors"
 
 	"github.com/datawire/teleproxy/pkg/supervisor"
 )
@@ -18,6 +19,16 @@ type Translator struct {
 	token string
 }
 
+// platformState records the token pf handed us when we enabled it,
+// so that a crashed teleproxy's reference can be released.
+type platformState struct {
+	Token string `json:"token,omitempty"`
+}
+
+func (t *Translator) platformState() platformState {
+	return platformState{Token: t.token}
+}
+
 func pf(p *supervisor.Process, args []string, stdin string) error {
 	cmd := p.Command("pfctl", args...)
 	cmd.Stdin = strings.NewReader(stdin)
@@ -28,13 +39,6 @@ func pf(p *supervisor.Process, args []string, stdin string) error {
 	return cmd.Wait()
 }
 
-func splitPorts(portspec string) (result []string) {
-	for _, part := range strings.Split(portspec, ",") {
-		result = append(result, strings.TrimSpace(part))
-	}
-	return
-}
-
 func fmtDest(a Address) (result []string) {
 	ports := splitPorts(a.Port)
 
@@ -44,7 +48,7 @@ func fmtDest(a Address) (result []string) {
 		for _, port := range ports {
 			addr := fmt.Sprintf("proto %s to %s", a.Proto, a.Ip)
 			if port != "" {
-				addr += fmt.Sprintf(" port %s", port)
+				addr += fmt.Sprintf(" port %s", colonRanges(port))
 			}
 
 			result = append(result, addr)
@@ -54,27 +58,65 @@ func fmtDest(a Address) (result []string) {
 	return
 }
 
-func (t *Translator) rules() string {
+// pfFamily returns the pf address family keyword and loopback
+// address to use for the given destination.
+func pfFamily(a Address) (af, loopback string) {
+	if isIPv6(a.Ip) {
+		return "inet6", "::1"
+	}
+	return "inet", "127.0.0.1"
+}
+
+// ipv4Mappings returns the IPv4 mappings, and how many IPv6 ones it
+// left out. Our pf bindings can't look up where an IPv6 connection
+// was headed, so redirecting one would only break it.
+func ipv4Mappings(mappings map[Address]string) (result map[Address]string, skipped int) {
+	result = make(map[Address]string, len(mappings))
+	for dst, port := range mappings {
+		if isIPv6(dst.Ip) {
+			skipped++
+		} else {
+			result[dst] = port
+		}
+	}
+	return
+}
+
+func (t *Translator) rules(mappings map[Address]string, excludes []string) string {
 	if t.dev == nil {
 		return ""
 	}
 
-	entries := t.sorted()
+	mappings, _ = ipv4Mappings(mappings)
+	entries := sortedEntries(mappings)
 
+	// translation rules are first match, so these need to come
+	// before any of the rdr rules
 	result := ""
+	for _, x := range excludes {
+		af, _ := pfFamily(Address{Ip: x})
+		result += "no rdr on lo0 " + af + " to " + x + "\n"
+	}
 	for _, entry := range entries {
 		dst := entry.Destination
+		af, loopback := pfFamily(dst)
 		for _, addr := range fmtDest(dst) {
-			result += ("rdr pass on lo0 inet " + addr + " -> 127.0.0.1 port " + entry.Port + "\n")
+			result += ("rdr pass on lo0 " + af + " " + addr + " -> " + loopback + " port " + entry.Port + "\n")
 		}
 	}
 
 	result += "pass out quick inet proto tcp to 127.0.0.1/32\n"
+	result += "pass out quick inet6 proto tcp to ::1/128\n"
+	for _, x := range excludes {
+		af, _ := pfFamily(Address{Ip: x})
+		result += "pass out quick " + af + " to " + x + "\n"
+	}
 
 	for _, entry := range entries {
 		dst := entry.Destination
+		af, _ := pfFamily(dst)
 		for _, addr := range fmtDest(dst) {
-			result += "pass out route-to lo0 inet " + addr + " keep state\n"
+			result += "pass out route-to lo0 " + af + " " + addr + " keep state\n"
 		}
 	}
 
@@ -83,24 +125,38 @@ func (t *Translator) rules() string {
 
 var actions = []ppf.Action{ppf.ActionPass, ppf.ActionRDR}
 
-func (t *Translator) Enable(p *supervisor.Process) {
-	var err error
+// Enable sets up the firewall so that Apply can install rules, and
+// returns an error if it can't.
+func (t *Translator) Enable(p *supervisor.Process) error {
+	// if a previous incarnation died without cleaning up, get rid
+	// of its anchor rules and release its pf enable reference
+	st, err := LoadState(t.Name)
+	if err != nil {
+		p.Log(err)
+	}
+	if st != nil {
+		p.Logf("cleaning up after previous run")
+		if err := NewTranslator(t.Name).cleanup(p, st); err != nil {
+			p.Log(err)
+		}
+	}
+
 	t.dev, err = ppf.Open()
 	if err != nil {
-		panic(err)
+		return errors.Wrap(err, "opening pf")
 	}
 
 	for _, action := range actions {
 		var rule ppf.Rule
 		err = rule.SetAnchorCall(t.Name)
 		if err != nil {
-			panic(err)
+			return errors.Wrap(err, "pf")
 		}
 		rule.SetAction(action)
 		rule.SetQuick(true)
 		err = t.dev.PrependRule(rule)
 		if err != nil {
-			panic(err)
+			return errors.Wrap(err, "pf")
 		}
 	}
 
@@ -113,9 +169,12 @@ func (t *Translator) Enable(p *supervisor.Process) {
 	// doesn't seem to work, it has to be a syntax error of some
 	// kind.
 	pf(p, []string{"-f", "/dev/stdin"}, "pass on lo0")
-	pf(p, []string{"-a", t.Name, "-f", "/dev/stdin"}, t.rules())
+	pf(p, []string{"-a", t.Name, "-f", "/dev/stdin"}, t.rules(t.Mappings, t.Excludes))
 
-	output := p.Command("pfctl", "-E").MustCaptureErr(nil)
+	output, err := p.Command("pfctl", "-E").CaptureErr(nil)
+	if err != nil {
+		return errors.Wrap(err, "enabling pf")
+	}
 	for _, line := range strings.Split(output, "\n") {
 		parts := strings.Split(line, ":")
 		if len(parts) == 2 && strings.TrimSpace(parts[0]) == "Token" {
@@ -125,12 +184,17 @@ func (t *Translator) Enable(p *supervisor.Process) {
 	}
 
 	if t.token == "" {
-		panic("unable to parse token")
+		return errors.New("enabling pf: unable to parse token")
 	}
+
+	t.saveState(p)
+	return nil
 }
 
 func (t *Translator) Disable(p *supervisor.Process) {
-	_ = p.Command("pfctl", "-X", t.token).Run()
+	if t.token != "" {
+		_ = p.Command("pfctl", "-X", t.token).Run()
+	}
 
 	if t.dev != nil {
 		for _, action := range actions {
@@ -157,6 +221,21 @@ func (t *Translator) Disable(p *supervisor.Process) {
 	}
 
 	pf(p, []string{"-a", t.Name, "-F", "all"}, "")
+	t.removeState(p)
+}
+
+// cleanup removes whatever st says was installed. Every rule that
+// calls our anchor is removed regardless, so this also works when
+// there is no record of a previous run.
+func (t *Translator) cleanup(p *supervisor.Process, st *State) error {
+	var err error
+	t.dev, err = ppf.Open()
+	if err != nil {
+		return errors.Wrap(err, "opening pf")
+	}
+	t.token = st.Token
+	t.Disable(p)
+	return nil
 }
 
 func (t *Translator) ForwardTCP(p *supervisor.Process, ip, port, toPort string) {
@@ -168,28 +247,59 @@ func (t *Translator) ForwardUDP(p *supervisor.Process, ip, port, toPort string)
 }
 
 func (t *Translator) forward(p *supervisor.Process, protocol, ip, port, toPort string) {
-	t.clear(protocol, ip, port)
-	t.Mappings[Address{protocol, ip, port}] = toPort
-	pf(p, []string{"-a", t.Name, "-f", "/dev/stdin"}, t.rules())
+	err := t.Apply(p, []Change{ForwardChange(protocol, ip, port, toPort)})
+	if err != nil {
+		p.Log(err)
+	}
 }
 
 func (t *Translator) ClearTCP(p *supervisor.Process, ip, port string) {
-	t.clear("tcp", ip, port)
-	pf(p, []string{"-a", t.Name, "-f", "/dev/stdin"}, t.rules())
+	t.clear(p, "tcp", ip, port)
 }
 
 func (t *Translator) ClearUDP(p *supervisor.Process, ip, port string) {
-	t.clear("udp", ip, port)
-	pf(p, []string{"-a", t.Name, "-f", "/dev/stdin"}, t.rules())
+	t.clear(p, "udp", ip, port)
 }
 
-func (t *Translator) clear(protocol, ip, port string) {
-	delete(t.Mappings, Address{protocol, ip, port})
+func (t *Translator) clear(p *supervisor.Process, protocol, ip, port string) {
+	err := t.Apply(p, []Change{ClearChange(protocol, ip, port)})
+	if err != nil {
+		p.Log(err)
+	}
+}
+
+// ApplyExcludes installs a whole batch of changes, along with a new
+// list of excluded destinations, by reloading our anchor once. pfctl
+// loads an anchor's ruleset atomically, so if the load fails the
+// previous rules stay in place.
+func (t *Translator) ApplyExcludes(p *supervisor.Process, excludes []string, changes []Change) error {
+	excludes, err := normalizeExcludes(excludes)
+	if err != nil {
+		return err
+	}
+	next := t.next(changes)
+	if _, skipped := ipv4Mappings(next); skipped > 0 {
+		p.Logf("WARNING: skipping %d IPv6 mappings, only IPv4 can be intercepted on macOS", skipped)
+	}
+	if t.dev != nil {
+		err := pf(p, []string{"-a", t.Name, "-f", "/dev/stdin"}, t.rules(next, excludes))
+		if err != nil {
+			return errors.Wrap(err, "pfctl")
+		}
+	}
+	t.Mappings = next
+	t.Excludes = excludes
+	t.saveState(p)
+	return nil
 }
 
 func (t *Translator) GetOriginalDst(conn *net.TCPConn) (rawaddr []byte, host string, err error) {
 	remote := conn.RemoteAddr().(*net.TCPAddr)
 	local := conn.LocalAddr().(*net.TCPAddr)
+	if local.IP.To4() == nil {
+		// our pf bindings only know how to do IPv4 lookups
+		return nil, "", errors.Errorf("unable to look up original destination for IPv6 connection from %v", remote)
+	}
 	addr, port, err := t.dev.NatLook(remote.IP.String(), remote.Port, local.IP.String(), local.Port)
 	if err != nil {
 		return
@@ -197,3 +307,10 @@ func (t *Translator) GetOriginalDst(conn *net.TCPConn) (rawaddr []byte, host str
 
 	return nil, fmt.Sprintf("%s:%d", addr, port), nil
 }
+
+// GetOriginalDstUDP returns where a datagram from src, that was
+// redirected to local, was originally headed.
+func (t *Translator) GetOriginalDstUDP(src, local *net.UDPAddr) (host string, err error) {
+	// our pf bindings only know how to look up tcp states
+	return "", errors.Errorf("unable to look up original destination for udp from %v", src)
+}
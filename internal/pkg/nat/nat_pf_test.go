@@ -53,6 +53,8 @@ func (e *env) setup() {
 	})
 }
 
+func (e *env) configure(tr *Translator) {}
+
 func (e *env) teardown() {
 	supervisor.MustRun("teardown", func(p *supervisor.Process) error {
 		_ = pf(p, []string{"-F", "all"}, "")
@@ -86,7 +86,7 @@ func listeners(p *supervisor.Process, ports []int) error {
 
 func checkForwardTCP(t *testing.T, fromIP string, ports []string, toPort string) {
 	for _, port := range ports {
-		from := fmt.Sprintf("%s:%s", fromIP, port)
+		from := net.JoinHostPort(fromIP, port)
 
 		deadline := time.Now().Add(3 * time.Second)
 
@@ -116,7 +116,7 @@ func checkForwardTCP(t *testing.T, fromIP string, ports []string, toPort string)
 
 func checkNoForwardTCP(t *testing.T, fromIP string, ports []string) {
 	for _, port := range ports {
-		c, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%s", fromIP, port), 50*time.Millisecond)
+		c, err := net.DialTimeout("tcp", net.JoinHostPort(fromIP, port), 50*time.Millisecond)
 		if err != nil {
 			continue
 		}
@@ -164,6 +164,7 @@ func TestTranslator(t *testing.T) {
 				env.setup()
 				for _, network := range networks {
 					tr := NewTranslator("test-table")
+					env.configure(tr)
 
 					for _, mapping := range mappings {
 						checkNoForwardTCP(t, fmt.Sprintf("%s.%s", network, mapping.from), mapping.forwarded)
@@ -202,23 +203,59 @@ func TestTranslator(t *testing.T) {
 }
 
 func TestSorted(t *testing.T) {
-	supervisor.MustRun("sorted", func(p *supervisor.Process) error {
-		tr := NewTranslator("test-table")
-		defer tr.Disable(p)
-		tr.ForwardTCP(p, "192.0.2.1", "", "4321")
-		tr.ForwardTCP(p, "192.0.2.3", "", "4323")
-		tr.ForwardTCP(p, "192.0.2.2", "", "4322")
-		tr.ForwardUDP(p, "192.0.2.4", "", "1234")
-		entries := tr.sorted()
-		if !reflect.DeepEqual(entries, []Entry{
-			{Address{"tcp", "192.0.2.1", ""}, "4321"},
-			{Address{"tcp", "192.0.2.2", ""}, "4322"},
-			{Address{"tcp", "192.0.2.3", ""}, "4323"},
-			{Address{"udp", "192.0.2.4", ""}, "1234"},
-		}) {
-			t.Errorf("not sorted: %s", entries)
-		}
+	tr := NewTranslator("test-table")
+	tr.Mappings = tr.next([]Change{
+		ForwardChange("tcp", "192.0.2.1", "", "4321"),
+		ForwardChange("tcp", "192.0.2.3", "", "4323"),
+		ForwardChange("tcp", "192.0.2.2", "", "4322"),
+		ForwardChange("udp", "192.0.2.4", "", "1234"),
+	})
+	entries := tr.sorted()
+	if !reflect.DeepEqual(entries, []Entry{
+		{Address{"tcp", "192.0.2.1", ""}, "4321"},
+		{Address{"tcp", "192.0.2.2", ""}, "4322"},
+		{Address{"tcp", "192.0.2.3", ""}, "4323"},
+		{Address{"udp", "192.0.2.4", ""}, "1234"},
+	}) {
+		t.Errorf("not sorted: %s", entries)
+	}
+}
 
-		return nil
+func TestNext(t *testing.T) {
+	tr := NewTranslator("test-table")
+	tr.Mappings[Address{"tcp", "192.0.2.1", ""}] = "4321"
+	tr.Mappings[Address{"tcp", "192.0.2.2", ""}] = "4322"
+
+	next := tr.next([]Change{
+		ClearChange("tcp", "192.0.2.1", ""),
+		ForwardChange("tcp", "192.0.2.2", "", "1234"),
+		ForwardChange("udp", "192.0.2.3", "53", "1233"),
+		ClearChange("udp", "192.0.2.4", ""),
 	})
+
+	expected := map[Address]string{
+		{"tcp", "192.0.2.2", ""}:   "1234",
+		{"udp", "192.0.2.3", "53"}: "1233",
+	}
+	if !reflect.DeepEqual(next, expected) {
+		t.Errorf("got %v, expected %v", next, expected)
+	}
+	if len(tr.Mappings) != 2 || tr.Mappings[Address{"tcp", "192.0.2.2", ""}] != "4322" {
+		t.Errorf("next modified the current mappings: %v", tr.Mappings)
+	}
+}
+
+func TestDestCIDR(t *testing.T) {
+	for ip, expected := range map[string]string{
+		"192.0.2.1":        "192.0.2.1/32",
+		"2001:db8::1":      "2001:db8::1/128",
+		"::ffff:192.0.2.1": "192.0.2.1/32",
+		"10.96.0.0/12":     "10.96.0.0/12",
+		"10.100.0.0/12":    "10.96.0.0/12",
+		"fd00::/108":       "fd00::/108",
+	} {
+		if actual := destCIDR(ip); actual != expected {
+			t.Errorf("destCIDR(%q) = %q, expected %q", ip, actual, expected)
+		}
+	}
 }
@@ -0,0 +1,111 @@
+package nat
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/pkg/supervisor"
+)
+
+// StateDir is where translators record what they have installed so
+// that it can be removed even if the process that installed it died
+// without cleaning up. It lives under /var/run because firewall
+// rules don't survive a reboot either.
+var StateDir = "/var/run"
+
+// State is what a Translator records about itself in its state
+// file. The platformState holds whatever else a platform needs to
+// undo, e.g. the pf enable token on darwin.
+type State struct {
+	Name     string   `json:"name"`
+	Backend  string   `json:"backend,omitempty"`
+	Mappings []Entry  `json:"mappings"`
+	Excludes []string `json:"excludes,omitempty"`
+	platformState
+}
+
+// StatePath returns the path of the state file for the translator
+// with the given name.
+func StatePath(name string) string {
+	return filepath.Join(StateDir, "teleproxy-"+name+".json")
+}
+
+// LoadState reads the state file for the translator with the given
+// name. It returns nil and no error if there is no state file.
+func LoadState(name string) (*State, error) {
+	bytes, err := ioutil.ReadFile(StatePath(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st State
+	err = json.Unmarshal(bytes, &st)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", StatePath(name))
+	}
+	return &st, nil
+}
+
+// saveState records what is currently installed. Failing to do so
+// isn't fatal, it just means a crash would need manual cleanup, so
+// errors are only logged.
+func (t *Translator) saveState(p *supervisor.Process) {
+	st := State{
+		Name:          t.Name,
+		Backend:       t.Backend,
+		Mappings:      t.sorted(),
+		Excludes:      t.Excludes,
+		platformState: t.platformState(),
+	}
+	bytes, err := json.MarshalIndent(st, "", "  ")
+	if err == nil {
+		path := StatePath(t.Name)
+		tmp := path + ".tmp"
+		err = ioutil.WriteFile(tmp, bytes, 0600)
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		p.Logf("unable to save nat state: %v", err)
+	}
+}
+
+func (t *Translator) removeState(p *supervisor.Process) {
+	err := os.Remove(StatePath(t.Name))
+	if err != nil && !os.IsNotExist(err) {
+		p.Logf("unable to remove nat state: %v", err)
+	}
+}
+
+// Cleanup removes everything that a translator with the given name
+// may have left behind, whether or not the process that created it
+// is still around. It consults the state file when there is one, and
+// otherwise falls back to removing whatever it can find under that
+// name.
+func Cleanup(p *supervisor.Process, name string) error {
+	st, err := LoadState(name)
+	if err != nil {
+		p.Logf("ignoring unreadable state: %v", err)
+		st = nil
+	}
+	if st == nil {
+		st = &State{Name: name}
+	} else {
+		p.Logf("found state for %s with %d mappings", name, len(st.Mappings))
+	}
+
+	t := NewTranslator(name)
+	err = t.cleanup(p, st)
+	if err != nil {
+		return err
+	}
+	t.removeState(p)
+	return nil
+}
@@ -0,0 +1,113 @@
+// +build linux
+
+package nat
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/datawire/teleproxy/pkg/supervisor"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	defer tempStateDir(t)()
+	log, done := fakeBinaries(t, []string{"iptables", "iptables-restore"})
+	defer done()
+
+	withProcess(t, func(p *supervisor.Process) {
+		tr := NewTranslator("test-table")
+		tr.Backend = "iptables"
+		tr.Enable(p)
+		if err := tr.ApplyExcludes(p, []string{"192.0.2.0/24"}, []Change{ForwardChange("tcp", "198.51.100.1", "80", "1234")}); err != nil {
+			t.Fatal(err)
+		}
+
+		st, err := LoadState("test-table")
+		if err != nil || st == nil {
+			t.Fatalf("got %v, %v", st, err)
+		}
+		if st.Backend != "iptables" || len(st.Mappings) != 1 || st.Mappings[0].Port != "1234" ||
+			len(st.Excludes) != 1 || st.Excludes[0] != "192.0.2.0/24" {
+			t.Errorf("got %+v", st)
+		}
+
+		// as if teleproxy had crashed and --mode cleanup ran
+		if err := Cleanup(p, "test-table"); err != nil {
+			t.Fatal(err)
+		}
+		out := log()
+		for _, expected := range []string{"-D OUTPUT -j test-table", "-D PREROUTING -j test-table", "-X test-table"} {
+			if !strings.Contains(out, expected) {
+				t.Errorf("expected %q in:\n%s", expected, out)
+			}
+		}
+		if st, err := LoadState("test-table"); st != nil || err != nil {
+			t.Errorf("expected the state to be gone, got %+v, %v", st, err)
+		}
+	})
+}
+
+func TestCleanupWithoutIptables(t *testing.T) {
+	defer tempStateDir(t)()
+	_, done := fakeBinaries(t, nil)
+	defer done()
+	if _, err := exec.LookPath("iptables"); err == nil {
+		t.Fatal("expected no iptables on the PATH")
+	}
+
+	withProcess(t, func(p *supervisor.Process) {
+		tr := NewTranslator("test-table")
+		tr.Backend = "iptables"
+		tr.saveState(p)
+
+		// this has to fail rather than panic, and leave the
+		// state for another try
+		if err := Cleanup(p, "test-table"); err == nil {
+			t.Error("expected an error")
+		}
+		if st, err := LoadState("test-table"); st == nil || err != nil {
+			t.Errorf("expected the state to be kept, got %+v, %v", st, err)
+		}
+	})
+}
+
+func TestRemoveJumps(t *testing.T) {
+	log, done := fakeBinaries(t, nil)
+	defer done()
+
+	// fakeBinaries left its directory alone on the PATH
+	dir := os.Getenv("PATH")
+	count := filepath.Join(dir, "count")
+	if err := ioutil.WriteFile(count, []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// an iptables that finds three jumps in OUTPUT and none in
+	// PREROUTING
+	script := fmt.Sprintf(`#!/bin/sh
+echo "iptables $*" >> %s
+read n < %s
+n=$((n+1))
+echo $n > %s
+[ $n -le 3 ]
+`, filepath.Join(dir, "log"), count, count)
+	if err := ioutil.WriteFile(filepath.Join(dir, "iptables"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	withProcess(t, func(p *supervisor.Process) {
+		impl := &iptables{}
+		impl.removeJumps(p, ipv4, "test-table")
+	})
+	out := log()
+	if n := strings.Count(out, "-D OUTPUT -j test-table"); n != 4 {
+		t.Errorf("expected 4 tries for OUTPUT, got %d:\n%s", n, out)
+	}
+	if n := strings.Count(out, "-D PREROUTING -j test-table"); n != 1 {
+		t.Errorf("expected 1 try for PREROUTING, got %d:\n%s", n, out)
+	}
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+// A Dialer makes the upstream connection for an intercepted one.
+// golang.org/x/net/proxy dialers are Dialers. For udp, the network
+// is "udp" and each Read and Write of the resulting connection is one
+// datagram.
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+const (
+	// DefaultDialer is the name of the dialer used for tables that
+	// don't name one. Unless it is configured otherwise, it goes
+	// through the ssh tunnel's socks proxy.
+	DefaultDialer = "default"
+
+	// DirectDialer is the name of the dialer that connects
+	// straight to the destination.
+	DirectDialer = "direct"
+
+	// KubernetesDialer is the name of the dialer that connects
+	// through a port-forward to the pod behind the destination.
+	KubernetesDialer = "kubernetes"
+
+	// defaultSOCKS is where the ssh tunnel's socks proxy listens.
+	defaultSOCKS = "localhost:1080"
+
+	dialTimeout = 30 * time.Second
+)
+
+// ParseDialer returns the Dialer described by spec, which is one of
+// "direct", "socks5://host:port", or "http://host:port" (a proxy
+// that supports CONNECT).
+func ParseDialer(spec string) (Dialer, error) {
+	if spec == DirectDialer {
+		return &net.Dialer{Timeout: dialTimeout}, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil || u.Host == "" {
+		return nil, errors.Errorf("bad dialer, expected direct, socks5://host:port, or http://host:port: %q", spec)
+	}
+	switch u.Scheme {
+	case "socks5":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		return newSOCKSDialer(u.Host, auth)
+	case "http":
+		return &connectDialer{proxy: u}, nil
+	default:
+		return nil, errors.Errorf("unsupported dialer scheme: %q", spec)
+	}
+}
+
+// ParseDialerFlag parses a dialer definition of the form "name=spec".
+func ParseDialerFlag(flag string) (name string, dialer Dialer, err error) {
+	parts := strings.SplitN(flag, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", nil, errors.Errorf("bad dialer, expected name=spec: %q", flag)
+	}
+	dialer, err = ParseDialer(parts[1])
+	return parts[0], dialer, err
+}
+
+// A connectDialer tunnels through an http proxy with CONNECT.
+type connectDialer struct {
+	proxy *url.URL
+}
+
+func (d *connectDialer) Dial(network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, errors.Errorf("CONNECT only supports tcp, not %s", network)
+	}
+	conn, err := net.DialTimeout("tcp", d.proxy.Host, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.proxy.User != nil {
+		password, _ := d.proxy.User.Password()
+		req.SetBasicAuth(d.proxy.User.Username(), password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Errorf("CONNECT %s via %s: %s", address, d.proxy.Host, resp.Status)
+	}
+	if r.Buffered() > 0 {
+		// the far end spoke first and we already read some of it
+		return &bufferedConn{conn, r}, nil
+	}
+	return conn, nil
+}
+
+// A bufferedConn is a net.Conn with some of its input already read
+// into a bufio.Reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *bufferedConn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
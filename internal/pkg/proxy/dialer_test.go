@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParseDialer(t *testing.T) {
+	for _, spec := range []string{"direct", "socks5://localhost:1080", "socks5://user:pw@localhost:1080", "http://proxy:3128"} {
+		if _, err := ParseDialer(spec); err != nil {
+			t.Errorf("%s: %v", spec, err)
+		}
+	}
+	for _, spec := range []string{"", "socks5", "ftp://proxy:21", "http://"} {
+		if _, err := ParseDialer(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+	if _, _, err := ParseDialerFlag("direct"); err == nil {
+		t.Error("expected an error for a flag without a name")
+	}
+}
+
+func TestConnectDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != http.MethodConnect || req.Host != "example.com:80" {
+			conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			return
+		}
+		// the greeting arrives along with the response, as it
+		// would from a server that speaks first
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhello"))
+	}()
+
+	dialer, err := ParseDialer("http://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	greeting, err := ioutil.ReadAll(conn)
+	if err != nil || string(greeting) != "hello" {
+		t.Errorf("got %q, %v", greeting, err)
+	}
+}
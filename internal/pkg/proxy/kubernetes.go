@@ -0,0 +1,504 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+
+	"github.com/datawire/teleproxy/pkg/k8s"
+)
+
+// these are the header names and values from k8s.io/api/core/v1
+const (
+	streamType                 = "streamType"
+	streamTypeError            = "error"
+	streamTypeData             = "data"
+	portHeader                 = "port"
+	portForwardRequestIDHeader = "requestID"
+)
+
+// PortForward connects to port on the given pod through the api
+// server, the same way `kubectl port-forward` does, and returns the
+// connection.
+func PortForward(config *rest.Config, namespace, pod string, port int) (net.Conn, error) {
+	conn, err := dialPod(config, namespace, pod)
+	if err != nil {
+		return nil, err
+	}
+	result, err := forwardStream(conn, namespace+"/"+pod, port, 0, func() { conn.Close() })
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return result, nil
+}
+
+// dialPod opens a port-forward connection to the given pod, which
+// can then carry any number of streams.
+func dialPod(config *rest.Config, namespace, pod string) (httpstream.Connection, error) {
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return nil, err
+	}
+	host := config.Host
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, "api/v1/namespaces", namespace, "pods", pod, "portforward")
+
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, u)
+	conn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "port-forward to %s/%s", namespace, pod)
+	}
+	return conn, nil
+}
+
+// forwardStream opens the streams for one connection to port over
+// conn, a port-forward connection to pod. Each connection needs its
+// own requestID. The returned net.Conn calls done once it is closed.
+func forwardStream(conn httpstream.Connection, pod string, port, requestID int, done func()) (net.Conn, error) {
+	headers := http.Header{}
+	headers.Set(streamType, streamTypeError)
+	headers.Set(portHeader, strconv.Itoa(port))
+	headers.Set(portForwardRequestIDHeader, strconv.Itoa(requestID))
+	errorStream, err := conn.CreateStream(headers)
+	if err != nil {
+		return nil, err
+	}
+	// we're not writing to this stream
+	errorStream.Close()
+
+	headers.Set(streamType, streamTypeData)
+	dataStream, err := conn.CreateStream(headers)
+	if err != nil {
+		errorStream.Reset()
+		return nil, err
+	}
+
+	result := &streamConn{
+		errors: errorStream,
+		data:   dataStream,
+		remote: forwardAddr(fmt.Sprintf("%s:%d", pod, port)),
+		done:   done,
+		failed: make(chan struct{}),
+	}
+	go func() {
+		message, err := ioutil.ReadAll(errorStream)
+		if err == nil && len(message) > 0 {
+			result.err = errors.Errorf("port-forward to %s: %s", result.remote, message)
+			close(result.failed)
+		}
+	}()
+	return result, nil
+}
+
+// forwardAddr is the net.Addr of a port-forward.
+type forwardAddr string
+
+func (a forwardAddr) Network() string { return "port-forward" }
+func (a forwardAddr) String() string  { return string(a) }
+
+// A streamConn is a net.Conn over a port-forward's data stream.
+type streamConn struct {
+	errors httpstream.Stream
+	data   httpstream.Stream
+	remote forwardAddr
+	done   func()
+	once   sync.Once
+
+	// err is what the far end reported on the error stream, and
+	// failed is closed once it is set.
+	err    error
+	failed chan struct{}
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	n, err := c.data.Read(b)
+	if err != nil {
+		select {
+		case <-c.failed:
+			err = c.err
+		default:
+		}
+	}
+	return n, err
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	return c.data.Write(b)
+}
+
+// CloseWrite tells the far end that we're done sending.
+func (c *streamConn) CloseWrite() error {
+	return c.data.Close()
+}
+
+// Close resets the streams, leaving the port-forward connection to
+// whoever owns it.
+func (c *streamConn) Close() error {
+	c.once.Do(func() {
+		c.data.Reset()
+		c.errors.Reset()
+		c.done()
+	})
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return forwardAddr("local") }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+// port-forward streams have no deadlines, the connection is closed
+// by whichever end is done with it
+
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+const (
+	// lookupTTL is how long the pod behind an address is
+	// remembered.
+	lookupTTL = 30 * time.Second
+
+	// forwardIdleTimeout is how long a port-forward connection to
+	// a pod is kept open once nothing is using it.
+	forwardIdleTimeout = time.Minute
+)
+
+type podPort struct {
+	namespace, pod string
+	port           int
+	expires        time.Time
+}
+
+// A forward is a port-forward connection to a pod, which is shared
+// by all of the connections to that pod.
+type forward struct {
+	conn httpstream.Connection
+	// nextID is the requestID of the next connection, streams the
+	// number of open ones, and idle closes conn once there are
+	// none for a while
+	nextID  int
+	streams int
+	idle    *time.Timer
+}
+
+// A kubernetesDialer connects to cluster addresses with a
+// port-forward to the pod behind them: the pod itself for a pod ip,
+// or one of a service's ready endpoints for a service ip. It needs
+// neither the ssh tunnel nor any route to the cluster's network.
+type kubernetesDialer struct {
+	info *k8s.KubeInfo
+	// dial opens a port-forward connection to a pod
+	dial func(config *rest.Config, namespace, pod string) (httpstream.Connection, error)
+
+	mu       sync.Mutex
+	config   *rest.Config
+	client   *k8s.Client
+	services *k8s.Watcher
+	pods     map[string]podPort
+	forwards map[string]*forward
+}
+
+// NewKubernetesDialer returns a Dialer that port-forwards to the pods
+// of the cluster described by info. It doesn't talk to the cluster
+// until the first Dial.
+func NewKubernetesDialer(info *k8s.KubeInfo) Dialer {
+	return newKubernetesDialer(info)
+}
+
+func newKubernetesDialer(info *k8s.KubeInfo) *kubernetesDialer {
+	return &kubernetesDialer{
+		info:     info,
+		dial:     dialPod,
+		pods:     make(map[string]podPort),
+		forwards: make(map[string]*forward),
+	}
+}
+
+func (d *kubernetesDialer) Dial(network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, errors.Errorf("port-forward only supports tcp, not %s", network)
+	}
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, err
+	}
+	config, target, err := d.lookup(host, port)
+	if err != nil {
+		return nil, err
+	}
+	return d.forward(config, target)
+}
+
+// forward connects to the target over the port-forward connection to
+// its pod, opening one if there isn't one yet. If the connection
+// turns out to be broken, it is replaced once.
+func (d *kubernetesDialer) forward(config *rest.Config, target podPort) (net.Conn, error) {
+	key := target.namespace + "/" + target.pod
+	for try := 0; ; try++ {
+		f, id, err := d.acquire(config, key, target)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := forwardStream(f.conn, key, target.port, id, func() { d.release(key, f) })
+		if err == nil {
+			return conn, nil
+		}
+		d.discard(key, f)
+		if try > 0 {
+			return nil, errors.Wrapf(err, "port-forward to %s", key)
+		}
+	}
+}
+
+// use returns the requestID for a new connection over f. The caller
+// must hold the dialer's lock.
+func (f *forward) use() int {
+	if f.idle != nil {
+		f.idle.Stop()
+		f.idle = nil
+	}
+	id := f.nextID
+	f.nextID++
+	f.streams++
+	return id
+}
+
+// acquire returns the port-forward connection to the pod, and the
+// requestID for a new connection over it. The lock isn't held while
+// dialing the pod, so if two connections to a new pod race, the
+// port-forward that is opened second is closed again.
+func (d *kubernetesDialer) acquire(config *rest.Config, key string, target podPort) (*forward, int, error) {
+	d.mu.Lock()
+	if f, ok := d.forwards[key]; ok {
+		id := f.use()
+		d.mu.Unlock()
+		return f, id, nil
+	}
+	d.mu.Unlock()
+
+	conn, err := d.dial(config, target.namespace, target.pod)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	d.mu.Lock()
+	if f, ok := d.forwards[key]; ok {
+		id := f.use()
+		d.mu.Unlock()
+		conn.Close()
+		return f, id, nil
+	}
+	f := &forward{conn: conn}
+	d.forwards[key] = f
+	id := f.use()
+	d.mu.Unlock()
+
+	go func() {
+		<-conn.CloseChan()
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.forwards[key] == f {
+			delete(d.forwards, key)
+		}
+	}()
+	return f, id, nil
+}
+
+// release is called when a connection over f is closed. Once f has
+// been idle for forwardIdleTimeout, it is closed.
+func (d *kubernetesDialer) release(key string, f *forward) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f.streams--
+	if f.streams > 0 {
+		return
+	}
+	f.idle = time.AfterFunc(forwardIdleTimeout, func() {
+		d.mu.Lock()
+		if f.streams > 0 {
+			d.mu.Unlock()
+			return
+		}
+		if d.forwards[key] == f {
+			delete(d.forwards, key)
+		}
+		d.mu.Unlock()
+		f.conn.Close()
+	})
+}
+
+// discard closes f and forgets about it.
+func (d *kubernetesDialer) discard(key string, f *forward) {
+	d.mu.Lock()
+	if d.forwards[key] == f {
+		delete(d.forwards, key)
+	}
+	d.mu.Unlock()
+	f.conn.Close()
+}
+
+// lookup returns the pod and port behind ip and port. The lock is
+// only held to look at and update the cache, never while talking to
+// the cluster.
+func (d *kubernetesDialer) lookup(ip string, port int) (*rest.Config, podPort, error) {
+	config, client, services, err := d.cluster()
+	if err != nil {
+		return nil, podPort{}, err
+	}
+
+	key := net.JoinHostPort(ip, strconv.Itoa(port))
+	d.mu.Lock()
+	target, ok := d.pods[key]
+	d.mu.Unlock()
+	if ok && time.Now().Before(target.expires) {
+		return config, target, nil
+	}
+
+	target, err = findPod(client, services, ip, port)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		delete(d.pods, key)
+		return nil, podPort{}, err
+	}
+	target.expires = time.Now().Add(lookupTTL)
+	d.pods[key] = target
+	return config, target, nil
+}
+
+// cluster returns the config, client and services watcher for the
+// cluster, setting them up the first time. If two dials race to do
+// that, the loser's watcher is stopped again.
+func (d *kubernetesDialer) cluster() (*rest.Config, *k8s.Client, *k8s.Watcher, error) {
+	d.mu.Lock()
+	config, client, services := d.config, d.client, d.services
+	d.mu.Unlock()
+	if client != nil {
+		return config, client, services, nil
+	}
+
+	config, err := d.info.GetRestConfig()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	client, err = k8s.NewClient(d.info)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// services are looked up by their cluster ip, which can't be
+	// selected on, so we keep all of them
+	services = client.Watcher()
+	if err := services.Watch("services", func(*k8s.Watcher) {}); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := startWatcher(services); err != nil {
+		return nil, nil, nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client != nil {
+		services.Stop()
+		return d.config, d.client, d.services, nil
+	}
+	d.config, d.client, d.services = config, client, services
+	return config, client, services, nil
+}
+
+// startWatcher starts w, which panics if it can't list what it
+// watches.
+func startWatcher(w *k8s.Watcher) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("watching services: %v", r)
+		}
+	}()
+	w.Start()
+	return nil
+}
+
+// findPod works out which pod and port a connection to ip and port
+// should be forwarded to.
+func findPod(client *k8s.Client, services *k8s.Watcher, ip string, port int) (podPort, error) {
+	pods, err := client.SelectiveList(k8s.NamespaceAll, "pods", "status.podIP="+ip, "")
+	if err != nil {
+		return podPort{}, err
+	}
+	for _, pod := range pods {
+		if pod.Status().GetString("phase") == "Running" {
+			return podPort{namespace: pod.Namespace(), pod: pod.Name(), port: port}, nil
+		}
+	}
+
+	for _, svc := range services.List("services") {
+		if svc.Spec().GetString("clusterIP") != ip {
+			continue
+		}
+		portName := ""
+		found := false
+		for _, p := range svc.Spec().GetMaps("ports") {
+			p := k8s.Map(p)
+			if protocol := p.GetString("protocol"); protocol != "" && protocol != "TCP" {
+				continue
+			}
+			if int(p.GetInt64("port")) == port {
+				portName = p.GetString("name")
+				found = true
+				break
+			}
+		}
+		if !found {
+			return podPort{}, errors.Errorf("service %s has no tcp port %d", svc.QName(), port)
+		}
+
+		endpoints, err := client.SelectiveList(svc.Namespace(), "endpoints", "metadata.name="+svc.Name(), "")
+		if err != nil {
+			return podPort{}, err
+		}
+		for _, ep := range endpoints {
+			for _, subset := range ep.Data().GetMaps("subsets") {
+				target := 0
+				for _, p := range k8s.Map(subset).GetMaps("ports") {
+					if k8s.Map(p).GetString("name") == portName {
+						target = int(k8s.Map(p).GetInt64("port"))
+					}
+				}
+				if target == 0 {
+					continue
+				}
+				for _, addr := range k8s.Map(subset).GetMaps("addresses") {
+					ref := k8s.Map(k8s.Map(addr).GetMap("targetRef"))
+					if ref.GetString("kind") == "Pod" {
+						return podPort{namespace: svc.Namespace(), pod: ref.GetString("name"), port: target}, nil
+					}
+				}
+			}
+		}
+		return podPort{}, errors.Errorf("service %s has no ready pods", svc.QName())
+	}
+
+	return podPort{}, errors.Errorf("no pod or service has the address %s", ip)
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+)
+
+// fakeStream is a port-forward stream with nothing in it.
+type fakeStream struct {
+	headers http.Header
+}
+
+func (s *fakeStream) Read(b []byte) (int, error)  { return 0, io.EOF }
+func (s *fakeStream) Write(b []byte) (int, error) { return len(b), nil }
+func (s *fakeStream) Close() error                { return nil }
+func (s *fakeStream) Reset() error                { return nil }
+func (s *fakeStream) Headers() http.Header        { return s.headers }
+func (s *fakeStream) Identifier() uint32          { return 0 }
+
+// fakeConnection is a port-forward connection that remembers the
+// request ids of its data streams, and fails to create streams if
+// broken is set.
+type fakeConnection struct {
+	mu       sync.Mutex
+	requests []string
+	broken   bool
+	closed   chan bool
+	once     sync.Once
+}
+
+func newFakeConnection() *fakeConnection {
+	return &fakeConnection{closed: make(chan bool)}
+}
+
+func (c *fakeConnection) CreateStream(headers http.Header) (httpstream.Stream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.broken {
+		return nil, errors.New("broken")
+	}
+	if headers.Get(streamType) == streamTypeData {
+		c.requests = append(c.requests, headers.Get(portForwardRequestIDHeader))
+	}
+	return &fakeStream{headers: headers}, nil
+}
+
+func (c *fakeConnection) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeConnection) CloseChan() <-chan bool               { return c.closed }
+func (c *fakeConnection) SetIdleTimeout(timeout time.Duration) {}
+
+func TestKubernetesForward(t *testing.T) {
+	var conns []*fakeConnection
+	d := newKubernetesDialer(nil)
+	d.dial = func(config *rest.Config, namespace, pod string) (httpstream.Connection, error) {
+		conn := newFakeConnection()
+		conns = append(conns, conn)
+		return conn, nil
+	}
+	target := podPort{namespace: "default", pod: "web", port: 8080}
+
+	// connections to the same pod share a port-forward
+	a, err := d.forward(nil, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := d.forward(nil, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 1 || len(conns[0].requests) != 2 || conns[0].requests[0] != "0" || conns[0].requests[1] != "1" {
+		t.Fatalf("expected one port-forward with two requests, got %d: %v", len(conns), conns[0].requests)
+	}
+	if a.RemoteAddr().String() != "default/web:8080" {
+		t.Errorf("got %s", a.RemoteAddr())
+	}
+
+	// closing them leaves the port-forward for the next one
+	a.Close()
+	b.Close()
+	select {
+	case <-conns[0].closed:
+		t.Error("expected the port-forward to stay open")
+	default:
+	}
+	if c, err := d.forward(nil, target); err != nil || len(conns) != 1 {
+		t.Errorf("expected the port-forward to be reused, got %d, %v", len(conns), err)
+	} else {
+		c.Close()
+	}
+
+	// a broken port-forward is replaced
+	conns[0].broken = true
+	c, err := d.forward(nil, target)
+	if err != nil || len(conns) != 2 {
+		t.Fatalf("expected a new port-forward, got %d, %v", len(conns), err)
+	}
+	c.Close()
+	select {
+	case <-conns[0].closed:
+	default:
+		t.Error("expected the broken port-forward to be closed")
+	}
+
+	// and so is one the far end closes
+	conns[1].Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		d.mu.Lock()
+		_, ok := d.forwards["default/web"]
+		d.mu.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the closed port-forward to be forgotten")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c, err := d.forward(nil, target); err != nil || len(conns) != 3 {
+		t.Errorf("expected a new port-forward, got %d, %v", len(conns), err)
+	} else {
+		c.Close()
+	}
+}
+
+func TestKubernetesForwardUnlocked(t *testing.T) {
+	var mu sync.Mutex
+	var conns []*fakeConnection
+	dialing := make(chan string, 2)
+	proceed := make(chan struct{})
+	d := newKubernetesDialer(nil)
+	d.dial = func(config *rest.Config, namespace, pod string) (httpstream.Connection, error) {
+		if pod == "slow" {
+			dialing <- pod
+			<-proceed
+		}
+		conn := newFakeConnection()
+		mu.Lock()
+		conns = append(conns, conn)
+		mu.Unlock()
+		return conn, nil
+	}
+
+	// two connections to a pod that takes a while to dial
+	slow := podPort{namespace: "default", pod: "slow", port: 80}
+	results := make(chan error, 2)
+	for n := 0; n < 2; n++ {
+		go func() {
+			_, err := d.forward(nil, slow)
+			results <- err
+		}()
+	}
+	<-dialing
+	<-dialing
+
+	// don't hold up connections to other pods
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.forward(nil, podPort{namespace: "default", pod: "fast", port: 80})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dialing one pod held up another")
+	}
+
+	close(proceed)
+	for n := 0; n < 2; n++ {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only one of the port-forwards to the slow pod is kept, and
+	// both connections go over it
+	mu.Lock()
+	defer mu.Unlock()
+	var kept, closed int
+	for _, conn := range conns[1:] {
+		select {
+		case <-conn.closed:
+			closed++
+		default:
+			kept++
+			if len(conn.requests) != 2 {
+				t.Errorf("expected both connections on the kept port-forward, got %v", conn.requests)
+			}
+		}
+	}
+	if len(conns) != 3 || kept != 1 || closed != 1 {
+		t.Errorf("expected one port-forward kept and one closed, got %d kept and %d closed of %d", kept, closed, len(conns))
+	}
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// These are just enough of the prometheus metric types to describe
+// the proxy, written out in the prometheus text format. Every metric
+// has a fixed set of labels, and each combination of label values
+// gets its own series.
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// labelString renders label names and values as {name="value",...}.
+func labelString(names, values []string, extra ...string) string {
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%s", name, strconv.Quote(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%s", extra[i], strconv.Quote(extra[i+1])))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// a valueVec is a counter or gauge.
+type valueVec struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func newValueVec(kind, name, help string, labels ...string) *valueVec {
+	return &valueVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]float64),
+		keys:   make(map[string][]string),
+	}
+}
+
+func (v *valueVec) add(delta float64, values ...string) {
+	key := strings.Join(values, "\x00")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[key] += delta
+	v.keys[key] = values
+}
+
+func (v *valueVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	for _, key := range sortedKeys(v.keys) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, labelString(v.labels, v.keys[key]), formatFloat(v.values[key]))
+	}
+}
+
+// buckets are the upper bounds, in seconds, of the latency histograms.
+var buckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*histogram
+	keys   map[string][]string
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*histogram),
+		keys:   make(map[string][]string),
+	}
+}
+
+func (h *histogramVec) observe(value float64, values ...string) {
+	key := strings.Join(values, "\x00")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(buckets))}
+		h.series[key] = s
+		h.keys[key] = values
+	}
+	for i, bound := range buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.keys) {
+		s, values := h.series[key], h.keys[key]
+		for i, bound := range buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, values, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelString(h.labels, values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, values), s.count)
+	}
+}
+
+func sortedKeys(keys map[string][]string) []string {
+	result := make([]string, 0, len(keys))
+	for key := range keys {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
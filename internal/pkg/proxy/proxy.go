@@ -1,26 +1,106 @@
 package proxy
 
 import (
+	"context"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/datawire/teleproxy/pkg/tpu"
-	"golang.org/x/net/proxy"
 )
 
+// A Router returns where an intercepted connection was headed, and
+// the name of the dialer to get there with. An empty dialer name
+// means the DefaultDialer.
+type Router func(*net.TCPConn) (host, dialer string, err error)
+
 type Proxy struct {
 	listener net.Listener
-	router   func(*net.TCPConn) (string, error)
+	router   Router
+
+	// UDPIdleTimeout is how long a udp flow may go without a
+	// datagram in either direction before it is forgotten.
+	UDPIdleTimeout time.Duration
+
+	// Tracker keeps track of the connections the proxy handles.
+	Tracker *Tracker
+
+	// ServiceName, if set, returns the name that an address
+	// resolves to, so that connections can be labeled with it.
+	ServiceName func(ip string) string
+
+	mu      sync.RWMutex
+	dialers map[string]Dialer
+
+	// stopping is closed by Stop. Until then, handlers counts the
+	// connections and flows being handled, and active holds what
+	// must be closed to cut them off.
+	stopping  chan struct{}
+	handlers  sync.WaitGroup
+	active    map[io.Closer]struct{}
+	udpConns  []*net.UDPConn
+	stateLock sync.Mutex
 }
 
-func NewProxy(address string, router func(*net.TCPConn) (string, error)) (proxy *Proxy, err error) {
+// NewProxy creates a Proxy with the DefaultDialer going through the
+// ssh tunnel's socks proxy and the DirectDialer connecting directly.
+// Use SetDialer to change those or add more.
+func NewProxy(address string, router Router) (*Proxy, error) {
 	tpu.Rlimit()
-	ln, err := net.Listen("tcp", ":1234")
-	if err == nil {
-		proxy = &Proxy{ln, router}
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
 	}
-	return
+	p, err := newProxy(ln, router)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// newProxy creates a Proxy that accepts connections on ln, which may
+// be nil for a Proxy that only does udp.
+func newProxy(ln net.Listener, router Router) (*Proxy, error) {
+	// setting up an ssh tunnel with dynamic socks proxy at this end
+	// seems faster than connecting directly to a socks proxy
+	socks, err := newSOCKSDialer(defaultSOCKS, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Proxy{
+		listener:       ln,
+		router:         router,
+		UDPIdleTimeout: DefaultUDPIdleTimeout,
+		Tracker:        NewTracker(),
+		dialers: map[string]Dialer{
+			DefaultDialer: socks,
+			DirectDialer:  &net.Dialer{Timeout: dialTimeout},
+		},
+		stopping: make(chan struct{}),
+		active:   make(map[io.Closer]struct{}),
+	}, nil
+}
+
+// SetDialer makes name refer to dialer.
+func (p *Proxy) SetDialer(name string, dialer Dialer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialers[name] = dialer
+}
+
+func (p *Proxy) dialer(name string) (Dialer, bool) {
+	if name == "" {
+		name = DefaultDialer
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	dialer, ok := p.dialers[name]
+	return dialer, ok
 }
 
 func (p *Proxy) log(line string, args ...interface{}) {
@@ -34,14 +114,22 @@ func (p *Proxy) Start(limit int) {
 		for {
 			conn, err := p.listener.Accept()
 			if err != nil {
+				if p.isStopping() {
+					return
+				}
 				p.log(err.Error())
 			} else {
 				switch conn := conn.(type) {
 				case *net.TCPConn:
+					if !p.begin() {
+						conn.Close()
+						return
+					}
 					p.log("CAPACITY: %v", len(sem))
 					sem.Acquire()
 					go func() {
 						defer sem.Release()
+						defer p.handlers.Done()
 						p.handleConnection(conn)
 					}()
 				default:
@@ -52,49 +140,166 @@ func (p *Proxy) Start(limit int) {
 	}()
 }
 
+// Stop stops accepting connections and udp datagrams, and waits for
+// the connections and flows that are already being handled to finish.
+// Once ctx is done, whatever is left is cut off and ctx's error is
+// returned.
+func (p *Proxy) Stop(ctx context.Context) error {
+	p.stateLock.Lock()
+	if !p.isStopping() {
+		close(p.stopping)
+	}
+	udpConns := p.udpConns
+	p.stateLock.Unlock()
+
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	// stop reading udp, but keep the sockets open so that flows
+	// can still send replies while they drain
+	for _, conn := range udpConns {
+		conn.SetReadDeadline(time.Unix(1, 0))
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		p.handlers.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+		p.log("stopped")
+	case <-ctx.Done():
+		err = ctx.Err()
+		p.stateLock.Lock()
+		p.log("cutting off %d connections", len(p.active))
+		for c := range p.active {
+			c.Close()
+		}
+		p.stateLock.Unlock()
+	}
+	for _, conn := range udpConns {
+		conn.Close()
+	}
+	return err
+}
+
+func (p *Proxy) isStopping() bool {
+	select {
+	case <-p.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// begin counts a new connection or flow as being handled, unless the
+// proxy is stopping. The caller must call p.handlers.Done() once it
+// is done with it.
+func (p *Proxy) begin() bool {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	if p.isStopping() {
+		return false
+	}
+	p.handlers.Add(1)
+	return true
+}
+
+// hold makes Stop close c if it runs out of time to drain, until the
+// returned function is called.
+func (p *Proxy) hold(c io.Closer) func() {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	p.active[c] = struct{}{}
+	return func() {
+		p.stateLock.Lock()
+		defer p.stateLock.Unlock()
+		delete(p.active, c)
+	}
+}
+
 func (p *Proxy) handleConnection(conn *net.TCPConn) {
-	host, err := p.router(conn)
+	defer conn.Close()
+	defer p.hold(conn)()
+
+	tracked := p.Tracker.open("tcp", conn.RemoteAddr().String())
+	defer tracked.close()
+
+	host, name, err := p.router(conn)
 	if err != nil {
 		p.log("router error: %v", err)
+		tracked.fail(err)
 		return
 	}
+	tracked.routed(host, p.serviceName(host), name)
 
-	p.log("CONNECT %s %s", conn.RemoteAddr(), host)
-
-	// setting up an ssh tunnel with dynamic socks proxy at this end
-	// seems faster than connecting directly to a socks proxy
-	dialer, err := proxy.SOCKS5("tcp", "localhost:1080", nil, proxy.Direct)
-	//	dialer, err := proxy.SOCKS5("tcp", "localhost:9050", nil, proxy.Direct)
-	if err != nil {
-		p.log(err.Error())
-		conn.Close()
+	dialer, ok := p.dialer(name)
+	if !ok {
+		p.log("unknown dialer %q for %s", name, host)
+		tracked.fail(errors.Errorf("unknown dialer %q", name))
 		return
 	}
 
-	_proxy, err := dialer.Dial("tcp", host)
+	p.log("CONNECT %s %s via %s", conn.RemoteAddr(), host, dialerName(name))
+
+	start := time.Now()
+	proxy, err := dialer.Dial("tcp", host)
+	tracked.dialing(start, err)
 	if err != nil {
 		p.log(err.Error())
-		conn.Close()
 		return
 	}
-	proxy := _proxy.(*net.TCPConn)
+	defer proxy.Close()
+	defer p.hold(proxy)()
 
 	done := tpu.NewLatch(2)
 
-	go p.pipe(conn, proxy, done)
-	go p.pipe(proxy, conn, done)
+	go p.pipe(conn, proxy, done, tracked, tracked.in)
+	go p.pipe(proxy, conn, done, tracked, tracked.out)
 
 	done.Wait()
 }
 
-func (p *Proxy) pipe(from, to *net.TCPConn, done tpu.Latch) {
+// serviceName returns the name for the address in host, if there is
+// one.
+func (p *Proxy) serviceName(host string) string {
+	if p.ServiceName == nil {
+		return ""
+	}
+	ip, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return ""
+	}
+	return p.ServiceName(ip)
+}
+
+func dialerName(name string) string {
+	if name == "" {
+		return DefaultDialer
+	}
+	return name
+}
+
+// pipe copies from one connection to the other, and then half closes
+// both so that the far end sees the eof. Not every upstream
+// connection can be half closed, those are left for the caller to
+// close once both directions are done. Whatever is copied is counted,
+// and any error is recorded against the tracked connection.
+func (p *Proxy) pipe(from, to net.Conn, done tpu.Latch, tracked *tracked, count func(int)) {
 	defer func() {
 		p.log("CLOSED WRITE %v", to.RemoteAddr())
-		to.CloseWrite()
+		if c, ok := to.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		}
 	}()
 	defer func() {
 		p.log("CLOSED READ %v", from.RemoteAddr())
-		from.CloseRead()
+		if c, ok := from.(interface{ CloseRead() error }); ok {
+			c.CloseRead()
+		}
 	}()
 	defer done.Notify()
 
@@ -105,13 +310,16 @@ func (p *Proxy) pipe(from, to *net.TCPConn, done tpu.Latch) {
 		if err != nil {
 			if err != io.EOF {
 				p.log(err.Error())
+				tracked.fail(err)
 			}
 			break
 		} else {
+			count(n)
 			_, err := to.Write(buf[0:n])
 
 			if err != nil {
 				p.log(err.Error())
+				tracked.fail(err)
 				break
 			}
 		}
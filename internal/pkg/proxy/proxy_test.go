@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleConnection(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	p, err := newProxy(nil, func(*net.TCPConn) (string, string, error) {
+		return echo.Addr().String(), DirectDialer, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		p.handleConnection(conn.(*net.TCPConn))
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("hello"))
+	client.(*net.TCPConn).CloseWrite()
+	result, err := ioutil.ReadAll(client)
+	if err != nil || string(result) != "hello" {
+		t.Errorf("got %q, %v", result, err)
+	}
+	<-done
+
+	if conns := p.Tracker.Connections(); len(conns) != 0 {
+		t.Errorf("expected no live connections, got %+v", conns)
+	}
+	var metrics bytes.Buffer
+	p.Tracker.WriteMetrics(&metrics)
+	for _, line := range []string{
+		`teleproxy_proxy_connections_total{proto="tcp",dialer="direct",result="ok"} 1`,
+		`teleproxy_proxy_active_connections{proto="tcp"} 0`,
+		`teleproxy_proxy_bytes_total{proto="tcp",dialer="direct",direction="in"} 5`,
+		`teleproxy_proxy_bytes_total{proto="tcp",dialer="direct",direction="out"} 5`,
+	} {
+		if !strings.Contains(metrics.String(), line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, metrics.String())
+		}
+	}
+}
+
+func TestStop(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newProxy(ln, func(*net.TCPConn) (string, string, error) {
+		return echo.Addr().String(), DirectDialer, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start(10)
+
+	connect := func() net.Conn {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	// a connection that finishes while stopping is let through
+	client := connect()
+	stopped := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- p.Stop(ctx)
+	}()
+	select {
+	case err := <-stopped:
+		t.Fatalf("stopped before the connection was done: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	client.Write([]byte("pong"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "pong" {
+		t.Errorf("got %q, %v", buf, err)
+	}
+	client.Close()
+	if err := <-stopped; err != nil {
+		t.Errorf("stop: %v", err)
+	}
+
+	// and no new ones are accepted
+	if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("connected after stopping")
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newProxy(ln, func(*net.TCPConn) (string, string, error) {
+		return echo.Addr().String(), DirectDialer, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start(10)
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// a connection that outlasts the deadline is cut off
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := p.Stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(buf); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestNewProxyAddress(t *testing.T) {
+	p, err := NewProxy("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop(context.Background())
+	if addr := p.listener.Addr().(*net.TCPAddr); !addr.IP.IsLoopback() || addr.Port == 1234 {
+		t.Errorf("expected to listen on an ephemeral loopback port, got %v", addr)
+	}
+}
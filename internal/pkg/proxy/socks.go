@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+
+	"github.com/datawire/teleproxy/internal/pkg/socks"
+)
+
+// A socksDialer connects through a socks5 proxy. Tcp connections are
+// made with golang.org/x/net/proxy, which doesn't do udp, so udp
+// associations are made here.
+type socksDialer struct {
+	tcp     proxy.Dialer
+	address string
+	auth    *proxy.Auth
+}
+
+func newSOCKSDialer(address string, auth *proxy.Auth) (*socksDialer, error) {
+	tcp, err := proxy.SOCKS5("tcp", address, auth, &net.Dialer{Timeout: dialTimeout})
+	if err != nil {
+		return nil, err
+	}
+	return &socksDialer{tcp: tcp, address: address, auth: auth}, nil
+}
+
+func (d *socksDialer) Dial(network, address string) (net.Conn, error) {
+	if strings.HasPrefix(network, "udp") {
+		return d.dialUDP(address)
+	}
+	return d.tcp.Dial(network, address)
+}
+
+// dialUDP asks the proxy to relay udp, and returns a connection that
+// exchanges datagrams with address through the relay. The relay
+// lasts as long as the connection the association was asked for on,
+// so both are closed together.
+func (d *socksDialer) dialUDP(address string) (net.Conn, error) {
+	header, err := socks.EncodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl, err := net.DialTimeout("tcp", d.address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	relay, err := d.associate(ctrl)
+	if err != nil {
+		ctrl.Close()
+		return nil, errors.Wrapf(err, "socks udp associate via %s", d.address)
+	}
+	conn, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	// reserved, fragment, and then the address
+	header = append([]byte{0, 0, 0}, header...)
+	return &socksUDPConn{UDPConn: conn, ctrl: ctrl, header: header}, nil
+}
+
+// associate does the socks handshake on ctrl, and returns where the
+// proxy relays udp.
+func (d *socksDialer) associate(ctrl net.Conn) (*net.UDPAddr, error) {
+	methods := []byte{socks.NoAuth}
+	if d.auth != nil {
+		methods = append(methods, socks.UserPassword)
+	}
+	greeting := append([]byte{socks.Version, byte(len(methods))}, methods...)
+	if _, err := ctrl.Write(greeting); err != nil {
+		return nil, err
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(ctrl, choice[:]); err != nil {
+		return nil, err
+	}
+	switch {
+	case choice[1] == socks.NoAuth:
+	case choice[1] == socks.UserPassword && d.auth != nil:
+		if len(d.auth.User) > 255 || len(d.auth.Password) > 255 {
+			return nil, errors.New("user or password too long")
+		}
+		login := []byte{socks.UserPasswordVersion, byte(len(d.auth.User))}
+		login = append(login, d.auth.User...)
+		login = append(login, byte(len(d.auth.Password)))
+		login = append(login, d.auth.Password...)
+		if _, err := ctrl.Write(login); err != nil {
+			return nil, err
+		}
+		var status [2]byte
+		if _, err := io.ReadFull(ctrl, status[:]); err != nil {
+			return nil, err
+		}
+		if status[1] != socks.Succeeded {
+			return nil, errors.New("authentication failed")
+		}
+	default:
+		return nil, errors.New("no acceptable authentication method")
+	}
+
+	// we don't know which address we'll send from, so let the
+	// proxy take whichever one the first datagram comes from
+	request := []byte{socks.Version, socks.UDPAssociate, 0, socks.IPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := ctrl.Write(request); err != nil {
+		return nil, err
+	}
+	var reply [3]byte
+	if _, err := io.ReadFull(ctrl, reply[:]); err != nil {
+		return nil, err
+	}
+	if reply[1] != socks.Succeeded {
+		return nil, errors.Errorf("failed with status %d", reply[1])
+	}
+	host, port, err := socks.ReadAddress(ctrl)
+	if err != nil {
+		return nil, err
+	}
+
+	relay := &net.UDPAddr{IP: net.ParseIP(host), Port: port}
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		// the relay is on the same host as the proxy
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+	return relay, nil
+}
+
+// A socksUDPConn exchanges datagrams with one address through a socks
+// udp relay.
+type socksUDPConn struct {
+	*net.UDPConn
+	ctrl   net.Conn
+	header []byte
+}
+
+func (c *socksUDPConn) Write(b []byte) (int, error) {
+	_, err := c.UDPConn.Write(append(c.header[:len(c.header):len(c.header)], b...))
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socksUDPConn) Read(b []byte) (int, error) {
+	buf := make([]byte, len(b)+len(c.header)+256)
+	for {
+		n, err := c.UDPConn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		payload, ok := socksPayload(buf[:n])
+		if !ok {
+			// fragments and garbage get dropped
+			continue
+		}
+		return copy(b, payload), nil
+	}
+}
+
+func (c *socksUDPConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
+
+// socksPayload strips the header from a datagram from a socks relay.
+func socksPayload(datagram []byte) ([]byte, bool) {
+	if len(datagram) < 4 || datagram[2] != 0 {
+		return nil, false
+	}
+	r := bytes.NewReader(datagram[3:])
+	if _, _, err := socks.ReadAddress(r); err != nil {
+		return nil, false
+	}
+	return datagram[len(datagram)-r.Len():], true
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Connection describes a proxied tcp connection or udp flow. BytesIn
+// counts what the client sent, and BytesOut what it was sent back.
+type Connection struct {
+	ID          uint64    `json:"id"`
+	Proto       string    `json:"proto"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination,omitempty"`
+	Service     string    `json:"service,omitempty"`
+	Dialer      string    `json:"dialer,omitempty"`
+	Start       time.Time `json:"start"`
+	Duration    float64   `json:"duration"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// A Tracker keeps track of the connections a Proxy handles: which
+// ones are open right now, and metrics about all of them. The dial
+// and first byte latencies are kept apart so that a slow tunnel can
+// be told from a slow service.
+type Tracker struct {
+	mu     sync.Mutex
+	nextID uint64
+	live   map[uint64]*tracked
+
+	connections *valueVec
+	active      *valueVec
+	bytes       *valueVec
+	dial        *histogramVec
+	firstByte   *histogramVec
+	duration    *histogramVec
+}
+
+// NewTracker creates an empty Tracker.
+func NewTracker() *Tracker {
+	return &Tracker{
+		live: make(map[uint64]*tracked),
+		connections: newValueVec("counter", "teleproxy_proxy_connections_total",
+			"Proxied connections and udp flows that have ended.", "proto", "dialer", "result"),
+		active: newValueVec("gauge", "teleproxy_proxy_active_connections",
+			"Proxied connections and udp flows that are open.", "proto"),
+		bytes: newValueVec("counter", "teleproxy_proxy_bytes_total",
+			"Bytes proxied, in from clients and out to them.", "proto", "dialer", "direction"),
+		dial: newHistogramVec("teleproxy_proxy_dial_duration_seconds",
+			"How long connecting upstream took.", "proto", "dialer"),
+		firstByte: newHistogramVec("teleproxy_proxy_first_byte_seconds",
+			"How long after connecting upstream the first reply arrived.", "proto", "dialer"),
+		duration: newHistogramVec("teleproxy_proxy_connection_duration_seconds",
+			"How long proxied connections and udp flows lasted.", "proto", "dialer"),
+	}
+}
+
+// Connections returns the connections that are open right now, oldest
+// first.
+func (t *Tracker) Connections() []Connection {
+	t.mu.Lock()
+	live := make([]*tracked, 0, len(t.live))
+	for _, c := range t.live {
+		live = append(live, c)
+	}
+	t.mu.Unlock()
+
+	now := time.Now()
+	result := make([]Connection, 0, len(live))
+	for _, c := range live {
+		result = append(result, c.snapshot(now))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// WriteMetrics writes the metrics in the prometheus text format.
+func (t *Tracker) WriteMetrics(w io.Writer) {
+	for _, m := range []metric{t.connections, t.active, t.bytes, t.dial, t.firstByte, t.duration} {
+		m.write(w)
+	}
+}
+
+// A tracked connection is one that the Tracker knows about.
+type tracked struct {
+	tracker *Tracker
+
+	mu      sync.Mutex
+	c       Connection
+	dialed  time.Time
+	replied bool
+}
+
+// open starts tracking a connection from source.
+func (t *Tracker) open(proto, source string) *tracked {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	c := &tracked{
+		tracker: t,
+		c:       Connection{ID: t.nextID, Proto: proto, Source: source, Start: time.Now()},
+	}
+	t.live[c.c.ID] = c
+	t.active.add(1, proto)
+	return c
+}
+
+// routed records where the connection is going.
+func (c *tracked) routed(destination, service, dialer string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.c.Destination = destination
+	c.c.Service = service
+	c.c.Dialer = dialerName(dialer)
+}
+
+// dialing records how long connecting upstream took.
+func (c *tracked) dialing(start time.Time, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.c.Error = err.Error()
+		return
+	}
+	c.dialed = time.Now()
+	c.tracker.dial.observe(c.dialed.Sub(start).Seconds(), c.c.Proto, dialerName(c.c.Dialer))
+}
+
+// in counts bytes from the client.
+func (c *tracked) in(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.c.BytesIn += uint64(n)
+	c.tracker.bytes.add(float64(n), c.c.Proto, dialerName(c.c.Dialer), "in")
+}
+
+// out counts bytes to the client.
+func (c *tracked) out(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.replied && !c.dialed.IsZero() {
+		c.replied = true
+		c.tracker.firstByte.observe(time.Since(c.dialed).Seconds(), c.c.Proto, dialerName(c.c.Dialer))
+	}
+	c.c.BytesOut += uint64(n)
+	c.tracker.bytes.add(float64(n), c.c.Proto, dialerName(c.c.Dialer), "out")
+}
+
+// fail records what went wrong, unless something already did.
+func (c *tracked) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.c.Error == "" {
+		c.c.Error = err.Error()
+	}
+}
+
+// close stops tracking the connection.
+func (c *tracked) close() {
+	t := c.tracker
+	t.mu.Lock()
+	delete(t.live, c.c.ID)
+	t.mu.Unlock()
+
+	final := c.snapshot(time.Now())
+	result := "ok"
+	if final.Error != "" {
+		result = "error"
+	}
+	dialer := dialerName(final.Dialer)
+	t.active.add(-1, final.Proto)
+	t.connections.add(1, final.Proto, dialer, result)
+	t.duration.observe(final.Duration, final.Proto, dialer)
+}
+
+func (c *tracked) snapshot(now time.Time) Connection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := c.c
+	result.Duration = now.Sub(result.Start).Seconds()
+	return result
+}
@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A UDPRouter returns where a datagram from src, that was redirected
+// to local, was originally headed, and the name of the dialer to get
+// there with.
+type UDPRouter func(src, local *net.UDPAddr) (host, dialer string, err error)
+
+const (
+	// DefaultUDPIdleTimeout is how long a udp flow may be idle
+	// unless the Proxy's UDPIdleTimeout says otherwise.
+	DefaultUDPIdleTimeout = time.Minute
+
+	// udpDrainTimeout is how long a flow may be idle once the
+	// proxy is stopping.
+	udpDrainTimeout = time.Second
+
+	// udpBacklog is how many datagrams may wait for a flow's
+	// upstream before more are dropped.
+	udpBacklog = 64
+
+	maxDatagram = 64 * 1024
+)
+
+// ListenUDP relays the udp datagrams redirected to address. Since
+// udp has no connections, datagrams are grouped into flows by where
+// they come from, and each flow gets its own upstream connection from
+// the dialer the router picks for its first datagram. Replies are
+// sent back from address, which the nat turns back into the original
+// destination. A flow ends once it has been idle for UDPIdleTimeout.
+func (p *Proxy) ListenUDP(address string, router UDPRouter) error {
+	laddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+	p.stateLock.Lock()
+	p.udpConns = append(p.udpConns, conn)
+	p.stateLock.Unlock()
+	p.log("listening udp %v", conn.LocalAddr())
+	go p.serveUDP(conn, router)
+	return nil
+}
+
+// A udpFlow is the datagrams from one source.
+type udpFlow struct {
+	src      *net.UDPAddr
+	incoming chan []byte
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (f *udpFlow) touch() {
+	f.mu.Lock()
+	f.last = time.Now()
+	f.mu.Unlock()
+}
+
+func (f *udpFlow) idle() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Since(f.last)
+}
+
+func (p *Proxy) serveUDP(conn *net.UDPConn, router UDPRouter) {
+	var mu sync.Mutex
+	flows := make(map[string]*udpFlow)
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if !p.isStopping() {
+				p.log(err.Error())
+			}
+			return
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+
+		key := src.String()
+		mu.Lock()
+		flow, ok := flows[key]
+		if !ok {
+			if !p.begin() {
+				mu.Unlock()
+				return
+			}
+			flow = &udpFlow{src: src, incoming: make(chan []byte, udpBacklog), last: time.Now()}
+			flows[key] = flow
+			// a flow is only removed while nothing is
+			// waiting for it, so that nothing queued for it
+			// gets lost
+			remove := func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				if len(flow.incoming) > 0 {
+					return false
+				}
+				delete(flows, key)
+				return true
+			}
+			go func() {
+				defer p.handlers.Done()
+				p.handleFlow(conn, flow, router, remove)
+			}()
+		}
+		select {
+		case flow.incoming <- datagram:
+		default:
+			p.log("UDP %v: backlog full, dropping datagram", src)
+		}
+		mu.Unlock()
+	}
+}
+
+// dialFlow finds out where flow is headed and connects there. If that
+// fails, it says why once, and returns a nil upstream.
+func (p *Proxy) dialFlow(conn *net.UDPConn, flow *udpFlow, router UDPRouter, tracked *tracked) (upstream net.Conn, host string) {
+	host, name, err := router(flow.src, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		p.log("router error: %v", err)
+		tracked.fail(err)
+		return nil, ""
+	}
+	tracked.routed(host, p.serviceName(host), name)
+
+	dialer, ok := p.dialer(name)
+	if !ok {
+		p.log("unknown dialer %q for %s", name, host)
+		tracked.fail(errors.Errorf("unknown dialer %q", name))
+		return nil, host
+	}
+
+	p.log("UDP %s %s via %s", flow.src, host, dialerName(name))
+
+	start := time.Now()
+	upstream, err = dialer.Dial("udp", host)
+	tracked.dialing(start, err)
+	if err != nil {
+		p.log(err.Error())
+		return nil, host
+	}
+	return upstream, host
+}
+
+// handleFlow relays flow until it goes idle and remove takes it out
+// of the proxy's flows. A flow that can't be relayed drops what is
+// sent to it instead, so that a source that keeps sending doesn't
+// make a new flow, and a new error, for every datagram.
+func (p *Proxy) handleFlow(conn *net.UDPConn, flow *udpFlow, router UDPRouter, remove func() bool) {
+	tracked := p.Tracker.open("udp", flow.src.String())
+	defer tracked.close()
+
+	upstream, host := p.dialFlow(conn, flow, router, tracked)
+	if upstream != nil {
+		defer upstream.Close()
+		defer p.hold(upstream)()
+
+		go func() {
+			buf := make([]byte, maxDatagram)
+			for {
+				n, err := upstream.Read(buf)
+				if err != nil {
+					// closing upstream is how the
+					// flow ends, so that isn't worth
+					// logging
+					return
+				}
+				flow.touch()
+				tracked.out(n)
+				if _, err := conn.WriteToUDP(buf[:n], flow.src); err != nil {
+					p.log(err.Error())
+				}
+			}
+		}()
+	}
+
+	// stopping wakes the flow up to shorten its timeout, and is
+	// then set to nil, since a closed channel would wake it up
+	// over and over
+	stopping := p.stopping
+	for {
+		// once the proxy is stopping, a flow only waits long
+		// enough for the replies to what it already sent
+		timeout := p.UDPIdleTimeout
+		if p.isStopping() {
+			stopping = nil
+			if timeout > udpDrainTimeout {
+				timeout = udpDrainTimeout
+			}
+		}
+		idle := flow.idle()
+		if idle >= timeout {
+			if remove() {
+				if upstream != nil {
+					p.log("UDP %s %s idle, closing", flow.src, host)
+				}
+				return
+			}
+			// a datagram came in just now
+			idle = 0
+		}
+		select {
+		case datagram := <-flow.incoming:
+			flow.touch()
+			if upstream == nil {
+				continue
+			}
+			tracked.in(len(datagram))
+			if _, err := upstream.Write(datagram); err != nil {
+				p.log(err.Error())
+				tracked.fail(err)
+			}
+		case <-time.After(timeout - idle):
+		case <-stopping:
+		}
+	}
+}
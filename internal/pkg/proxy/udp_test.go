@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// udpEcho starts a server that sends every datagram back to where it
+// came from, and returns its address.
+func udpEcho(t *testing.T) (*net.UDPAddr, func()) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr), func() { conn.Close() }
+}
+
+func TestUDP(t *testing.T) {
+	echo, stop := udpEcho(t)
+	defer stop()
+
+	routed := make(chan *net.UDPAddr, 10)
+	p, err := newProxy(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.UDPIdleTimeout = 100 * time.Millisecond
+	p.ServiceName = func(ip string) string { return "echo.default.svc.cluster.local" }
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go p.serveUDP(conn, func(src, local *net.UDPAddr) (string, string, error) {
+		routed <- src
+		return echo.String(), DirectDialer, nil
+	})
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	exchange := func(message string) {
+		if _, err := client.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil || string(buf[:n]) != message {
+			t.Fatalf("got %q, %v", buf[:n], err)
+		}
+	}
+
+	// datagrams from the same source share a flow
+	exchange("one")
+	exchange("two")
+	if len(routed) != 1 {
+		t.Errorf("expected one flow, got %d", len(routed))
+	}
+	conns := p.Tracker.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("expected one live flow, got %+v", conns)
+	}
+	c := conns[0]
+	if c.Proto != "udp" || c.Destination != echo.String() || c.Service != "echo.default.svc.cluster.local" ||
+		c.Dialer != DirectDialer || c.BytesIn != 6 || c.BytesOut != 6 {
+		t.Errorf("unexpected flow: %+v", c)
+	}
+
+	// once the flow has been idle for long enough, the next
+	// datagram starts a new one
+	time.Sleep(300 * time.Millisecond)
+	exchange("three")
+	if len(routed) != 2 {
+		t.Errorf("expected two flows, got %d", len(routed))
+	}
+
+	var metrics bytes.Buffer
+	p.Tracker.WriteMetrics(&metrics)
+	for _, line := range []string{
+		`teleproxy_proxy_connections_total{proto="udp",dialer="direct",result="ok"} 1`,
+		`teleproxy_proxy_active_connections{proto="udp"} 1`,
+		`teleproxy_proxy_bytes_total{proto="udp",dialer="direct",direction="in"} 11`,
+		`teleproxy_proxy_dial_duration_seconds_count{proto="udp",dialer="direct"} 2`,
+		`teleproxy_proxy_first_byte_seconds_bucket{proto="udp",dialer="direct",le="+Inf"} 2`,
+	} {
+		if !strings.Contains(metrics.String(), line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, metrics.String())
+		}
+	}
+}
+
+func TestStopUDP(t *testing.T) {
+	echo, stop := udpEcho(t)
+	defer stop()
+
+	p, err := newProxy(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ListenUDP("127.0.0.1:0", func(src, local *net.UDPAddr) (string, string, error) {
+		return echo.String(), DirectDialer, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	listener := p.udpConns[0].LocalAddr().(*net.UDPAddr)
+
+	client, err := net.DialUDP("udp", nil, listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("ping"))
+	buf := make([]byte, 64)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// flows don't get to wait out the whole idle timeout
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*udpDrainTimeout {
+		t.Errorf("stopping took %v", elapsed)
+	}
+	if conns := p.Tracker.Connections(); len(conns) != 0 {
+		t.Errorf("expected no live flows, got %+v", conns)
+	}
+}
+
+func TestUDPRouterFailure(t *testing.T) {
+	var routed int32
+	p, err := newProxy(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.UDPIdleTimeout = 200 * time.Millisecond
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go p.serveUDP(conn, func(src, local *net.UDPAddr) (string, string, error) {
+		atomic.AddInt32(&routed, 1)
+		return "", "", errors.New("no route")
+	})
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// the failed flow soaks up what follows, rather than failing
+	// again for every datagram
+	for n := 0; n < 5; n++ {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&routed); n != 1 {
+		t.Errorf("expected one route lookup, got %d", n)
+	}
+
+	// once it has gone idle, the source gets a new flow
+	time.Sleep(2 * p.UDPIdleTimeout)
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&routed) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&routed); n != 2 {
+		t.Errorf("expected a new flow after the idle timeout, got %d lookups", n)
+	}
+}
@@ -1,27 +1,225 @@
 package route
 
 import (
+	"bytes"
+	"net"
+	"strconv"
 	"strings"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
 )
 
+// Table is a named set of routes. When tables disagree about a name
+// or an address, the table with the higher Priority wins, and tables
+// with the same Priority are ordered by Name.
+//
+// A table with a TTL (in seconds) is a lease: unless it is posted
+// again within that many seconds, it is removed as if it had been
+// deleted. A TTL of zero means the table never expires.
+//
+// The Dialer names how the proxy connects onward for traffic the
+// table intercepts, e.g. "direct" or "kubernetes". Empty means the
+// default dialer.
+//
+// The Version goes up every time the table changes. A table that is
+// posted with a Version only replaces one that still has that
+// Version, so that several writers can't undo each other's changes.
 type Table struct {
-	Name   string  `json:"name"`
-	Routes []Route `json:"routes"`
+	Name     string  `json:"name"`
+	Priority int     `json:"priority,omitempty"`
+	TTL      int     `json:"ttl,omitempty"`
+	Dialer   string  `json:"dialer,omitempty"`
+	Version  uint64  `json:"version,omitempty"`
+	Routes   []Route `json:"routes"`
 }
 
 func (t *Table) Add(route Route) {
 	t.Routes = append(t.Routes, route)
 }
 
+// Validate checks that the table's TTL and routes are well formed.
+func (t Table) Validate() error {
+	if t.TTL < 0 {
+		return errors.Errorf("table %s: bad ttl: %d", t.Name, t.TTL)
+	}
+	for _, r := range t.Routes {
+		if err := r.Validate(); err != nil {
+			return errors.Wrapf(err, "table %s", t.Name)
+		}
+	}
+	return nil
+}
+
+// ParseTables parses a list of tables, or a single table, written in
+// YAML or JSON. An empty document has no tables, and unknown fields
+// are errors so that typos don't go unnoticed.
+func ParseTables(data []byte) ([]Table, error) {
+	data, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	var tables []Table
+	if bytes.Equal(data, []byte("null")) {
+		return nil, nil
+	} else if bytes.HasPrefix(data, []byte("[")) {
+		err = yaml.UnmarshalStrict(data, &tables)
+	} else {
+		var table Table
+		err = yaml.UnmarshalStrict(data, &table)
+		tables = append(tables, table)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+// A Patch changes some of the routes in a table rather than replacing
+// all of them. The routes matching Remove are removed first, and then
+// the routes in Add are added. Remove holds route keys, which remove
+// every route with that name, or addresses, which remove just the
+// route for that proto:ip:port. If the Version is set, the patch only
+// applies to that version of the table.
+type Patch struct {
+	Version uint64   `json:"version,omitempty"`
+	Remove  []string `json:"remove,omitempty"`
+	Add     []Route  `json:"add,omitempty"`
+}
+
+// Apply returns the table with the patch applied. The table itself
+// is left alone.
+func (t Table) Apply(p Patch) Table {
+	remove := make(map[string]bool, len(p.Remove))
+	for _, key := range p.Remove {
+		remove[key] = true
+	}
+	routes := make([]Route, 0, len(t.Routes)+len(p.Add))
+	for _, r := range t.Routes {
+		if !remove[r.Key()] && !remove[r.Address()] {
+			routes = append(routes, r)
+		}
+	}
+	t.Routes = append(routes, p.Add...)
+	return t
+}
+
+// Route describes a destination to intercept. The Ip may be a single
+// address or a CIDR such as "10.96.0.0/12". The Port may be empty
+// (meaning all ports), or a comma separated list of ports and port
+// ranges, e.g. "80,443,8000-9000".
+//
+// Several routes in a table may share a Name, in which case the name
+// resolves to all of their addresses. A route with a CNAME makes its
+// Name an alias for another name instead, and has no Ip.
 type Route struct {
 	Name   string `json:"name,omitempty"`
-	Ip     string `json:"ip"`
+	Ip     string `json:"ip,omitempty"`
 	Proto  string `json:"proto"`
 	Port   string `json:"port,omitempty"`
 	Target string `json:"target"`
 	Action string `json:"action,omitempty"`
+	CNAME  string `json:"cname,omitempty"`
+	SRV    []SRV  `json:"srv,omitempty"`
+}
+
+// SRV describes a named port that is published as an SRV record,
+// e.g. the "http" service over "tcp" on a route named
+// foo.ns.svc.cluster.local is published as
+// _http._tcp.foo.ns.svc.cluster.local.
+type SRV struct {
+	Service string `json:"service"`
+	Proto   string `json:"proto"`
+	Port    int    `json:"port"`
+}
+
+// Domain returns the fully qualified name of the SRV record.
+func (s SRV) Domain(r Route) string {
+	return strings.ToLower("_" + s.Service + "._" + s.Proto + "." + r.Name + ".")
 }
 
 func (r Route) Domain() string {
 	return strings.ToLower(r.Name + ".")
 }
+
+// IsCIDR returns true if the route covers a whole network rather
+// than a single address.
+func (r Route) IsCIDR() bool {
+	return strings.Contains(r.Ip, "/")
+}
+
+// Key names the route. Named routes go by their name, and unnamed
+// routes (which are typically CIDRs) by their Address. Since a name
+// may have several routes, e.g. one per address, the key of a named
+// route isn't unique within its table.
+func (r Route) Key() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Address()
+}
+
+// Address identifies what the route intercepts as proto:ip:port.
+func (r Route) Address() string {
+	return r.Proto + ":" + r.Ip + ":" + r.Port
+}
+
+// Validate checks that the route's Ip and Port are well formed.
+func (r Route) Validate() error {
+	for _, srv := range r.SRV {
+		if r.Name == "" || srv.Service == "" || (srv.Proto != "tcp" && srv.Proto != "udp") {
+			return errors.Errorf("route %s: bad srv: %+v", r.Key(), srv)
+		}
+		if srv.Port < 1 || srv.Port > 65535 {
+			return errors.Errorf("route %s: bad srv port: %d", r.Key(), srv.Port)
+		}
+	}
+
+	if r.CNAME != "" {
+		if r.Name == "" || r.Ip != "" || r.Target != "" {
+			return errors.Errorf("route %s: cname routes need a name and no ip or target", r.Key())
+		}
+		return nil
+	}
+
+	if r.IsCIDR() {
+		if _, _, err := net.ParseCIDR(r.Ip); err != nil {
+			return errors.Errorf("route %s: bad cidr: %q", r.Key(), r.Ip)
+		}
+		if r.Name != "" {
+			return errors.Errorf("route %s: cidr routes cannot be named", r.Key())
+		}
+	} else if net.ParseIP(r.Ip) == nil {
+		return errors.Errorf("route %s: bad ip: %q", r.Key(), r.Ip)
+	}
+
+	if r.Port == "" {
+		return nil
+	}
+	for _, part := range strings.Split(r.Port, ",") {
+		if _, _, err := ParsePortRange(part); err != nil {
+			return errors.Wrapf(err, "route %s", r.Key())
+		}
+	}
+	return nil
+}
+
+// ParsePortRange parses a single port ("80") or an inclusive port
+// range ("8000-9000") and returns its bounds.
+func ParsePortRange(spec string) (from, to uint16, err error) {
+	spec = strings.TrimSpace(spec)
+	parts := strings.SplitN(spec, "-", 2)
+	lo, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil || lo == 0 {
+		return 0, 0, errors.Errorf("bad port: %q", spec)
+	}
+	hi := lo
+	if len(parts) == 2 {
+		hi, err = strconv.ParseUint(parts[1], 10, 16)
+		if err != nil || hi < lo {
+			return 0, 0, errors.Errorf("bad port range: %q", spec)
+		}
+	}
+	return uint16(lo), uint16(hi), nil
+}
@@ -43,3 +43,123 @@ func TestDecode(t *testing.T) {
 		}
 	}
 }
+
+var routes = []struct {
+	route Route
+	err   string
+}{
+	{Route{Name: "foo", Ip: "192.0.2.1", Proto: "tcp"}, ""},
+	{Route{Name: "foo", Ip: "2001:db8::1", Proto: "tcp", Port: "80,443"}, ""},
+	{Route{Ip: "10.96.0.0/12", Proto: "tcp", Port: "80,8000-9000"}, ""},
+	{Route{Ip: "fd00::/108", Proto: "udp"}, ""},
+	{Route{Name: "foo", Ip: "bar", Proto: "tcp"}, `route foo: bad ip: "bar"`},
+	{Route{Ip: "10.96.0.0/33", Proto: "tcp"}, `route tcp:10.96.0.0/33:: bad cidr: "10.96.0.0/33"`},
+	{Route{Name: "foo", Ip: "10.96.0.0/12", Proto: "tcp"}, `route foo: cidr routes cannot be named`},
+	{Route{Name: "foo", Ip: "192.0.2.1", Proto: "tcp", Port: "0"}, `route foo: bad port: "0"`},
+	{Route{Name: "foo", Ip: "192.0.2.1", Proto: "tcp", Port: "80,x"}, `route foo: bad port: "x"`},
+	{Route{Name: "foo", Ip: "192.0.2.1", Proto: "tcp", Port: "9000-8000"}, `route foo: bad port range: "9000-8000"`},
+	{Route{Name: "foo", CNAME: "bar.example.com"}, ""},
+	{Route{Name: "foo", Ip: "192.0.2.1", CNAME: "bar.example.com"}, `route foo: cname routes need a name and no ip or target`},
+	{Route{Name: "foo", Ip: "192.0.2.1", Proto: "tcp", SRV: []SRV{{"http", "tcp", 80}}}, ""},
+	{Route{Name: "foo", Ip: "192.0.2.1", Proto: "tcp", SRV: []SRV{{"http", "sctp", 80}}}, `route foo: bad srv: {Service:http Proto:sctp Port:80}`},
+	{Route{Name: "foo", Ip: "192.0.2.1", Proto: "tcp", SRV: []SRV{{"http", "tcp", 0}}}, `route foo: bad srv port: 0`},
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range routes {
+		err := tt.route.Validate()
+		actual := ""
+		if err != nil {
+			actual = err.Error()
+		}
+		if actual != tt.err {
+			t.Errorf("%v: got %q, expected %q", tt.route, actual, tt.err)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	table := Table{Name: "table", Version: 3, Routes: []Route{
+		{Name: "foo", Ip: "192.0.2.1", Proto: "tcp"},
+		{Name: "foo", Ip: "192.0.2.1", Proto: "udp"},
+		{Name: "bar", Ip: "192.0.2.2", Proto: "tcp"},
+		{Ip: "10.96.0.0/12", Proto: "tcp"},
+	}}
+	patched := table.Apply(Patch{
+		Remove: []string{"foo", "tcp:10.96.0.0/12:", "missing"},
+		Add:    []Route{{Name: "baz", Ip: "192.0.2.3", Proto: "tcp"}},
+	})
+	expected := []Route{
+		{Name: "bar", Ip: "192.0.2.2", Proto: "tcp"},
+		{Name: "baz", Ip: "192.0.2.3", Proto: "tcp"},
+	}
+	if !reflect.DeepEqual(patched.Routes, expected) {
+		t.Errorf("got %v, expected %v", patched.Routes, expected)
+	}
+	if patched.Name != "table" || patched.Version != 3 {
+		t.Errorf("expected the rest of the table to be kept, got %+v", patched)
+	}
+	if len(table.Routes) != 4 {
+		t.Errorf("the original table was modified: %v", table.Routes)
+	}
+
+	// a name may have several routes, which removing the name
+	// removes all of, while an address removes just the one
+	multi := Table{Name: "table", Routes: []Route{
+		{Name: "foo", Ip: "192.0.2.1", Proto: "tcp"},
+		{Name: "foo", Ip: "192.0.2.2", Proto: "tcp"},
+		{Name: "foo", Ip: "192.0.2.3", Proto: "tcp", Port: "80"},
+	}}
+	patched = multi.Apply(Patch{Remove: []string{"tcp:192.0.2.2:", "tcp:192.0.2.3:"}})
+	expected = []Route{
+		{Name: "foo", Ip: "192.0.2.1", Proto: "tcp"},
+		{Name: "foo", Ip: "192.0.2.3", Proto: "tcp", Port: "80"},
+	}
+	if !reflect.DeepEqual(patched.Routes, expected) {
+		t.Errorf("got %v, expected %v", patched.Routes, expected)
+	}
+	if patched = multi.Apply(Patch{Remove: []string{"foo"}}); len(patched.Routes) != 0 {
+		t.Errorf("expected every foo route to be removed, got %v", patched.Routes)
+	}
+}
+
+func TestParseTables(t *testing.T) {
+	staging := Table{Name: "staging", Routes: []Route{{Name: "db", Ip: "10.0.0.5", Proto: "tcp", Port: "5432"}}}
+	legacy := Table{Name: "legacy", Priority: 10, Routes: []Route{{Name: "vm", Ip: "10.0.0.6", Proto: "tcp"}}}
+	for _, tt := range []struct {
+		in  string
+		out []Table
+		err string
+	}{
+		{"", nil, ""},
+		{`
+name: staging
+routes:
+- {name: db, ip: 10.0.0.5, proto: tcp, port: "5432"}
+`, []Table{staging}, ""},
+		{`
+- name: staging
+  routes:
+  - name: db
+    ip: 10.0.0.5
+    proto: tcp
+    port: "5432"
+- name: legacy
+  priority: 10
+  routes:
+  - {name: vm, ip: 10.0.0.6, proto: tcp}
+`, []Table{staging, legacy}, ""},
+		{`[{"name": "staging", "routes": [{"name": "db", "ip": "10.0.0.5", "proto": "tcp", "port": "5432"}]}]`, []Table{staging}, ""},
+		{`{"name": "staging", "routes": [{"name": "db", "ip": "10.0.0.5", "target": "1234", "prot": "tcp"}]}`, nil,
+			`error unmarshaling JSON: while decoding JSON: json: unknown field "prot"`},
+	} {
+		tables, err := ParseTables([]byte(tt.in))
+		actual := ""
+		if err != nil {
+			actual = err.Error()
+		}
+		if actual != tt.err || !reflect.DeepEqual(tables, tt.out) {
+			t.Errorf("%s: got %v, %q, expected %v, %q", tt.in, tables, actual, tt.out, tt.err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Package socks has the parts of the socks5 protocol that both the
+// proxy's socks dialer and the tunnel's socks server need, see RFC
+// 1928 and RFC 1929.
+package socks
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	Version = 5
+
+	// authentication methods
+	NoAuth       = 0
+	UserPassword = 2
+	NoAcceptable = 0xff
+
+	// UserPasswordVersion is the version of the username/password
+	// authentication of RFC 1929.
+	UserPasswordVersion = 1
+
+	// commands
+	Connect      = 1
+	UDPAssociate = 3
+
+	// address types
+	IPv4   = 1
+	Domain = 3
+	IPv6   = 4
+
+	// reply statuses
+	Succeeded          = 0
+	GeneralFailure     = 1
+	CommandUnsupported = 7
+	AddressUnsupported = 8
+)
+
+// EncodeAddress encodes address, a host and port, the way socks
+// requests, replies and datagrams carry it. A host that isn't an ip
+// address is sent as a domain name.
+func EncodeAddress(address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, errors.Errorf("bad port: %q", portString)
+	}
+
+	var result []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, errors.Errorf("host name too long: %q", host)
+		}
+		result = append([]byte{Domain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		result = append([]byte{IPv4}, ip4...)
+	} else {
+		result = append([]byte{IPv6}, ip.To16()...)
+	}
+	return append(result, byte(port>>8), byte(port)), nil
+}
+
+// ReadAddress reads an encoded address.
+func ReadAddress(r io.Reader) (host string, port int, err error) {
+	var kind [1]byte
+	if _, err := io.ReadFull(r, kind[:]); err != nil {
+		return "", 0, err
+	}
+	switch kind[0] {
+	case IPv4, IPv6:
+		ip := make(net.IP, net.IPv4len)
+		if kind[0] == IPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = ip.String()
+	case Domain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", 0, err
+		}
+		host = string(name)
+	default:
+		return "", 0, errors.Errorf("unsupported socks address type: %d", kind[0])
+	}
+	var p [2]byte
+	if _, err := io.ReadFull(r, p[:]); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(p[:])), nil
+}
@@ -0,0 +1,42 @@
+package socks
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestAddress(t *testing.T) {
+	for address, kind := range map[string]byte{
+		"192.0.2.1:80":      IPv4,
+		"[2001:db8::1]:53":  IPv6,
+		"example.com:65535": Domain,
+	} {
+		encoded, err := EncodeAddress(address)
+		if err != nil {
+			t.Errorf("%s: %v", address, err)
+			continue
+		}
+		if encoded[0] != kind {
+			t.Errorf("%s: got address type %d", address, encoded[0])
+		}
+		r := bytes.NewReader(append(encoded, "payload"...))
+		host, port, err := ReadAddress(r)
+		if err != nil || net.JoinHostPort(host, strconv.Itoa(port)) != address || r.Len() != len("payload") {
+			t.Errorf("%s: got %s, %d, %v", address, host, port, err)
+		}
+	}
+
+	for _, address := range []string{"example.com", "example.com:http", "192.0.2.1:65536"} {
+		if _, err := EncodeAddress(address); err == nil {
+			t.Errorf("%s: expected an error", address)
+		}
+	}
+	if _, _, err := ReadAddress(bytes.NewReader([]byte{2, 0, 0})); err == nil {
+		t.Error("expected an error for an unknown address type")
+	}
+	if _, _, err := ReadAddress(bytes.NewReader([]byte{IPv4, 192, 0})); err == nil {
+		t.Error("expected an error for a short address")
+	}
+}
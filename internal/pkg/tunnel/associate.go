@@ -0,0 +1,159 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/internal/pkg/socks"
+)
+
+const maxDatagram = 64 * 1024
+
+// An association relays datagrams between a socks client and the
+// destinations it names, with one upstream connection per
+// destination.
+type association struct {
+	relay *net.UDPConn
+	dial  func(network, address string) (net.Conn, error)
+
+	// only the host that asked for the association may use it
+	clientIP net.IP
+
+	mu        sync.Mutex
+	client    *net.UDPAddr
+	upstreams map[string]net.Conn
+}
+
+// associate serves a UDP ASSOCIATE request that arrived on conn. The
+// relay lasts until conn is closed.
+func associate(conn net.Conn, dial func(network, address string) (net.Conn, error)) error {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	remote, ok2 := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !ok2 {
+		reply(conn, socks.GeneralFailure)
+		return errors.New("udp associate needs a tcp connection")
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		reply(conn, socks.GeneralFailure)
+		return errors.Wrap(err, "udp relay")
+	}
+	if err := replyBound(conn, socks.Succeeded, relay.LocalAddr().(*net.UDPAddr)); err != nil {
+		relay.Close()
+		return err
+	}
+
+	a := &association{
+		relay:     relay,
+		dial:      dial,
+		clientIP:  remote.IP,
+		upstreams: make(map[string]net.Conn),
+	}
+	go a.serve()
+
+	// nothing more should arrive on conn, it is only there to
+	// say when the client is done
+	io.Copy(ioutil.Discard, conn)
+	a.close()
+	return nil
+}
+
+func (a *association) serve() {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(a.clientIP) {
+			continue
+		}
+		a.mu.Lock()
+		a.client = from
+		a.mu.Unlock()
+
+		header, address, err := parseDatagram(buf[:n])
+		if err != nil {
+			log.Printf("SOCKS: %v", err)
+			continue
+		}
+		upstream, err := a.upstream(header, address)
+		if err != nil {
+			log.Printf("SOCKS: %v", err)
+			continue
+		}
+		if _, err := upstream.Write(buf[len(header):n]); err != nil {
+			log.Printf("SOCKS: %v", err)
+		}
+	}
+}
+
+// upstream returns the connection to address, dialing it if need be.
+// Datagrams that come back on it are sent to the client with the
+// same header the client used.
+func (a *association) upstream(header []byte, address string) (net.Conn, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if upstream, ok := a.upstreams[address]; ok {
+		return upstream, nil
+	}
+	if a.upstreams == nil {
+		return nil, errors.New("association closed")
+	}
+
+	upstream, err := a.dial("udp", address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "connecting to %s", address)
+	}
+	a.upstreams[address] = upstream
+
+	header = append([]byte(nil), header...)
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				return
+			}
+			a.mu.Lock()
+			client := a.client
+			a.mu.Unlock()
+			a.relay.WriteToUDP(append(header, buf[:n]...), client)
+		}
+	}()
+	return upstream, nil
+}
+
+func (a *association) close() {
+	a.relay.Close()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, upstream := range a.upstreams {
+		upstream.Close()
+	}
+	a.upstreams = nil
+}
+
+// parseDatagram splits the header off a datagram from a socks client,
+// and returns it along with the destination it names.
+func parseDatagram(datagram []byte) (header []byte, address string, err error) {
+	if len(datagram) < 4 {
+		return nil, "", errors.New("short socks datagram")
+	}
+	if datagram[2] != 0 {
+		return nil, "", errors.New("fragmented socks datagrams are not supported")
+	}
+	r := bytes.NewReader(datagram[3:])
+	host, port, err := socks.ReadAddress(r)
+	if err != nil {
+		return nil, "", err
+	}
+	return datagram[:len(datagram)-r.Len()], net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
@@ -0,0 +1,126 @@
+package tunnel
+
+import (
+	"io"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/internal/pkg/socks"
+)
+
+// ServeSOCKS accepts socks5 connections on ln and makes each of them
+// with dial, until ln is closed. Only CONNECT and UDP ASSOCIATE
+// without authentication are supported, which is all the proxy
+// needs.
+func ServeSOCKS(ln net.Listener, dial func(network, address string) (net.Conn, error)) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := serveSOCKS(conn, dial); err != nil {
+				log.Printf("SOCKS: %v", err)
+			}
+		}()
+	}
+}
+
+func serveSOCKS(conn net.Conn, dial func(network, address string) (net.Conn, error)) error {
+	defer conn.Close()
+
+	// greeting: version, then the authentication methods on offer
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[0] != socks.Version {
+		return errors.Errorf("unsupported socks version: %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	method := byte(socks.NoAcceptable)
+	for _, m := range methods {
+		if m == socks.NoAuth {
+			method = socks.NoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socks.Version, method}); err != nil {
+		return err
+	}
+	if method == socks.NoAcceptable {
+		return errors.New("client wants authentication")
+	}
+
+	// request: version, command, reserved, address
+	var request [3]byte
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return err
+	}
+	host, port, err := socks.ReadAddress(conn)
+	if err != nil {
+		reply(conn, socks.AddressUnsupported)
+		return err
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	switch request[1] {
+	case socks.Connect:
+	case socks.UDPAssociate:
+		// the address is where the client will send from,
+		// which it usually doesn't know yet
+		return associate(conn, dial)
+	default:
+		reply(conn, socks.CommandUnsupported)
+		return errors.Errorf("unsupported socks command: %d", request[1])
+	}
+
+	upstream, err := dial("tcp", address)
+	if err != nil {
+		reply(conn, socks.GeneralFailure)
+		return errors.Wrapf(err, "connecting to %s", address)
+	}
+	defer upstream.Close()
+	if err := reply(conn, socks.Succeeded); err != nil {
+		return err
+	}
+
+	done := make(chan struct{}, 2)
+	go pipe(conn, upstream, done)
+	go pipe(upstream, conn, done)
+	<-done
+	<-done
+	return nil
+}
+
+// reply sends a socks reply. The bound address of a connection is of
+// no use to anybody here, so it is always 0.0.0.0:0.
+func reply(w io.Writer, status byte) error {
+	return replyBound(w, status, &net.UDPAddr{IP: net.IPv4zero})
+}
+
+// replyBound sends a socks reply with the given bound address.
+func replyBound(w io.Writer, status byte, bound *net.UDPAddr) error {
+	address, err := socks.EncodeAddress(net.JoinHostPort(bound.IP.String(), strconv.Itoa(bound.Port)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append([]byte{socks.Version, status, 0}, address...))
+	return err
+}
+
+// pipe copies from one connection to the other, and then tells the
+// far end that nothing more is coming.
+func pipe(from, to net.Conn, done chan<- struct{}) {
+	defer func() { done <- struct{}{} }()
+	io.Copy(to, from)
+	if c, ok := to.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		to.Close()
+	}
+}
@@ -0,0 +1,147 @@
+// Package tunnel connects to a cluster through an ssh server running
+// in a pod, reached with a port-forward through the api server. It
+// does in process what `kubectl port-forward` followed by `ssh -D`
+// would otherwise do.
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/rest"
+
+	"github.com/datawire/teleproxy/internal/pkg/proxy"
+)
+
+const (
+	// handshakeTimeout bounds how long the ssh handshake may take.
+	handshakeTimeout = 10 * time.Second
+
+	// keepaliveInterval is how often we check that the far end is
+	// still there, so that a dead tunnel (e.g. after the laptop
+	// sleeps) is noticed without waiting for a connection to hang.
+	keepaliveInterval = 15 * time.Second
+)
+
+// A Tunnel is an ssh connection to a pod that connections into the
+// cluster are dialed through.
+type Tunnel struct {
+	client *ssh.Client
+	done   chan error
+	// udp is why udp can't be relayed, if it can't
+	udp error
+}
+
+// Open port-forwards to port on the given pod and logs in to the ssh
+// server there as user.
+func Open(config *rest.Config, namespace, pod string, port int, user string) (*Tunnel, error) {
+	conn, err := proxy.PortForward(config, namespace, pod, port)
+	if err != nil {
+		return nil, err
+	}
+	return open(conn, fmt.Sprintf("%s/%s:%d", namespace, pod, port), user)
+}
+
+// open logs in to the ssh server at the other end of conn.
+func open(conn net.Conn, addr, user string) (*Tunnel, error) {
+	// the pod's host key changes every time it is recreated, and
+	// the port-forward already authenticates the far end
+	config := &ssh.ClientConfig{
+		User:            user,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	handshake := make(chan error, 1)
+	var sshConn ssh.Conn
+	var chans <-chan ssh.NewChannel
+	var reqs <-chan *ssh.Request
+	go func() {
+		var err error
+		sshConn, chans, reqs, err = ssh.NewClientConn(conn, addr, config)
+		handshake <- err
+	}()
+	select {
+	case err := <-handshake:
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "ssh to %s", addr)
+		}
+	case <-time.After(handshakeTimeout):
+		conn.Close()
+		return nil, errors.Errorf("ssh to %s: handshake timed out", addr)
+	}
+
+	t := &Tunnel{client: ssh.NewClient(sshConn, chans, reqs), done: make(chan error, 1)}
+	go t.keepalive()
+	go func() {
+		t.done <- t.client.Wait()
+	}()
+	t.udp = t.checkRelay()
+	return t, nil
+}
+
+// checkRelay checks that the pod can run the udp relay.
+func (t *Tunnel) checkRelay() error {
+	session, err := t.client.NewSession()
+	if err != nil {
+		return errors.Wrap(err, "udp relay")
+	}
+	defer session.Close()
+	if err := session.Run("command -v python3"); err != nil {
+		return errors.New("udp relay: python3 not found in the pod")
+	}
+	return nil
+}
+
+func (t *Tunnel) keepalive() {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := t.client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case err := <-reply:
+			if err != nil {
+				// the connection is gone, Wait has
+				// already returned or is about to
+				return
+			}
+		case <-time.After(keepaliveInterval):
+			t.client.Close()
+			return
+		}
+	}
+}
+
+// Dial connects to address from the far end of the tunnel. Ssh only
+// forwards tcp, so udp goes through a relay run in the pod instead.
+func (t *Tunnel) Dial(network, address string) (net.Conn, error) {
+	if strings.HasPrefix(network, "udp") {
+		return t.dialUDP(address)
+	}
+	return t.client.Dial(network, address)
+}
+
+// UDP returns why udp can't be dialed through the tunnel, or nil if
+// it can.
+func (t *Tunnel) UDP() error {
+	return t.udp
+}
+
+// Done returns a channel that receives why the tunnel went away
+// once it does.
+func (t *Tunnel) Done() <-chan error {
+	return t.done
+}
+
+// Close closes the tunnel along with every connection through it.
+func (t *Tunnel) Close() error {
+	return t.client.Close()
+}
@@ -0,0 +1,319 @@
+package tunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	netproxy "golang.org/x/net/proxy"
+
+	"github.com/datawire/teleproxy/internal/pkg/proxy"
+)
+
+// echo starts a server that sends back whatever it receives, and
+// returns its address.
+func echo(t *testing.T) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+// roundTrip checks that conn is connected to an echo server.
+func roundTrip(t *testing.T, conn net.Conn) {
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	result := make([]byte, 5)
+	_, err := io.ReadFull(conn, result)
+	if err != nil || string(result) != "hello" {
+		t.Errorf("got %q, %v", result, err)
+	}
+}
+
+func TestSOCKS(t *testing.T) {
+	target, stop := echo(t)
+	defer stop()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go ServeSOCKS(ln, net.Dial)
+
+	dialer, err := netproxy.SOCKS5("tcp", ln.Addr().String(), nil, netproxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn)
+
+	// nothing is listening on port 1 of the loopback address
+	if _, err := dialer.Dial("tcp", "127.0.0.1:1"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+// sshServer serves one ssh connection on conn that allows anybody in
+// and forwards direct-tcpip channels, like the teleproxy pod does.
+func sshServer(t *testing.T, conn net.Conn) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	go func() {
+		_, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range reqs {
+				req.Reply(req.Type == "keepalive@openssh.com", nil)
+			}
+		}()
+		for ch := range chans {
+			if ch.ChannelType() == "session" {
+				go session(ch)
+				continue
+			}
+			if ch.ChannelType() != "direct-tcpip" {
+				ch.Reject(ssh.UnknownChannelType, "unsupported")
+				continue
+			}
+			// host, port, origin host, origin port
+			extra := ch.ExtraData()
+			n := binary.BigEndian.Uint32(extra)
+			host := string(extra[4 : 4+n])
+			port := binary.BigEndian.Uint32(extra[4+n:])
+			upstream, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+			if err != nil {
+				ch.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			channel, reqs, err := ch.Accept()
+			if err != nil {
+				upstream.Close()
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				io.Copy(channel, upstream)
+				channel.CloseWrite()
+			}()
+			go func() {
+				io.Copy(upstream, channel)
+				upstream.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+}
+
+// session runs the command of an ssh exec request locally.
+func session(ch ssh.NewChannel) {
+	channel, reqs, err := ch.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		ssh.Unmarshal(req.Payload, &payload)
+		req.Reply(true, nil)
+		go ssh.DiscardRequests(reqs)
+
+		cmd := exec.Command("sh", "-c", payload.Command)
+		cmd.Stdin = channel
+		cmd.Stdout = channel
+		cmd.Stderr = channel.Stderr()
+		status := struct{ Status uint32 }{}
+		if cmd.Run() != nil {
+			status.Status = 1
+		}
+		channel.SendRequest("exit-status", false, ssh.Marshal(&status))
+		return
+	}
+}
+
+// tunnel opens a tunnel to an in-process ssh server.
+func tunnel(t *testing.T) *Tunnel {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshServer(t, server)
+
+	tun, err := open(client, "test", "telepresence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tun
+}
+
+func TestTunnel(t *testing.T) {
+	target, stop := echo(t)
+	defer stop()
+
+	tun := tunnel(t)
+	conn, err := tun.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, conn)
+	conn.Close()
+
+	tun.Close()
+	<-tun.Done()
+}
+
+// udpEcho starts a server that sends every datagram back to where it
+// came from, and returns its address.
+func udpEcho(t *testing.T) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+// udpRoundTrip checks that conn exchanges datagrams with an echo
+// server.
+func udpRoundTrip(t *testing.T, conn net.Conn) {
+	for _, message := range []string{"hello", "world"} {
+		if _, err := conn.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		result := make([]byte, 64)
+		n, err := conn.Read(result)
+		if err != nil || string(result[:n]) != message {
+			t.Errorf("got %q, %v", result[:n], err)
+		}
+	}
+}
+
+func TestSOCKSUDP(t *testing.T) {
+	target, stop := udpEcho(t)
+	defer stop()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go ServeSOCKS(ln, net.Dial)
+
+	dialer, err := proxy.ParseDialer("socks5://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("udp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	udpRoundTrip(t, conn)
+}
+
+func TestTunnelUDP(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip(err)
+	}
+	target, stop := udpEcho(t)
+	defer stop()
+
+	tun := tunnel(t)
+	defer tun.Close()
+	conn, err := tun.Dial("udp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	udpRoundTrip(t, conn)
+}
+
+func TestTunnelUDPWithoutPython(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err)
+	}
+	// a "pod" with a shell and nothing else
+	dir, err := ioutil.TempDir("", "tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Symlink(sh, filepath.Join(dir, "sh")); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir)
+	defer os.Setenv("PATH", path)
+
+	tun := tunnel(t)
+	defer tun.Close()
+	if err := tun.UDP(); err == nil || err.Error() != "udp relay: python3 not found in the pod" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := tun.Dial("udp", "192.0.2.1:53"); err != tun.UDP() {
+		t.Errorf("expected the same error from Dial, got %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	shellquote "github.com/kballard/go-shellquote"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// relayScript exchanges datagrams with the address given by its
+// arguments, and passes them over stdin and stdout with each one
+// prefixed by its length as two big endian bytes. It exits on any
+// error receiving other than the destination refusing a datagram, so
+// that the flow ends. The teleproxy pod has python but nothing else
+// that can do this, so udp needs python3 in the pod.
+const relayScript = `
+import os, socket, struct, sys, threading
+family, kind, proto, _, addr = socket.getaddrinfo(sys.argv[1], int(sys.argv[2]), 0, socket.SOCK_DGRAM)[0]
+s = socket.socket(family, kind, proto)
+s.connect(addr)
+i, o = sys.stdin.buffer, sys.stdout.buffer
+
+def up():
+    while True:
+        header = i.read(2)
+        if len(header) < 2:
+            os._exit(0)
+        datagram = i.read(struct.unpack(">H", header)[0])
+        try:
+            s.send(datagram)
+        except OSError:
+            pass
+
+threading.Thread(target=up, daemon=True).start()
+while True:
+    try:
+        datagram = s.recv(65535)
+    except ConnectionRefusedError:
+        # the destination wasn't listening when we last sent
+        continue
+    except OSError as e:
+        sys.stderr.write(str(e))
+        sys.stderr.flush()
+        os._exit(1)
+    o.write(struct.pack(">H", len(datagram)) + datagram)
+    o.flush()
+`
+
+// dialUDP starts a relay to address in the pod.
+func (t *Tunnel) dialUDP(address string) (net.Conn, error) {
+	if t.udp != nil {
+		return nil, t.udp
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := t.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stderr := &syncBuffer{}
+	session.Stderr = stderr
+	if err := session.Start(shellquote.Join("python3", "-c", relayScript, host, port)); err != nil {
+		session.Close()
+		return nil, errors.Wrapf(err, "udp relay to %s", address)
+	}
+
+	return &datagramConn{
+		session: session,
+		stdin:   stdin,
+		stdout:  bufio.NewReader(stdout),
+		stderr:  stderr,
+		remote:  relayAddr(address),
+	}, nil
+}
+
+// relayAddr is the net.Addr of a udp relay.
+type relayAddr string
+
+func (a relayAddr) Network() string { return "udp" }
+func (a relayAddr) String() string  { return string(a) }
+
+// A syncBuffer is a bytes.Buffer that may be written while it is
+// being read.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// A datagramConn is a net.Conn over a relay, where each Read and
+// Write is one datagram.
+type datagramConn struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+	stderr  *syncBuffer
+	remote  relayAddr
+
+	writeLock sync.Mutex
+}
+
+func (c *datagramConn) Read(b []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.stdout, header[:]); err != nil {
+		return 0, c.relayError(err)
+	}
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if n <= len(b) {
+		read, err := io.ReadFull(c.stdout, b[:n])
+		return read, c.relayError(err)
+	}
+	// like udp, whatever doesn't fit is lost
+	read, err := io.ReadFull(c.stdout, b)
+	if err == nil {
+		_, err = c.stdout.Discard(n - len(b))
+	}
+	return read, c.relayError(err)
+}
+
+// relayError explains an unexpected end of the relay with what it
+// said on stderr, if anything.
+func (c *datagramConn) relayError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if message := c.stderr.String(); message != "" {
+		return errors.Errorf("udp relay to %s: %s", c.remote, message)
+	}
+	return err
+}
+
+func (c *datagramConn) Write(b []byte) (int, error) {
+	if len(b) > 0xffff {
+		return 0, errors.Errorf("datagram too big: %d bytes", len(b))
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if _, err := c.stdin.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *datagramConn) Close() error {
+	c.stdin.Close()
+	return c.session.Close()
+}
+
+func (c *datagramConn) LocalAddr() net.Addr  { return relayAddr("local") }
+func (c *datagramConn) RemoteAddr() net.Addr { return c.remote }
+
+// ssh channels have no deadlines, the relay is closed by whichever
+// end is done with it
+
+func (c *datagramConn) SetDeadline(t time.Time) error      { return nil }
+func (c *datagramConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *datagramConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -13,6 +13,7 @@ import (
 
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 
 	"k8s.io/cli-runtime/pkg/genericclioptions"
@@ -391,3 +392,41 @@ func (c *Client) ListQuery(query Query) ([]Resource, error) {
 	}
 	return result, nil
 }
+
+// Create creates resource in the cluster, in its own namespace if it
+// has one and the client's namespace otherwise, and returns what the
+// cluster made of it.
+func (c *Client) Create(resource Resource) (Resource, error) {
+	query := Query{Kind: strings.ToLower(resource.QKind())}
+	err := query.resolve(c)
+	if err != nil {
+		return nil, err
+	}
+	ri := query.resourceType
+
+	dyn, err := dynamic.NewForConfig(c.config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create dynamic context")
+	}
+
+	cli := dyn.Resource(schema.GroupVersionResource{
+		Group:    ri.Group,
+		Version:  ri.Version,
+		Resource: ri.Name,
+	})
+
+	var filtered dynamic.ResourceInterface = cli
+	if ri.Namespaced {
+		namespace := resource.Namespace()
+		if namespace == "" {
+			namespace = c.Namespace
+		}
+		filtered = cli.Namespace(namespace)
+	}
+
+	un, err := filtered.Create(&unstructured.Unstructured{Object: resource}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return un.UnstructuredContent(), nil
+}
@@ -0,0 +1,167 @@
+package teleproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/internal/pkg/dns"
+	"github.com/datawire/teleproxy/internal/pkg/interceptor"
+	"github.com/datawire/teleproxy/internal/pkg/route"
+	"github.com/datawire/teleproxy/pkg/supervisor"
+)
+
+const (
+	// staticTable is the name of a table in the routes file that
+	// doesn't have one.
+	staticTable = "static"
+
+	// routesFileInterval is how often the routes file is checked
+	// for changes.
+	routesFileInterval = 2 * time.Second
+)
+
+// reservedTables are the tables teleproxy keeps itself, which the
+// routes file may not replace.
+var reservedTables = map[string]bool{
+	interceptor.BootstrapTable: true,
+	kubernetesTable:            true,
+	dockerTable:                true,
+}
+
+// A tableUpdater is where the routes file's tables go, i.e. the
+// interceptor.
+type tableUpdater interface {
+	Update(tables ...route.Table) error
+}
+
+// A routesFile keeps the tables in the --routes-file applied to the
+// interceptor, for hosts that don't come from a bridge.
+type routesFile struct {
+	path      string
+	proxyPort string
+	iceptor   tableUpdater
+	// data is what was last applied, tables the names of the
+	// tables it had, and err the last error reading or applying
+	// it, so that it is only logged once
+	data   []byte
+	tables map[string]bool
+	err    string
+}
+
+// parse parses the routes file's data into tables. Unnamed tables are
+// called "static", and routes are tcp and go to the proxy unless they
+// say otherwise.
+func (f *routesFile) parse(data []byte) ([]route.Table, error) {
+	tables, err := route.ParseTables(data)
+	if err != nil {
+		return nil, errors.Wrap(err, f.path)
+	}
+	names := make(map[string]bool, len(tables))
+	for i := range tables {
+		t := &tables[i]
+		if t.Name == "" {
+			t.Name = staticTable
+		}
+		if reservedTables[t.Name] {
+			return nil, errors.Errorf("%s: table %s is reserved", f.path, t.Name)
+		}
+		if names[t.Name] {
+			return nil, errors.Errorf("%s: table %s appears twice", f.path, t.Name)
+		}
+		names[t.Name] = true
+		if t.TTL != 0 {
+			return nil, errors.Errorf("%s: table %s: static tables can't have a ttl", f.path, t.Name)
+		}
+		// the file is the authority on what's in it
+		t.Version = 0
+		for j := range t.Routes {
+			r := &t.Routes[j]
+			if r.CNAME != "" {
+				continue
+			}
+			if r.Proto == "" {
+				r.Proto = "tcp"
+			}
+			if r.Target == "" {
+				r.Target = f.proxyPort
+			}
+		}
+		if err := t.Validate(); err != nil {
+			return nil, errors.Wrap(err, f.path)
+		}
+	}
+	return tables, nil
+}
+
+// load reads and parses the routes file.
+func (f *routesFile) load() ([]byte, []route.Table, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	tables, err := f.parse(data)
+	return data, tables, err
+}
+
+// reload applies the routes file if it has changed, and removes the
+// tables that are no longer in it, all in one update. If the file is
+// broken, or the update fails, the previous tables stay in place and
+// the file is tried again next time.
+func (f *routesFile) reload(p *supervisor.Process) {
+	data, tables, err := f.load()
+	if err == nil && (f.tables == nil || !bytes.Equal(data, f.data)) {
+		err = f.apply(tables)
+		if err == nil {
+			f.data = data
+			p.Logf("loaded %d tables from %s", len(tables), f.path)
+		}
+	}
+	if err != nil {
+		if err.Error() != f.err {
+			p.Logf("%v, keeping the previous routes", err)
+			f.err = err.Error()
+		}
+		return
+	}
+	f.err = ""
+}
+
+// apply replaces the tables from the routes file with the given ones.
+func (f *routesFile) apply(tables []route.Table) error {
+	names := make(map[string]bool, len(tables))
+	for _, t := range tables {
+		names[t.Name] = true
+	}
+	for name := range f.tables {
+		if !names[name] {
+			// an empty table is a deleted one
+			tables = append(tables, route.Table{Name: name})
+		}
+	}
+	if err := f.iceptor.Update(tables...); err != nil {
+		return errors.Wrapf(err, "%s: applying tables", f.path)
+	}
+	dns.Flush()
+	f.tables = names
+	return nil
+}
+
+// Work applies the routes file, and then again whenever it changes.
+func (f *routesFile) Work(p *supervisor.Process) error {
+	f.reload(p)
+	p.Ready()
+
+	ticker := time.NewTicker(routesFileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.Shutdown():
+			return nil
+		case <-ticker.C:
+			f.reload(p)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package teleproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/internal/pkg/route"
+	"github.com/datawire/teleproxy/pkg/supervisor"
+)
+
+func TestRoutesFileParse(t *testing.T) {
+	f := &routesFile{path: "routes.yaml", proxyPort: "1234"}
+
+	tables, err := f.parse([]byte(`
+- routes:
+  - {name: staging-db, ip: 10.0.0.5, port: "5432"}
+  - {name: db, cname: staging-db}
+- name: legacy
+  dialer: direct
+  version: 7
+  routes:
+  - {name: legacy-vm, ip: 10.0.0.6, proto: udp, target: "4321"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []route.Table{
+		{Name: staticTable, Routes: []route.Route{
+			{Name: "staging-db", Ip: "10.0.0.5", Proto: "tcp", Port: "5432", Target: "1234"},
+			{Name: "db", CNAME: "staging-db"},
+		}},
+		{Name: "legacy", Dialer: "direct", Routes: []route.Route{
+			{Name: "legacy-vm", Ip: "10.0.0.6", Proto: "udp", Target: "4321"},
+		}},
+	}
+	if !reflect.DeepEqual(tables, expected) {
+		t.Errorf("got %+v, expected %+v", tables, expected)
+	}
+
+	for in, expected := range map[string]string{
+		"- {routes: []}\n- {routes: []}":               "routes.yaml: table static appears twice",
+		"{name: kubernetes, routes: []}":               "routes.yaml: table kubernetes is reserved",
+		"{name: bootstrap, routes: []}":                "routes.yaml: table bootstrap is reserved",
+		"{ttl: 30, routes: []}":                        "routes.yaml: table static: static tables can't have a ttl",
+		"routes: [{name: foo, ip: nonexistent}]":       `routes.yaml: table static: route foo: bad ip: "nonexistent"`,
+		"routes: [{name: foo, ip: 10.0.0.5, pot: 80}]": `routes.yaml: error unmarshaling JSON: while decoding JSON: json: unknown field "pot"`,
+	} {
+		if _, err := f.parse([]byte(in)); err == nil || err.Error() != expected {
+			t.Errorf("%s: expected %q, got %v", in, expected, err)
+		}
+	}
+}
+
+// fakeUpdater records the tables it is given, unless fail is set.
+type fakeUpdater struct {
+	tables map[string]route.Table
+	fail   bool
+}
+
+func (u *fakeUpdater) Update(tables ...route.Table) error {
+	if u.fail {
+		return errors.New("failed")
+	}
+	for _, t := range tables {
+		if len(t.Routes) == 0 {
+			delete(u.tables, t.Name)
+		} else {
+			u.tables[t.Name] = t
+		}
+	}
+	return nil
+}
+
+func TestRoutesFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "routes.yaml")
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u := &fakeUpdater{tables: make(map[string]route.Table)}
+	f := &routesFile{path: path, proxyPort: "1234", iceptor: u}
+	check := func(what string, names ...string) {
+		if len(u.tables) != len(names) {
+			t.Errorf("%s: expected %v, got %v", what, names, u.tables)
+		}
+		for _, name := range names {
+			if _, ok := u.tables[name]; !ok {
+				t.Errorf("%s: expected %s in %v", what, name, u.tables)
+			}
+		}
+	}
+
+	sup := supervisor.WithContext(context.Background())
+	sup.Supervise(&supervisor.Worker{
+		Name: "test",
+		Work: func(p *supervisor.Process) error {
+			defer sup.Shutdown()
+
+			write("- {name: a, routes: [{name: foo, ip: 10.0.0.5}]}\n- {name: b, routes: [{name: bar, ip: 10.0.0.6}]}")
+			f.reload(p)
+			check("add", "a", "b")
+
+			// a failed update is tried again on the next
+			// tick
+			write("- {name: a, routes: [{name: foo, ip: 10.0.0.7}]}")
+			u.fail = true
+			f.reload(p)
+			check("failed update", "a", "b")
+			if u.tables["a"].Routes[0].Ip != "10.0.0.5" {
+				t.Errorf("failed update: got %v", u.tables["a"])
+			}
+			u.fail = false
+			f.reload(p)
+			check("remove", "a")
+			if u.tables["a"].Routes[0].Ip != "10.0.0.7" {
+				t.Errorf("retry: got %v", u.tables["a"])
+			}
+
+			// a broken file leaves everything as it was
+			write("- {name: docker, routes: []}")
+			f.reload(p)
+			check("broken", "a")
+			return nil
+		},
+	})
+	if errs := sup.Run(); len(errs) > 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
@@ -1,9 +1,7 @@
 package teleproxy
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -11,6 +9,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
@@ -19,6 +19,7 @@ import (
 
 	"git.lukeshu.com/go/libsystemd/sd_daemon"
 	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 
 	"github.com/datawire/teleproxy/pkg/k8s"
 	"github.com/datawire/teleproxy/pkg/supervisor"
@@ -27,20 +28,29 @@ import (
 	"github.com/datawire/teleproxy/internal/pkg/dns"
 	"github.com/datawire/teleproxy/internal/pkg/docker"
 	"github.com/datawire/teleproxy/internal/pkg/interceptor"
+	"github.com/datawire/teleproxy/internal/pkg/nat"
 	"github.com/datawire/teleproxy/internal/pkg/proxy"
 	"github.com/datawire/teleproxy/internal/pkg/route"
+	"github.com/datawire/teleproxy/internal/pkg/tunnel"
 )
 
-func dnsListeners(p *supervisor.Process, port string) (listeners []string) {
+// udpListeners returns the addresses to listen on for udp that is
+// redirected to port, i.e. for dns and for proxied udp.
+func udpListeners(p *supervisor.Process, port string, ipv6 bool) (listeners []string) {
 	// turns out you need to listen on localhost for nat to work
 	// properly for udp, otherwise you get an "unexpected source
-	// blah thingy" because the dns reply packets look like they
-	// are coming from the wrong place
+	// blah thingy" because the reply packets look like they are
+	// coming from the wrong place
 	listeners = append(listeners, "127.0.0.1:"+port)
+	if ipv6 {
+		// likewise, IPv6 packets get redirected to the
+		// IPv6 loopback address
+		listeners = append(listeners, "[::1]:"+port)
+	}
 
 	if runtime.GOOS == "linux" {
 		// This is the default docker bridge. We need to listen here because the nat logic we use to intercept
-		// dns packets will divert the packet to the interface it originates from, which in the case of
+		// udp packets will divert the packet to the interface it originates from, which in the case of
 		// containers is the docker bridge. Without this dns won't work from inside containers.
 		output, err := p.Command("docker", "inspect", "bridge",
 			"-f", "{{(index .IPAM.Config 0).Gateway}}").Capture(nil)
@@ -59,17 +69,39 @@ const (
 	interceptMode = "intercept"
 	bridgeMode    = "bridge"
 	versionMode   = "version"
-
-	// DNSRedirPort is the port to which we redirect dns requests. It
-	// should probably eventually be configurable and/or dynamically
-	// chosen
+	cleanupMode   = "cleanup"
+
+	// DefaultChainName is the name under which the interceptor
+	// installs its firewall rules unless --chain-name says
+	// otherwise. Teleproxies with different chain names don't
+	// touch each other's rules.
+	DefaultChainName = "teleproxy"
+
+	// bootstrapPriority is the priority of the table with the
+	// routes teleproxy itself depends on. It should be higher than
+	// any other table is likely to use.
+	bootstrapPriority = 1000
+
+	// kubernetesTable and dockerTable are the tables the bridges
+	// keep.
+	kubernetesTable = "kubernetes"
+	dockerTable     = "docker"
+
+	// drainTimeout is how long the proxy and dns servers get to
+	// finish what they are doing when shutting down.
+	drainTimeout = 5 * time.Second
+
+	// DNSRedirPort is the port to which we redirect dns requests
+	// unless --dns-port says otherwise.
 	DNSRedirPort = "1233"
 
-	// ProxyRedirPort is the port to which we redirect proxied IPs. It
-	// should probably eventually be configurable and/or dynamically
-	// chosen.
+	// ProxyRedirPort is the port to which we redirect proxied IPs
+	// unless --proxy-port says otherwise.
 	ProxyRedirPort = "1234"
 
+	// dynamicPort as a port flag means to pick a free port.
+	dynamicPort = "0"
+
 	// MagicIP is an IP from the localhost range that we resolve
 	// "teleproxy" to and intercept for convenient access to the
 	// teleproxy api server. This enables things like `curl
@@ -84,20 +116,20 @@ const (
 
 // worker names
 const (
-	TeleproxyWorker      = "TPY"
-	TranslatorWorker     = "NAT"
-	ProxyWorker          = "PXY"
-	APIWorker            = "API"
-	BridgeWorker         = "BRG"
-	K8sBridgeWorker      = "K8S"
-	K8sPortForwardWorker = "KPF"
-	K8sSSHWorker         = "SSH"
-	K8sApplyWorker       = "KAP"
-	DkrBridgeWorker      = "DKR"
-	DNSServerWorker      = "DNS"
-	DNSConfigWorker      = "CFG"
-	CheckReadyWorker     = "RDY"
-	SignalWorker         = "SIG"
+	TeleproxyWorker  = "TPY"
+	TranslatorWorker = "NAT"
+	ProxyWorker      = "PXY"
+	APIWorker        = "API"
+	BridgeWorker     = "BRG"
+	K8sBridgeWorker  = "K8S"
+	K8sTunnelWorker  = "TUN"
+	K8sApplyWorker   = "KAP"
+	DkrBridgeWorker  = "DKR"
+	DNSServerWorker  = "DNS"
+	DNSConfigWorker  = "CFG"
+	CheckReadyWorker = "RDY"
+	RoutesFileWorker = "RTF"
+	SignalWorker     = "SIG"
 )
 
 var logLegend = []struct {
@@ -112,27 +144,80 @@ var logLegend = []struct {
 		"the set of dns names and ip addresses that should be intercepted."},
 	{BridgeWorker, "The bridge worker sets up the kubernetes and docker bridges."},
 	{K8sBridgeWorker, "The kubernetes bridge."},
-	{K8sPortForwardWorker, "The kubernetes port forward used for connectivity."},
-	{K8sSSHWorker, "The SSH port forward used on top of the kubernetes port forward."},
-	{K8sApplyWorker, "The kubernetes apply used to setup the in-cluster pod we talk with."},
+	{K8sTunnelWorker, "The ssh tunnel to the in-cluster pod, over a kubernetes port forward, served as a " +
+		"socks proxy for connectivity."},
+	{K8sApplyWorker, "Creates the in-cluster pod we talk with."},
 	{DkrBridgeWorker, "The docker bridge."},
 	{DNSServerWorker, "The DNS server teleproxy runs to intercept dns requests."},
 	{CheckReadyWorker, "The worker teleproxy uses to do a self check and signal the system it is ready."},
+	{RoutesFileWorker, "Applies the routing tables in the --routes-file, and again whenever it changes."},
 }
 
 // Teleproxy holds the configuration for this Teleproxy invocation
 type Teleproxy struct {
-	Mode       string
-	Kubeconfig string
-	Context    string
-	Namespace  string
-	DNSIP      string
-	FallbackIP string
-	NoSearch   bool
-	NoCheck    bool
-	Version    bool
-	supervisor *supervisor.Supervisor
-	workers    []*supervisor.Worker
+	Mode        string
+	Kubeconfig  string
+	Context     string
+	Namespace   string
+	DNSIP       string
+	FallbackIPs []string
+	DNSForwards []string
+	Dialers     []string
+	NATBackend  string
+	Excludes    []string
+	RoutesFile  string
+	DNSPort     string
+	ProxyPort   string
+	ChainName   string
+	NoSearch    bool
+	// the api's bearer token goes in APITokenFile, unless it
+	// is served on the unix socket APISocket instead
+	APITokenFile string
+	APISocket    string
+	APISocketUID int
+	NoLegacyAPI  bool
+	NoCheck      bool
+	Version      bool
+	supervisor   *supervisor.Supervisor
+	workers      []*supervisor.Worker
+}
+
+// forwards parses the DNSForwards rules into a map from domain suffix
+// to the servers that answer for it.
+func (tele *Teleproxy) forwards() (map[string][]string, error) {
+	result := make(map[string][]string)
+	for _, spec := range tele.DNSForwards {
+		suffix, servers, err := dns.ParseForward(spec)
+		if err != nil {
+			return nil, err
+		}
+		result[suffix] = append(result[suffix], servers...)
+	}
+	return result, nil
+}
+
+// apiDefaults fills in the chain name and the api token file, which
+// both a teleproxy and its clients need to agree on.
+func (tele *Teleproxy) apiDefaults() error {
+	if tele.ChainName == "" {
+		tele.ChainName = DefaultChainName
+	}
+	if !chainNameRE.MatchString(tele.ChainName) {
+		return errors.Errorf("TPY: bad chain name: %q", tele.ChainName)
+	}
+	if tele.APITokenFile == "" {
+		tele.APITokenFile = filepath.Join(nat.StateDir, "teleproxy-"+tele.ChainName+".token")
+	}
+	return nil
+}
+
+// APIClient returns a client for the api of the running teleproxy
+// with tele's chain name, socket, or token file.
+func (tele *Teleproxy) APIClient() (*api.Client, error) {
+	if err := tele.apiDefaults(); err != nil {
+		return nil, err
+	}
+	return api.NewClient(tele.APISocket, tele.APITokenFile), nil
 }
 
 // RunTeleproxy is the main entry point for Teleproxy
@@ -147,10 +232,66 @@ func RunTeleproxy(tele *Teleproxy, version string) error {
 	case versionMode:
 		fmt.Println("teleproxy", "version", version)
 		return nil
+	case cleanupMode:
+		// do nothing yet, cleanup needs the chain name
 	default:
 		return errors.Errorf("TPY: unrecognized mode: %v", tele.Mode)
 	}
 
+	if err := tele.apiDefaults(); err != nil {
+		return err
+	}
+
+	if tele.Mode == cleanupMode {
+		return cleanup(tele.ChainName)
+	}
+
+	if tele.APISocketUID < 0 {
+		// let whoever ran sudo use the api, so that the
+		// bridge can run as them
+		tele.APISocketUID, _ = strconv.Atoi(os.Getenv("SUDO_UID"))
+	}
+
+	if tele.DNSPort == "" {
+		tele.DNSPort = DNSRedirPort
+	}
+	if tele.ProxyPort == "" {
+		tele.ProxyPort = ProxyRedirPort
+	}
+	for _, port := range []string{tele.DNSPort, tele.ProxyPort} {
+		if err := checkPort(port); err != nil {
+			return errors.Wrap(err, "TPY")
+		}
+	}
+	if tele.DNSPort == tele.ProxyPort && tele.DNSPort != dynamicPort {
+		return errors.Errorf("TPY: the dns and proxy ports must differ: %s", tele.DNSPort)
+	}
+
+	switch tele.NATBackend {
+	case "", "iptables", "nftables":
+		// do nothing
+	default:
+		return errors.Errorf("TPY: unrecognized nat backend: %v", tele.NATBackend)
+	}
+
+	if err := interceptor.CheckExcludes(tele.Excludes); err != nil {
+		return errors.Wrap(err, "TPY")
+	}
+
+	forwards, err := tele.forwards()
+	if err == nil {
+		err = dns.CheckForwards(forwards)
+	}
+	if err != nil {
+		return errors.Wrap(err, "TPY")
+	}
+
+	for _, flag := range tele.Dialers {
+		if _, _, err := proxy.ParseDialerFlag(flag); err != nil {
+			return errors.Wrap(err, "TPY")
+		}
+	}
+
 	// do this up front so we don't miss out on cleanup if someone
 	// Control-C's just after starting us
 	signalChan := make(chan os.Signal, 1)
@@ -192,7 +333,6 @@ func RunTeleproxy(tele *Teleproxy, version string) error {
 					}
 				}
 			}
-			return nil
 		},
 	})
 
@@ -218,6 +358,71 @@ func RunTeleproxy(tele *Teleproxy, version string) error {
 	return errors.New(strings.TrimSpace(msg))
 }
 
+// chainNameRE matches the chain names that every nat backend can use:
+// iptables chain names are at most 28 characters.
+var chainNameRE = regexp.MustCompile(`^[A-Za-z0-9_-]{1,28}$`)
+
+// checkPort checks that a port flag is a port number, or 0 for a
+// dynamically allocated one.
+func checkPort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return errors.Errorf("bad port: %q", port)
+	}
+	return nil
+}
+
+// freePort returns a port that is free for both tcp and udp. Nothing
+// stops something else from taking it before we listen on it, but
+// that just makes us fail to start, as with any other port.
+func freePort() (string, error) {
+	for i := 0; i < 10; i++ {
+		ln, err := net.Listen("tcp", ":0")
+		if err != nil {
+			return "", err
+		}
+		_, port, err := net.SplitHostPort(ln.Addr().String())
+		if err != nil {
+			ln.Close()
+			return "", err
+		}
+		pc, err := net.ListenPacket("udp", ":"+port)
+		ln.Close()
+		if err == nil {
+			pc.Close()
+			return port, nil
+		}
+	}
+	return "", errors.New("couldn't find a free port")
+}
+
+// cleanup restores the host to a clean state after a teleproxy that
+// didn't get to clean up after itself, e.g. because it was killed
+// with SIGKILL. It doesn't need (or want) a running teleproxy.
+func cleanup(chainName string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("ERROR: teleproxy must be run as root or suid root")
+	}
+
+	errs := supervisor.Run(TranslatorWorker, func(p *supervisor.Process) error {
+		err := nat.Cleanup(p, chainName)
+		if err != nil {
+			return err
+		}
+		err = dns.CleanupSearchDomains(p)
+		if err != nil {
+			return err
+		}
+		dns.Flush()
+		p.Log("cleanup complete")
+		return nil
+	})
+	if len(errs) > 0 {
+		return errors.Errorf("TPY: cleanup failed: %v", errs)
+	}
+	return nil
+}
+
 func selfcheck(p *supervisor.Process) error {
 	// XXX: these checks might not make sense if -dns is specified
 	lookupName := fmt.Sprintf("teleproxy%d.cachebust.telepresence.io", time.Now().Unix())
@@ -296,11 +501,6 @@ func teleproxy(p *supervisor.Process, tele *Teleproxy) error {
 			Name:     BridgeWorker,
 			Requires: requires,
 			Work: func(p *supervisor.Process) error {
-				err := checkKubectl(p)
-				if err != nil {
-					return err
-				}
-
 				bridges(p, tele)
 				return nil
 			},
@@ -315,49 +515,14 @@ func (t *Teleproxy) addWorker(worker *supervisor.Worker) {
 	t.workers = append(t.workers, worker)
 }
 
-const kubectlErr = "kubectl version 1.10 or greater is required"
-
-func checkKubectl(p *supervisor.Process) error {
-	output, err := p.Command("kubectl", "version", "--client", "-o", "json").Capture(nil)
-	if err != nil {
-		return errors.Wrap(err, kubectlErr)
-	}
-
-	var info struct {
-		ClientVersion struct {
-			Major string
-			Minor string
-		}
-	}
-
-	err = json.Unmarshal([]byte(output), &info)
-	if err != nil {
-		return errors.Wrap(err, kubectlErr)
-	}
-
-	major, err := strconv.Atoi(info.ClientVersion.Major)
-	if err != nil {
-		return errors.Wrap(err, kubectlErr)
-	}
-	minor, err := strconv.Atoi(info.ClientVersion.Minor)
-	if err != nil {
-		return errors.Wrap(err, kubectlErr)
-	}
-
-	if major != 1 || minor < 10 {
-		return errors.Errorf("%s (found %d.%d)", kubectlErr, major, minor)
-	}
-
-	return nil
-}
-
 // intercept starts the interceptor, and only returns once the
 // interceptor is successfully running in another goroutine.  It
 // returns a function to call to shut down that goroutine.
 //
 // If dnsIP is empty, it will be detected from /etc/resolv.conf
 //
-// If fallbackIP is empty, it will default to Google DNS.
+// If fallbackIPs is empty, it will default to the other nameservers
+// in /etc/resolv.conf followed by a couple of public ones.
 func intercept(p *supervisor.Process, tele *Teleproxy) error {
 	if os.Geteuid() != 0 {
 		return errors.New("ERROR: teleproxy must be run as root or suid root")
@@ -365,38 +530,113 @@ func intercept(p *supervisor.Process, tele *Teleproxy) error {
 
 	sup := p.Supervisor()
 
-	if tele.DNSIP == "" {
-		dat, err := ioutil.ReadFile("/etc/resolv.conf")
-		if err != nil {
-			return err
+	var nameservers []string
+	dat, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil && tele.DNSIP == "" {
+		return err
+	}
+	for _, line := range strings.Split(string(dat), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			nameservers = append(nameservers, fields[1])
 		}
-		for _, line := range strings.Split(string(dat), "\n") {
-			if strings.Contains(line, "nameserver") {
-				fields := strings.Fields(line)
-				tele.DNSIP = fields[1]
-				log.Printf("TPY: Automatically set -dns=%v", tele.DNSIP)
-				break
-			}
+	}
+
+	if tele.DNSIP == "" {
+		if len(nameservers) > 0 {
+			tele.DNSIP = nameservers[0]
+			log.Printf("TPY: Automatically set -dns=%v", tele.DNSIP)
 		}
 	}
 	if tele.DNSIP == "" {
 		return errors.New("couldn't determine dns ip from /etc/resolv.conf")
 	}
 
-	if tele.FallbackIP == "" {
-		if tele.DNSIP == "8.8.8.8" {
-			tele.FallbackIP = "8.8.4.4"
-		} else {
-			tele.FallbackIP = "8.8.8.8"
+	if len(tele.FallbackIPs) == 0 {
+		// prefer the other nameservers we were configured with,
+		// since public resolvers are often blocked on corporate
+		// networks, but keep a couple around in case those don't
+		// work either
+		for _, ip := range append(nameservers, "8.8.8.8", "1.1.1.1") {
+			if ip != tele.DNSIP && !contains(tele.FallbackIPs, ip) {
+				tele.FallbackIPs = append(tele.FallbackIPs, ip)
+			}
 		}
-		log.Printf("TPY: Automatically set -fallback=%v", tele.FallbackIP)
+		log.Printf("TPY: Automatically set -fallback=%v", strings.Join(tele.FallbackIPs, ","))
 	}
-	if tele.FallbackIP == tele.DNSIP {
+	if contains(tele.FallbackIPs, tele.DNSIP) {
 		return errors.New("if your fallbackIP and your dnsIP are the same, you will have a dns loop")
 	}
+	var fallbacks []string
+	for _, ip := range tele.FallbackIPs {
+		fallbacks = append(fallbacks, net.JoinHostPort(ip, "53"))
+	}
 
-	iceptor := interceptor.NewInterceptor("teleproxy")
-	apis, err := api.NewAPIServer(iceptor)
+	forwards, err := tele.forwards()
+	if err != nil {
+		return err
+	}
+	for suffix, servers := range forwards {
+		for _, server := range servers {
+			host, _, err := net.SplitHostPort(server)
+			if err != nil {
+				host = server
+			}
+			if host == tele.DNSIP {
+				return errors.Errorf("if you forward %s to your dnsIP, you will have a dns loop", suffix)
+			}
+		}
+	}
+
+	// ports are picked once, rather than every time the workers
+	// restart, so that the routes pointing at them stay valid
+	for _, port := range []*string{&tele.DNSPort, &tele.ProxyPort} {
+		if *port != dynamicPort {
+			continue
+		}
+		// the ports we've tried are closed again, so we
+		// could be handed the same one twice
+		for *port == dynamicPort || tele.DNSPort == tele.ProxyPort {
+			*port, err = freePort()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("TPY: Using --dns-port=%s --proxy-port=%s --chain-name=%s", tele.DNSPort, tele.ProxyPort, tele.ChainName)
+
+	srv := &dns.Server{Fallbacks: fallbacks}
+	if err := srv.SetForwards(forwards); err != nil {
+		return err
+	}
+
+	iceptor := interceptor.NewInterceptor(tele.ChainName, tele.NATBackend)
+	srv.Resolve = iceptor.Resolve
+
+	var static *routesFile
+	if tele.RoutesFile != "" {
+		static = &routesFile{path: tele.RoutesFile, proxyPort: tele.ProxyPort, iceptor: iceptor}
+		// a broken file is fatal at startup, but once we're
+		// running it just leaves the previous tables in place
+		if _, _, err := static.load(); err != nil {
+			return errors.Wrap(err, "routes file")
+		}
+	}
+
+	tracker := proxy.NewTracker()
+	auth := api.Auth{
+		Socket:    tele.APISocket,
+		SocketUID: tele.APISocketUID,
+		Legacy:    !tele.NoLegacyAPI,
+	}
+	if tele.APISocket == "" {
+		auth.Token = api.NewToken()
+	}
+	apis, err := api.NewAPIServer(iceptor, srv, tracker, api.Ports{
+		Chain: tele.ChainName,
+		DNS:   tele.DNSPort,
+		Proxy: tele.ProxyPort,
+	}, auth)
 	if err != nil {
 		return errors.Wrap(err, "API Server")
 	}
@@ -412,6 +652,12 @@ func intercept(p *supervisor.Process, tele *Teleproxy) error {
 		Name:     APIWorker,
 		Requires: []string{},
 		Work: func(p *supervisor.Process) error {
+			if auth.Token != "" {
+				if err := api.WriteToken(tele.APITokenFile, auth.Token); err != nil {
+					return err
+				}
+				defer os.Remove(tele.APITokenFile)
+			}
 			apis.Start()
 			p.Ready()
 			<-p.Shutdown()
@@ -424,25 +670,16 @@ func intercept(p *supervisor.Process, tele *Teleproxy) error {
 		Name:     DNSServerWorker,
 		Requires: []string{},
 		Work: func(p *supervisor.Process) error {
-			srv := dns.Server{
-				Listeners: dnsListeners(p, DNSRedirPort),
-				Fallback:  tele.FallbackIP + ":53",
-				Resolve: func(domain string) string {
-					route := iceptor.Resolve(domain)
-					if route != nil {
-						return route.Ip
-					}
-					return ""
-				},
-			}
+			srv.Listeners = udpListeners(p, tele.DNSPort, net.ParseIP(tele.DNSIP).To4() == nil)
 			err := srv.Start(p)
 			if err != nil {
 				return err
 			}
 			p.Ready()
 			<-p.Shutdown()
-			// there is no srv.Stop()
-			return nil
+			ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+			defer cancel()
+			return srv.Stop(ctx)
 		},
 	})
 
@@ -453,36 +690,82 @@ func intercept(p *supervisor.Process, tele *Teleproxy) error {
 			// hmm, we may not actually need to get the original
 			// destination, we could just forward each ip to a unique port
 			// and either listen on that port or run port-forward
-			proxy, err := proxy.NewProxy(fmt.Sprintf(":%s", ProxyRedirPort), iceptor.Destination)
+			pxy, err := proxy.NewProxy(":"+tele.ProxyPort, iceptor.Destination)
 			if err != nil {
 				return errors.Wrap(err, "Proxy")
 			}
+			pxy.Tracker = tracker
+			pxy.ServiceName = iceptor.ServiceName
+			kubeinfo := k8s.NewKubeInfo(tele.Kubeconfig, tele.Context, tele.Namespace)
+			pxy.SetDialer(proxy.KubernetesDialer, proxy.NewKubernetesDialer(kubeinfo))
+			for _, flag := range tele.Dialers {
+				name, dialer, err := proxy.ParseDialerFlag(flag)
+				if err != nil {
+					return err
+				}
+				pxy.SetDialer(name, dialer)
+			}
 
-			proxy.Start(10000)
+			pxy.Start(10000)
+			for _, address := range udpListeners(p, tele.ProxyPort, net.ParseIP(tele.DNSIP).To4() == nil) {
+				if err := pxy.ListenUDP(address, iceptor.DestinationUDP); err != nil {
+					pxy.Stop(context.Background())
+					return errors.Wrap(err, "Proxy")
+				}
+			}
 			p.Ready()
 			<-p.Shutdown()
-			// there is no proxy.Stop()
-			return nil
+			ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+			defer cancel()
+			return pxy.Stop(ctx)
 		},
 	})
 
+	if static != nil {
+		sup.Supervise(&supervisor.Worker{
+			Name:     RoutesFileWorker,
+			Requires: []string{TranslatorWorker},
+			Work:     static.Work,
+		})
+	}
+
 	sup.Supervise(&supervisor.Worker{
 		Name:     DNSConfigWorker,
 		Requires: []string{TranslatorWorker},
 		Work: func(p *supervisor.Process) error {
-			bootstrap := route.Table{Name: "bootstrap"}
+			// excludes go in first so that nothing they cover
+			// is ever intercepted, not even briefly
+			err := iceptor.SetExcludes(tele.Excludes)
+			if err != nil {
+				return errors.Wrap(err, "exclude")
+			}
+
+			// nothing should be able to take over the names
+			// and addresses teleproxy needs for itself
+			bootstrap := route.Table{Name: interceptor.BootstrapTable, Priority: bootstrapPriority}
 			bootstrap.Add(route.Route{
 				Ip:     tele.DNSIP,
-				Target: DNSRedirPort,
+				Target: tele.DNSPort,
 				Proto:  "udp",
 			})
+			// clients retry over tcp when an answer is too
+			// big for udp
+			bootstrap.Add(route.Route{
+				Ip:     tele.DNSIP,
+				Port:   "53",
+				Target: tele.DNSPort,
+				Proto:  "tcp",
+			})
 			bootstrap.Add(route.Route{
 				Name:   "teleproxy",
 				Ip:     MagicIP,
 				Target: apis.Port(),
 				Proto:  "tcp",
 			})
-			iceptor.Update(bootstrap)
+			err = iceptor.Update(bootstrap)
+			if err != nil {
+				return errors.Wrap(err, "bootstrap")
+			}
 
 			var restore func()
 			if !tele.NoSearch {
@@ -508,13 +791,24 @@ var (
 	errAborted = errors.New("aborted")
 )
 
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
 type svcResource struct {
 	Spec svcSpec
 }
 
 type svcSpec struct {
-	ClusterIP string
-	Ports     []svcPort
+	Type         string
+	ClusterIP    string
+	ExternalName string
+	Ports        []svcPort
 }
 
 type svcPort struct {
@@ -523,8 +817,38 @@ type svcPort struct {
 	Protocol string
 }
 
+type endpointsResource struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string
+		}
+	}
+}
+
+// endpointIPs returns the addresses of the ready endpoints in an
+// endpoints resource.
+func endpointIPs(ep k8s.Resource) (ips []string) {
+	if ep.Empty() {
+		return
+	}
+	decoded := endpointsResource{}
+	if err := ep.Decode(&decoded); err != nil {
+		return
+	}
+	for _, subset := range decoded.Subsets {
+		for _, addr := range subset.Addresses {
+			ips = append(ips, addr.IP)
+		}
+	}
+	return
+}
+
 func bridges(p *supervisor.Process, tele *Teleproxy) {
 	sup := p.Supervisor()
+	client := api.NewClient(tele.APISocket, tele.APITokenFile)
+	if err := client.Legacy(); err != nil {
+		log.Printf("BRG: using the unversioned api: %v", err)
+	}
 
 	connect(tele)
 
@@ -548,17 +872,20 @@ func bridges(p *supervisor.Process, tele *Teleproxy) {
 				"",
 			}
 			log.Println("BRG: Setting DNS search path:", paths[0])
-			body, err := json.Marshal(paths)
-			if err != nil {
-				panic(err)
-			}
-			ign, err := http.Post("http://teleproxy/api/search", "application/json", bytes.NewReader(body))
+			ign, err := client.Request(http.MethodPost, "/search", paths)
 			if err != nil {
 				log.Printf("BRG: error setting up search path: %v", err)
 				panic(err) // Because this will fail if we win the startup race
 			}
 			defer ign.Body.Close()
 
+			// the teleproxy we're bridging to may be running
+			// in another process, with its own ports
+			redirects, err := getPorts(client)
+			if err != nil {
+				return err
+			}
+
 			var w *k8s.Watcher
 
 			err = p.DoClean(func() error {
@@ -569,7 +896,7 @@ func bridges(p *supervisor.Process, tele *Teleproxy) {
 				}
 
 				updateTable := func(w *k8s.Watcher) {
-					table := route.Table{Name: "kubernetes"}
+					table := route.Table{Name: kubernetesTable}
 
 					for _, svc := range w.List("services") {
 						decoded := svcResource{}
@@ -580,30 +907,70 @@ func bridges(p *supervisor.Process, tele *Teleproxy) {
 						}
 
 						spec := decoded.Spec
+						qualName := svc.Name() + "." + svc.Namespace() + ".svc.cluster.local"
 
-						ports := ""
+						if spec.Type == "ExternalName" {
+							if spec.ExternalName != "" {
+								table.Add(route.Route{Name: qualName, CNAME: spec.ExternalName})
+							}
+							continue
+						}
+
+						// tcp and udp ports get a route each
+						ports := map[string]string{}
+						var srvs []route.SRV
 						for _, port := range spec.Ports {
-							if ports == "" {
-								ports = fmt.Sprintf("%d", port.Port)
+							proto := strings.ToLower(port.Protocol)
+							if proto == "" {
+								proto = "tcp"
+							}
+							if proto != "tcp" && proto != "udp" {
+								continue
+							}
+							if ports[proto] == "" {
+								ports[proto] = fmt.Sprintf("%d", port.Port)
 							} else {
-								ports = fmt.Sprintf("%s,%d", ports, port.Port)
+								ports[proto] = fmt.Sprintf("%s,%d", ports[proto], port.Port)
+							}
+							// only named ports get SRV records
+							if port.Name != "" {
+								srvs = append(srvs, route.SRV{
+									Service: port.Name,
+									Proto:   proto,
+									Port:    port.Port,
+								})
 							}
 						}
 
-						ip := spec.ClusterIP
-						// for headless services the IP is None, we
-						// should properly handle these by listening
-						// for endpoints and returning multiple A
-						// records at some point
-						if ip != "" && ip != "None" {
-							qualName := svc.Name() + "." + svc.Namespace() + ".svc.cluster.local"
-							table.Add(route.Route{
-								Name:   qualName,
-								Ip:     ip,
-								Port:   ports,
-								Proto:  "tcp",
-								Target: ProxyRedirPort,
-							})
+						ips := []string{spec.ClusterIP}
+						if spec.ClusterIP == "None" {
+							// headless services resolve to
+							// all of their ready endpoints
+							ips = endpointIPs(w.Get("endpoints", svc.QName()))
+						}
+						// a service without any ports is
+						// intercepted on all tcp ports
+						var protos []string
+						if ports["tcp"] != "" || ports["udp"] == "" {
+							protos = append(protos, "tcp")
+						}
+						if ports["udp"] != "" {
+							protos = append(protos, "udp")
+						}
+						for _, ip := range ips {
+							if ip == "" {
+								continue
+							}
+							for _, proto := range protos {
+								table.Add(route.Route{
+									Name:   qualName,
+									Ip:     ip,
+									Port:   ports[proto],
+									Proto:  proto,
+									Target: redirects.Proxy,
+									SRV:    srvs,
+								})
+							}
 						}
 					}
 
@@ -634,12 +1001,12 @@ func bridges(p *supervisor.Process, tele *Teleproxy) {
 								Name:   qname,
 								Ip:     ip.(string),
 								Proto:  "tcp",
-								Target: ProxyRedirPort,
+								Target: redirects.Proxy,
 							})
 						}
 					}
 
-					post(table)
+					post(client, table)
 				}
 
 				// FIXME why do we ignore this error?
@@ -651,6 +1018,11 @@ func bridges(p *supervisor.Process, tele *Teleproxy) {
 				_ = w.Watch("pods", func(w *k8s.Watcher) {
 					updateTable(w)
 				})
+
+				// FIXME why do we ignore this error?
+				_ = w.Watch("endpoints", func(w *k8s.Watcher) {
+					updateTable(w)
+				})
 				return nil
 			}, func() error {
 				return errAborted
@@ -679,11 +1051,11 @@ func bridges(p *supervisor.Process, tele *Teleproxy) {
 			// setup docker bridge
 			dw := docker.NewWatcher()
 			dw.Start(func(w *docker.Watcher) {
-				table := route.Table{Name: "docker"}
+				table := route.Table{Name: dockerTable}
 				for name, ip := range w.Containers {
 					table.Add(route.Route{Name: name, Ip: ip, Proto: "tcp"})
 				}
-				post(table)
+				post(client, table)
 			})
 			p.Ready()
 			<-p.Shutdown()
@@ -693,21 +1065,25 @@ func bridges(p *supervisor.Process, tele *Teleproxy) {
 	})
 }
 
-func post(tables ...route.Table) {
+// getPorts asks the teleproxy we're bridging to where it redirects
+// intercepted traffic.
+func getPorts(client *api.Client) (ports api.Ports, err error) {
+	err = client.Do(http.MethodGet, "/ports", nil, &ports)
+	return ports, errors.Wrap(err, "getting ports")
+}
+
+func post(client *api.Client, tables ...route.Table) {
 	names := make([]string, len(tables))
 	for i, t := range tables {
 		names[i] = t.Name
 	}
 	jnames := strings.Join(names, ", ")
 
-	body, err := json.Marshal(tables)
-	if err != nil {
-		panic(err)
-	}
-	resp, err := http.Post("http://teleproxy/api/tables/", "application/json", bytes.NewReader(body))
+	resp, err := client.Request(http.MethodPost, "/tables/", tables)
 	if err != nil {
 		log.Printf("BRG: error posting update to %s: %v", jnames, err)
 	} else {
+		resp.Body.Close()
 		log.Printf("BRG: posted update to %s: %v", jnames, resp.StatusCode)
 	}
 }
@@ -729,84 +1105,116 @@ spec:
       containerPort: 8022
 `
 
+const (
+	// the pod connect() creates, and the ssh server in it
+	teleproxyPodName = "teleproxy"
+	teleproxySSHPort = 8022
+	teleproxySSHUser = "telepresence"
+
+	// socksAddress is where the tunnel is served as a socks
+	// proxy, for the proxy's default dialer
+	socksAddress = "localhost:1080"
+)
+
 func connect(tele *Teleproxy) {
 	tele.addWorker(&supervisor.Worker{
 		Name: K8sApplyWorker,
-		Work: func(p *supervisor.Process) (err error) {
+		Work: func(p *supervisor.Process) error {
 			kubeinfo := k8s.NewKubeInfo(tele.Kubeconfig, tele.Context, tele.Namespace)
-			// setup remote teleproxy pod
-			args, err := kubeinfo.GetKubectlArray("apply", "-f", "-")
+			client, err := k8s.NewClient(kubeinfo)
 			if err != nil {
 				return err
 			}
-			apply := p.Command("kubectl", args...)
-			apply.Stdin = strings.NewReader(teleproxyPod)
-			err = apply.Start()
+			// setup remote teleproxy pod
+			resources, err := k8s.ParseResources("teleproxy pod", teleproxyPod)
 			if err != nil {
-				return
+				return err
 			}
-			err = p.DoClean(apply.Wait, apply.Process.Kill)
-			if err != nil {
-				return
+			for _, resource := range resources {
+				_, err = client.Create(resource)
+				if err != nil && !apierrors.IsAlreadyExists(err) {
+					return errors.Wrapf(err, "creating %s", resource.QName())
+				}
 			}
 			p.Ready()
 			// we need to stay alive so that our dependencies can start
 			<-p.Shutdown()
-			return
+			return nil
 		},
 	})
 
 	tele.addWorker(&supervisor.Worker{
-		Name:     K8sPortForwardWorker,
+		Name:     K8sTunnelWorker,
 		Requires: []string{K8sApplyWorker},
 		Retry:    true,
-		Work: func(p *supervisor.Process) (err error) {
-
+		Work: func(p *supervisor.Process) error {
 			kubeinfo := k8s.NewKubeInfo(tele.Kubeconfig, tele.Context, tele.Namespace)
-			args, err := kubeinfo.GetKubectlArray("port-forward", "pod/teleproxy", "8022")
+			config, err := kubeinfo.GetRestConfig()
 			if err != nil {
 				return err
 			}
-			pf := p.Command("kubectl", args...)
-			err = pf.Start()
+			client, err := k8s.NewClient(kubeinfo)
 			if err != nil {
-				return
+				return err
 			}
-			p.Ready()
-			err = p.DoClean(func() error {
-				err := pf.Wait()
-				if err != nil {
-					args, err := kubeinfo.GetKubectlArray("get", "pod/teleproxy")
-					if err != nil {
-						return err
-					}
-					inspect := p.Command("kubectl", args...)
-					_ = inspect.Run() // Discard error as this is just for logging
-				}
+			if err := waitForPod(p, client, teleproxyPodName); err != nil {
 				return err
-			}, func() error {
-				return pf.Process.Kill()
-			})
-			return
-		},
-	})
+			}
 
-	tele.addWorker(&supervisor.Worker{
-		Name:     K8sSSHWorker,
-		Requires: []string{K8sPortForwardWorker},
-		Retry:    true,
-		Work: func(p *supervisor.Process) (err error) {
-			// XXX: probably need some kind of keepalive check for ssh, first
-			// curl after wakeup seems to trigger detection of death
-			ssh := p.Command("ssh", "-D", "localhost:1080", "-C", "-N", "-oConnectTimeout=5",
-				"-oExitOnForwardFailure=yes", "-oStrictHostKeyChecking=no",
-				"-oUserKnownHostsFile=/dev/null", "telepresence@localhost", "-p", "8022")
-			err = ssh.Start()
+			tun, err := tunnel.Open(config, client.Namespace, teleproxyPodName, teleproxySSHPort, teleproxySSHUser)
 			if err != nil {
-				return
+				return err
+			}
+			defer tun.Close()
+			if err := tun.UDP(); err != nil {
+				p.Logf("WARNING: %v, udp through the tunnel won't work", err)
 			}
+
+			ln, err := net.Listen("tcp", socksAddress)
+			if err != nil {
+				return errors.Wrap(err, "socks proxy")
+			}
+			defer ln.Close()
+			go tunnel.ServeSOCKS(ln, tun.Dial)
+			p.Logf("tunnel to pod/%s open, socks proxy on %s", teleproxyPodName, socksAddress)
+
 			p.Ready()
-			return p.DoClean(ssh.Wait, ssh.Process.Kill)
+			select {
+			case <-p.Shutdown():
+				return nil
+			case err := <-tun.Done():
+				if err == nil {
+					err = errors.New("tunnel closed")
+				}
+				return errors.Wrap(err, "tunnel")
+			}
 		},
 	})
 }
+
+// waitForPod waits for the named pod in the client's namespace to be
+// running.
+func waitForPod(p *supervisor.Process, client *k8s.Client, name string) error {
+	for {
+		pods, err := client.SelectiveList(client.Namespace, "pods", "metadata.name="+name, "")
+		if err != nil {
+			return err
+		}
+		phase := ""
+		if len(pods) > 0 {
+			phase = pods[0].Status().GetString("phase")
+		}
+		switch phase {
+		case "Running":
+			return nil
+		case "Failed", "Succeeded":
+			return errors.Errorf("pod/%s is %s", name, phase)
+		}
+		p.Logf("waiting for pod/%s (phase %q)", name, phase)
+		select {
+		case <-p.Shutdown():
+			return errors.New("shutting down")
+		case <-time.After(time.Second):
+		}
+	}
+}